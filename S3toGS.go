@@ -1,51 +1,190 @@
 package main
 
 import (
-	"bytes"
-	"encoding/hex"
+	"encoding/base64"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-
+	"github.com/julianvmodesto/S3toGS/transfer"
 	"golang.org/x/net/context"
-	"google.golang.org/cloud/storage"
 
-	"github.com/pivotal-golang/bytefmt"
+	"code.cloudfoundry.org/bytefmt"
 )
 
 var (
-	awsProfile = flag.String("awsProfile", "", "aws profile")
-	s3Bucket   = flag.String("s3Bucket", "", "s3 bucket")
-	s3Prefix   = flag.String("s3Prefix", "", "s3 prefix")
-	localDir   = flag.String("localDir", "", "local directory")
-	gsBucket   = flag.String("gsBucket", "", "gs bucket")
-	dryRun     = flag.Bool("dryRun", false, "dry run")
+	logLevelName       = flag.String("logLevel", "info", "error, info (each object) or debug (each step, checksums and sizes)")
+	verbose            = flag.Bool("v", false, "same as -logLevel debug")
+	quiet              = flag.Bool("quiet", false, "only print errors and the summary, same as -logLevel error")
+	logFormat          = flag.String("logFormat", "text", "text, or json for one JSON object per event on stderr")
+	configFile         = flag.String("config", "", "YAML or JSON file of flag values; command line flags win")
+	awsProfile         = flag.String("awsProfile", "", "aws shared credentials profile (default credential chain if unset)")
+	awsRoleArn         = flag.String("awsRoleArn", "", "ARN of an IAM role to assume for S3, e.g. in another account")
+	awsExternalId      = flag.String("awsExternalId", "", "external ID to pass when assuming -awsRoleArn, if its trust policy requires one")
+	s3SSECustomerKey   = flag.String("s3SseCustomerKey", "", "base64 of the 256-bit key the S3 objects are encrypted with by SSE-C")
+	s3SSECustomerAlg   = flag.String("s3SseCustomerAlgorithm", "AES256", "algorithm of -s3SseCustomerKey")
+	s3RequesterPays    = flag.Bool("s3RequesterPays", false, "read s3Bucket with Requester Pays, billing your AWS account for the requests and data")
+	awsRegion          = flag.String("awsRegion", "", "aws region of s3Bucket (auto-detected if unset)")
+	s3Endpoint         = flag.String("s3Endpoint", "", "URL of an S3-compatible store to use instead of AWS, e.g. http://localhost:9000 for MinIO")
+	s3ForcePathStyle   = flag.Bool("s3ForcePathStyle", false, "address buckets by path rather than subdomain, as most S3-compatible stores need")
+	proxyURL           = flag.String("proxyUrl", "", "HTTP proxy for all S3 and GS requests, e.g. http://proxy:3128 (HTTP_PROXY, HTTPS_PROXY and NO_PROXY if unset)")
+	s3DualStack        = flag.Bool("s3DualStack", false, "reach S3 at its dual-stack endpoints, over IPv6 where available")
+	s3Bucket           = flag.String("s3Bucket", "", "s3 bucket")
+	localDir           = flag.String("localDir", "", "local directory for -useDisk (defaults to the system temp dir), or to upload with -uploadOnly")
+	gsBucket           = flag.String("gsBucket", "", "gs bucket, or several comma-separated to copy each object to all of them")
+	gsPrefix           = flag.String("gsPrefix", "", "prefix to put before each key to make its GS name")
+	stripPrefix        = flag.Bool("stripPrefix", false, "take s3Prefix off each key before adding gsPrefix")
+	keyRegex           = flag.String("keyRegex", "", "regexp rewriting each key into its GS name with -keyReplace; keys it doesn't match are left alone")
+	keyReplace         = flag.String("keyReplace", "", "replacement for -keyRegex matches, where $1 is the first group")
+	gcpCredentialsFile = flag.String("gcpCredentialsFile", "", "service account key file for GS, instead of Application Default Credentials")
+	gsUserProject      = flag.String("gsUserProject", "", "project to bill GS requests to, needed for buckets with Requester Pays enabled")
+	contentType        = flag.String("contentType", "", "content type for every uploaded object (source object's if unset)")
+	gsStorageClass     = flag.String("gsStorageClass", "", "storage class for uploaded gs objects (bucket default if unset)")
+	dryRun             = flag.Bool("dryRun", false, "dry run")
+	planFormat         = flag.String("plan", "", "with -dryRun, print what would be done with each object and why, as table, csv or json")
+	listOnly           = flag.String("listOnly", "", "only print the S3 objects that pass the filters, as plain keys, csv or json, transferring nothing")
+	verify             = flag.Bool("verify", false, "only compare S3 with GS and report differences, transferring nothing")
+	repair             = flag.Bool("repair", false, "like -verify, but transfer again each object whose size or checksum differs")
+	verifyContent      = flag.Bool("verifyContent", false, "like -verify, but download each object from S3 and read it from GS, comparing checksums of the bytes themselves")
+	verifySample       = flag.Float64("verifySample", 1, "with -verifyContent, the fraction of objects picked at random to check the content of, e.g. 0.05; the rest are verified by metadata")
+	direction          = flag.String("direction", "s3-to-gs", "s3-to-gs or gs-to-s3")
+	concurrency        = flag.Int("concurrency", 8, "number of objects to transfer at once")
+	compareConcurrency = flag.Int("compareConcurrency", 32, "number of objects to compare with the destination at once, ahead of the transfers")
+	checksum           = flag.String("checksum", "md5", "checksum to compare with GS: md5, crc32c or auto (crc32c when GS has no md5)")
+	storeSourceMD5     = flag.Bool("storeSourceMd5", false, "store the MD5 of objects whose ETag isn't one in GS metadata x-source-md5, for later runs to compare by")
+	multipartFallback  = flag.String("multipartFallback", "size", "how to compare multipart S3 objects, whose ETag isn't an MD5: size, hash (download and hash) or transfer")
+	compareMode        = flag.String("compareMode", "both", "what must match to skip an object: size, hash or both")
+	conflict           = flag.String("conflict", "compare", "what to do with objects already in the destination: compare (skip if -compareMode matches), skip, overwrite, or newer (overwrite if the source was modified since)")
+	maxRetries         = flag.Int("maxRetries", 3, "times to retry an object after a transient error")
+	awsMaxRetries      = flag.Int("awsMaxRetries", 0, "times the AWS SDK retries each S3 request within an attempt (0 for its default of 3, -1 for none)")
+	failFast           = flag.Bool("failFast", false, "abort the run when an object can't be synced")
+	deleteExtra        = flag.Bool("delete", false, "after syncing, delete destination objects under s3Prefix that aren't in the source (requires -yes)")
+	yes                = flag.Bool("yes", false, "go ahead with destructive operations such as -delete without asking")
+	deleteSource       = flag.Bool("deleteSource", false, "delete each S3 object once its upload to GS is checked, moving rather than copying (requires -yes)")
+	bandwidthLimit     = flag.String("bandwidthLimit", "", "cap on combined download and upload throughput, e.g. 50MB/s (unlimited if unset)")
+	stateFilePath      = flag.String("stateFile", "", "file recording the objects found in sync, so a rerun can skip them")
+	resume             = flag.Bool("resume", true, "skip the objects recorded in -stateFile; false starts it afresh")
+	useDisk            = flag.Bool("useDisk", false, "download each object to localDir before uploading instead of streaming")
+	uploadOnly         = flag.Bool("uploadOnly", false, "upload the files under localDir to gsBucket, keyed by their relative paths, instead of copying from S3")
+	fileMode           = flag.String("fileMode", "0600", "octal permissions of the files written locally: staged downloads, -stateFile, -reportFile and -diffReport")
+	dirMode            = flag.String("dirMode", "0700", "octal permissions of the directories made under localDir for staged downloads")
+	flatten            = flag.Bool("flatten", false, "with -useDisk, stage files directly in localDir, named by a hash of the key and its last element, rather than under the key's directories")
+	cacheControl       = flag.String("cacheControl", "", "Cache-Control for uploaded objects (defaults to the source object's)")
+	contentLanguage    = flag.String("contentLanguage", "", "Content-Language for uploaded objects (defaults to the source object's)")
+	contentDisposition = flag.String("contentDisposition", "", "Content-Disposition for uploaded objects (defaults to the source object's)")
+	compress           = flag.Bool("compress", false, "gzip objects on their way to GS, stored with Content-Encoding gzip; see -compressInclude and -compressType")
+	noTranscode        = flag.Bool("noTranscode", false, "stop GS decompressing gzip-encoded objects when serving them")
+	minSize            = flag.String("minSize", "", "skip objects smaller than this, e.g. 1M")
+	skipFolders        = flag.Bool("skipFolders", false, "skip folder placeholders, empty objects whose key ends in /, such as the S3 console makes")
+	modifiedAfter      = flag.String("modifiedAfter", "", "skip objects last modified before this, as RFC3339 or a duration ago like 24h")
+	maxSize            = flag.String("maxSize", "", "skip objects larger than this, e.g. 5G (no limit if unset)")
+	maxObjects         = flag.Int("maxObjects", 0, "stop after this many objects (no limit if 0), counted as given by -maxObjectsCount")
+	maxObjectsCount    = flag.String("maxObjectsCount", "considered", "what -maxObjects counts: considered (listed) or transferred objects")
+	gsKmsKey           = flag.String("gsKmsKey", "", "Cloud KMS key to encrypt uploaded objects with, projects/P/locations/L/keyRings/R/cryptoKeys/K (the bucket default if unset)")
+	copyTags           = flag.Bool("copyTags", false, "copy S3 object tags to GS metadata named s3-tag-<tag>, at the cost of a request per object")
+	copyACL            = flag.Bool("copyAcl", false, "give each object the GS predefined ACL nearest its S3 ACL, at the cost of a request per object")
+	gsPredefinedACL    = flag.String("gsPredefinedAcl", "", "GS predefined ACL for every uploaded object, e.g. publicRead, whatever its S3 ACL")
+	reportFilePath     = flag.String("reportFile", "", "file to write a line of JSON to for every object: its action, size, checksum and any error")
+	diffReport         = flag.String("diffReport", "", "only list s3Prefix and GS and write how each object compares to this file, as CSV if it ends in .csv and JSON lines otherwise, transferring nothing")
+	listDestination    = flag.Bool("listDestination", true, "list the GS objects under s3Prefix up front rather than looking each key up")
+	webhookURL         = flag.String("webhookUrl", "", "URL to POST the run's summary to when it ends, whatever the outcome")
+	webhookFormat      = flag.String("webhookFormat", "json", "webhook payload: json, or slack for a Slack incoming webhook")
+	metricsAddr        = flag.String("metricsAddr", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100")
+	otlpEndpoint       = flag.String("otlpEndpoint", "", "OpenTelemetry collector to send traces to over OTLP/HTTP, e.g. http://localhost:4318 (OTEL_EXPORTER_OTLP_ENDPOINT if unset; no tracing if neither)")
+	serveAddr          = flag.String("serve", "", "address to serve the job API on, e.g. :8080, instead of running one job")
+	watch              = flag.Bool("watch", false, "keep running, syncing again every -interval until interrupted")
+	watchInterval      = flag.Duration("interval", 5*time.Minute, "with -watch, how often to start a pass")
+	restoreDays        = flag.Int("restoreDays", 0, "request a restored copy of GLACIER and DEEP_ARCHIVE objects for this many days (skip them if 0)")
+	restoreTier        = flag.String("restoreTier", "Standard", "with -restoreDays, the retrieval tier: Standard, Bulk or Expedited")
+	restoreWait        = flag.Duration("restoreWait", 0, "with -restoreDays, wait this long for each restore rather than skipping the object for a later run")
+	inventoryManifest  = flag.String("inventoryManifest", "", "s3://bucket/key of the manifest.json of an S3 Inventory report of s3Bucket, to sync from instead of listing s3Prefix")
+	keysFile           = flag.String("keysFile", "", "file of keys to sync, one per line, instead of listing s3Prefix")
+	sqsQueueURL        = flag.String("sqsQueueUrl", "", "sync the objects announced by S3 event notifications on this SQS queue, until interrupted, instead of listing s3Prefix")
+	listShards         = flag.Int("listShards", 0, "list the S3 prefixes one path segment below s3Prefix this many at a time, for huge buckets")
+	s3VersionID        = flag.String("s3VersionId", "", "sync just this version of the key s3Prefix, to GS as key@versionId")
+	allVersions        = flag.Bool("allVersions", false, "sync every version of each S3 object, to GS as key@versionId, rather than only the latest")
+	runTimeout         = flag.Duration("timeout", 0, "abort the whole run after this long, e.g. 6h, printing the summary so far (no limit if 0)")
+	objectTimeout      = flag.Duration("objectTimeout", 0, "give up on one attempt at transferring an object after this long, e.g. 10m (no limit if 0)")
+	showProgress       = flag.Bool("progress", false, "show objects done, amount sent, throughput and ETA on stderr as the run goes")
+	pprofAddr          = flag.String("pprofAddr", "", "address to serve net/http/pprof on during the run, e.g. localhost:6060")
+	cpuProfile         = flag.String("cpuProfile", "", "file to write a CPU profile of the run to")
+	memProfile         = flag.String("memProfile", "", "file to write a heap profile to at the end of the run")
+	connectTimeout     = flag.Duration("connectTimeout", 30*time.Second, "give up on setting up the GS client after this long (no limit if 0)")
+
+	// Each -useDisk download buffers up to downloadConcurrency parts of
+	// downloadPartSize in memory, times -concurrency objects at once.
+	downloadConcurrency = flag.Int("downloadConcurrency", s3manager.DefaultDownloadConcurrency, "parts of one object to download at once with -useDisk")
+	downloadPartSize    = flag.String("downloadPartSize", "5M", "size of each part downloaded, at least 5M; streamed parts are downloaded one at a time")
+
+	// Each GS upload buffers a chunk, times -concurrency objects at once.
+	gsChunkSize = flag.String("gsChunkSize", "16M", "size of each request of a resumable GS upload, a multiple of 256K; 0 uploads each object in one request")
+)
+
+// Repeatable flags
+var (
+	extraMetadata = keyValues{}
+	mimeTypes     = keyValues{}
+	includes      patterns
+	excludes      patterns
+	s3Prefix      prefixes
+
+	compressIncludes patterns
+	compressTypes    patterns
 )
 
+func init() {
+	flag.Var(&s3Prefix, "s3Prefix", "key prefix to list in the source bucket, or prefix=>gsPrefix to sync it under gsPrefix instead; repeatable, to sync several prefixes in one run")
+	flag.Var(extraMetadata, "metadata", "k=v custom metadata to add to every uploaded object, repeatable")
+	flag.Var(mimeTypes, "mimeMap", ".ext=type content type for keys with that extension whose source has none, over the built-in map, repeatable")
+	flag.Var(&includes, "include", "only sync keys matching this glob, repeatable")
+	flag.Var(&excludes, "exclude", "don't sync keys matching this glob, repeatable; wins over -include")
+	flag.Var(&compressIncludes, "compressInclude", "with -compress, only compress keys matching this glob, repeatable")
+	flag.Var(&compressTypes, "compressType", "with -compress, only compress content types matching this glob, e.g. text/*, repeatable")
+}
+
+// Exit codes
+const (
+	exitPartialFailure = 2   // the run finished but some objects didn't sync
+	exitConfigError    = 3   // bad flags or config, nothing was attempted
+	exitFatalError     = 4   // couldn't connect, authenticate or list
+	exitTimedOut       = 5   // aborted at -timeout
+	exitInterrupted    = 130 // SIGINT/SIGTERM, as with shells
+)
+
+var exitReasons = map[int]string{
+	exitPartialFailure: "partial failure",
+	exitConfigError:    "configuration error",
+	exitFatalError:     "fatal error",
+	exitTimedOut:       "timed out",
+	exitInterrupted:    "interrupted",
+}
+
 // Exit struct helper
 type Exit struct{ Code int }
 
+// fail logs v and exits with code through handleExit.
+func fail(code int, v ...interface{}) {
+	logger.Error(transfer.Event{Action: "error"}, v...)
+	panic(Exit{code})
+}
+
 // exit code handler
 // http://stackoverflow.com/a/27630092/1881379
 func handleExit() {
 	if e := recover(); e != nil {
 		if exit, ok := e.(Exit); ok == true {
+			notify(exit.Code)
+			logger.Error(transfer.Event{Action: "exit"}, "Exiting with code", exit.Code, exitReasons[exit.Code])
 			os.Exit(exit.Code)
 		}
 		panic(e) // not an Exit, bubble up
 	}
+	notify(0)
 	os.Exit(0)
 }
 
@@ -53,33 +192,28 @@ func handleExit() {
 // https://coderwall.com/p/cp5fya/measuring-execution-time-in-go
 func timeTrack(start time.Time, name string) {
 	elapsed := time.Since(start)
-	log.Printf("%s took %s", name, elapsed)
+	logger.Error(transfer.Event{Action: "timing", Duration: elapsed}, name, "took", elapsed)
 }
 
-func writeToGS(file *os.File, w *storage.Writer) error {
-	var content io.Reader
-	content, err := os.Open(file.Name())
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	const maxSlurp = 1 << 20
-	var buf bytes.Buffer
-	n, err := io.CopyN(&buf, content, maxSlurp)
-	if err != nil && err != io.EOF {
-		log.Fatalf("Error reading from stdin: %v, %v", n, err)
-		return err
-	}
-	w.ContentType = http.DetectContentType(buf.Bytes())
-	_, err = io.Copy(w, io.MultiReader(&buf, content))
-	if cerr := w.Close(); cerr != nil && err == nil {
-		err = cerr
-	}
-	if err != nil {
-		log.Fatalf("Write error: %v", err)
-		return err
-	}
-	return nil
+// logger is replaced once the log flags are parsed.
+var logger, _ = transfer.NewLogger(transfer.LevelInfo, "text")
+
+// handleSignals closes stop on the first SIGINT/SIGTERM so no new objects
+// are picked up while in-flight transfers finish. A second signal cancels
+// the in-flight transfers, which removes their staged files; a third
+// exits straight away.
+func handleSignals(stop chan<- struct{}, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Error(transfer.Event{Action: "signal"}, "Received", sig, "finishing in-flight transfers, repeat to abort")
+	close(stop)
+
+	sig = <-signals
+	logger.Error(transfer.Event{Action: "signal"}, "Received", sig, "aborting")
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	cancel()
 }
 
 func main() {
@@ -88,98 +222,342 @@ func main() {
 
 	flag.Parse()
 
-	// Set up AWS clients
-	awsSession := session.New(&aws.Config{
-		Region:      aws.String("us-east-1"),
-		Credentials: credentials.NewSharedCredentials("", *awsProfile),
-	})
-	s3Client := s3.New(awsSession)
-	s3Downloader := s3manager.NewDownloader(awsSession)
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			fail(exitConfigError, err)
+		}
+	}
 
-	// Set up GCP clients
-	gcpContext := context.Background()
-	gsClient, err := storage.NewClient(gcpContext)
+	if err := validateFlags(); err != nil {
+		fail(exitConfigError, err, "(see -h for usage)")
+	}
+
+	level, err := transfer.ParseLevel(*logLevelName)
 	if err != nil {
-		log.Fatal(err)
-		panic(Exit{1})
+		fail(exitConfigError, err)
+	}
+	switch {
+	case *verbose && *quiet:
+		fail(exitConfigError, "-v and -quiet can't be combined")
+	case *verbose:
+		level = transfer.LevelDebug
+	case *quiet:
+		level = transfer.LevelError
+	}
+	if logger, err = transfer.NewLogger(level, *logFormat); err != nil {
+		logger, _ = transfer.NewLogger(level, "text")
+		fail(exitConfigError, "Unknown -logFormat", *logFormat)
 	}
-	defer gsClient.Close()
 
-	// S3 List
-	s3List, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(*s3Bucket),
-		Prefix: aws.String(*s3Prefix),
-	})
+	if *webhookFormat != "json" && *webhookFormat != "slack" {
+		fail(exitConfigError, "Unknown -webhookFormat", *webhookFormat)
+	}
+	if *planFormat != "" && !planFormats[*planFormat] {
+		fail(exitConfigError, "Unknown -plan", *planFormat)
+	}
+	if *listOnly != "" && !listFormats[*listOnly] {
+		fail(exitConfigError, "Unknown -listOnly", *listOnly)
+	}
+
+	stopProfiling, err := startProfiling(*pprofAddr, *cpuProfile, *memProfile)
+	if err != nil {
+		fail(exitConfigError, err)
+	}
+	defer stopProfiling()
+
+	partSize, err := bytefmt.ToBytes(*downloadPartSize)
+	if err != nil {
+		fail(exitConfigError, "Invalid -downloadPartSize", *downloadPartSize, err)
+	}
+	chunkSize := -1
+	if *gsChunkSize != "0" {
+		size, err := bytefmt.ToBytes(*gsChunkSize)
+		if err != nil {
+			fail(exitConfigError, "Invalid -gsChunkSize", *gsChunkSize, err)
+		}
+		chunkSize = int(size)
+	}
+	minObjectSize, err := parseSize(*minSize)
+	if err != nil {
+		fail(exitConfigError, "Invalid -minSize", *minSize, err)
+	}
+	maxObjectSize, err := parseSize(*maxSize)
+	if err != nil {
+		fail(exitConfigError, "Invalid -maxSize", *maxSize, err)
+	}
+	cutoff, err := parseModifiedAfter(*modifiedAfter, time.Now())
+	if err != nil {
+		fail(exitConfigError, "Invalid -modifiedAfter", *modifiedAfter, err)
+	}
+	bytesPerSecond, err := parseBandwidth(*bandwidthLimit)
+	if err != nil {
+		fail(exitConfigError, "Invalid -bandwidthLimit", err)
+	}
+	filePerm, err := parseMode(*fileMode)
+	if err != nil {
+		fail(exitConfigError, "Invalid -fileMode", err)
+	}
+	dirPerm, err := parseMode(*dirMode)
 	if err != nil {
-		log.Fatal(err)
-		panic(Exit{1})
-	}
-
-	amtTransferred := uint64(0)
-
-	for _, key := range s3List.Contents {
-		gsAttrs, gsErr := gsClient.Bucket(*gsBucket).Object(*key.Key).Attrs(gcpContext)
-
-		s3MD5 := strings.Replace(*key.ETag, "\"", "", -1)
-		s3Size := *key.Size
-
-		localFilepath := filepath.Join(*localDir, filepath.Base(*key.Key))
-
-		if gsErr != nil || // doesn't exist in GS
-			!strings.EqualFold(s3MD5, hex.EncodeToString(gsAttrs.MD5)) ||
-			s3Size != gsAttrs.Size {
-
-			if gsErr == nil && strings.EqualFold(s3MD5, hex.EncodeToString(gsAttrs.MD5)) {
-				fmt.Println("Hash matches, skipping", *key.Key)
-			} else if gsErr == nil && s3Size == gsAttrs.Size {
-				fmt.Println("Size matches, skipping", *key.Key)
-			} else if *dryRun {
-				amtTransferred += uint64(s3Size)
-				fmt.Println("Would download/upload", *key.Key)
-			} else {
-				amtTransferred += uint64(s3Size)
-
-				// Create local file path and file
-				err := os.MkdirAll(filepath.Dir(localFilepath), 0777)
-				if err != nil {
-					log.Fatal("Failed to create dirs", err)
-					panic(Exit{1})
-				}
-				file, err := os.Create(localFilepath)
-				if err != nil {
-					log.Fatal("Failed to create file", err)
-					panic(Exit{1})
-				}
-				defer file.Close()
-
-				// Download from S3
-				fmt.Println("Downloading from S3", *key.Key, "to", localFilepath)
-				s3Downloader.Download(file,
-					&s3.GetObjectInput{
-						Bucket: aws.String(*s3Bucket),
-						Key:    aws.String(*key.Key),
-					})
-
-				// Upload to GS
-				// https://github.com/golang/build/blob/master/cmd/upload/upload.go
-				fmt.Println("Uploading", localFilepath, "to GS at", *key.Key)
-				w := gsClient.Bucket(*gsBucket).Object(*key.Key).NewWriter(gcpContext)
-				writeToGS(file, w)
-
-				// Delete local file
-				fmt.Println("Removing", file.Name())
-				os.Remove(file.Name())
-
-				gsAttrs, gsErr := gsClient.Bucket(*gsBucket).Object(*key.Key).Attrs(gcpContext)
-				if gsErr != nil || s3Size != gsAttrs.Size {
-					log.Fatal("Upload failed")
-					panic(Exit{1})
-				}
-			}
-		} else {
-			fmt.Println("Already in GS, skipping", *key.Key)
+		fail(exitConfigError, "Invalid -dirMode", err)
+	}
+	sseKey, err := base64.StdEncoding.DecodeString(*s3SSECustomerKey)
+	if err != nil {
+		fail(exitConfigError, "Invalid -s3SseCustomerKey, which must be base64:", err)
+	}
+	var sseAlgorithm string
+	if len(sseKey) > 0 {
+		sseAlgorithm = *s3SSECustomerAlg
+	}
+
+	gsBuckets := strings.Split(*gsBucket, ",")
+	syncPrefixes := s3Prefix.parse(*gsPrefix, *stripPrefix)
+
+	stop := make(chan struct{})
+	cfg := transfer.Config{
+		Direction:      *direction,
+		S3Bucket:       *s3Bucket,
+		S3Prefix:       syncPrefixes[0].S3,
+		GSBucket:       gsBuckets[0],
+		ExtraGSBuckets: gsBuckets[1:],
+		GSPrefix:       syncPrefixes[0].GS,
+		StripPrefix:    syncPrefixes[0].Strip,
+		ExtraPrefixes:  syncPrefixes[1:],
+		KeyRegex:       *keyRegex,
+		KeyReplace:     *keyReplace,
+		GSUserProject:  *gsUserProject,
+
+		GCPCredentialsFile: *gcpCredentialsFile,
+		AWSProfile:         *awsProfile,
+		AWSRegion:          *awsRegion,
+		AWSRoleARN:         *awsRoleArn,
+		AWSExternalID:      *awsExternalId,
+
+		S3SSECustomerKey:       string(sseKey),
+		S3SSECustomerAlgorithm: sseAlgorithm,
+		S3RequesterPays:        *s3RequesterPays,
+
+		S3Endpoint:       *s3Endpoint,
+		S3ForcePathStyle: *s3ForcePathStyle,
+		S3DualStack:      *s3DualStack,
+		ProxyURL:         *proxyURL,
+
+		Includes:          includes,
+		Excludes:          excludes,
+		MinSize:           minObjectSize,
+		MaxSize:           maxObjectSize,
+		ModifiedAfter:     cutoff,
+		SkipFolders:       *skipFolders,
+		MaxObjects:        *maxObjects,
+		MaxObjectsCount:   *maxObjectsCount,
+		KeysFile:          *keysFile,
+		InventoryManifest: *inventoryManifest,
+		RestoreDays:       *restoreDays,
+		RestoreTier:       *restoreTier,
+		RestoreWait:       *restoreWait,
+		ListShards:        *listShards,
+		SQSQueueURL:       *sqsQueueURL,
+		S3VersionID:       *s3VersionID,
+		AllVersions:       *allVersions,
+
+		CompareMode:               *compareMode,
+		Conflict:                  *conflict,
+		Checksum:                  *checksum,
+		MultipartFallback:         *multipartFallback,
+		StoreSourceMD5:            *storeSourceMD5,
+		DisableDestinationListing: !*listDestination,
+
+		ContentType:        *contentType,
+		MimeTypes:          mimeTypes,
+		CacheControl:       *cacheControl,
+		ContentLanguage:    *contentLanguage,
+		ContentDisposition: *contentDisposition,
+		StorageClass:       *gsStorageClass,
+		KMSKey:             *gsKmsKey,
+		NoTranscode:        *noTranscode,
+		Compress:           *compress,
+		CompressIncludes:   compressIncludes,
+		CompressTypes:      compressTypes,
+		CopyTags:           *copyTags,
+		Metadata:           extraMetadata,
+
+		CopyACL:       *copyACL,
+		PredefinedACL: *gsPredefinedACL,
+
+		DryRun: *dryRun,
+		Plan:   *planFormat != "",
+		Verify: *verify,
+		Repair: *repair,
+
+		VerifyContent: *verifyContent,
+		VerifySample:  *verifySample,
+		Delete:        *deleteExtra,
+
+		DeleteSource: *deleteSource,
+
+		Concurrency:        *concurrency,
+		CompareConcurrency: *compareConcurrency,
+		MaxRetries:         *maxRetries,
+		AWSMaxRetries:      *awsMaxRetries,
+		FailFast:           *failFast,
+		ObjectTimeout:      *objectTimeout,
+		ConnectTimeout:     *connectTimeout,
+		BandwidthLimit:     bytesPerSecond,
+
+		UseDisk:             *useDisk,
+		LocalDir:            *localDir,
+		UploadOnly:          *uploadOnly,
+		Flatten:             *flatten,
+		DownloadConcurrency: *downloadConcurrency,
+		DownloadPartSize:    int64(partSize),
+		FileMode:            filePerm,
+		DirMode:             dirPerm,
+		GSChunkSize:         chunkSize,
+
+		StateFile:     *stateFilePath,
+		DisableResume: !*resume,
+		ReportFile:    *reportFilePath,
+		DiffReport:    *diffReport,
+
+		Stop:   stop,
+		Logger: logger,
+	}
+
+	if err := confirm(cfg); err != nil {
+		fail(exitConfigError, err)
+	}
+
+	// Cancelled on a second interrupt or after -timeout to abort in-flight
+	// transfers, each attempt ending at whichever of that and
+	// -objectTimeout comes first
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *runTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *runTimeout)
+		defer cancelTimeout()
+	}
+	go handleSignals(stop, cancel)
+
+	var progress *progressPrinter
+	if *showProgress {
+		progress = newProgressPrinter(*logFormat == "json")
+		cfg.Progress = progress.show
+		cfg.ProgressInterval = progress.interval()
+	}
+
+	if *metricsAddr != "" {
+		metrics := newPromMetrics()
+		stopMetrics, err := serveMetrics(*metricsAddr, metrics)
+		if err != nil {
+			fail(exitConfigError, err)
+		}
+		defer stopMetrics()
+		cfg.Metrics = metrics
+	}
+	if url := otlpTracesURL(*otlpEndpoint); url != "" {
+		provider, err := newTracerProvider(url)
+		if err != nil {
+			fail(exitConfigError, err)
+		}
+		defer shutdownTracing(provider)
+		cfg.TracerProvider = provider
+	}
+
+	if *serveAddr != "" {
+		runServer(ctx, cfg, stop)
+		return
+	}
+	if *watch {
+		runWatch(ctx, cfg, progress)
+		return
+	}
+	if *listOnly != "" {
+		runList(ctx, cfg)
+		return
+	}
+
+	result, err := transfer.Transfer(ctx, cfg)
+	if progress != nil {
+		progress.done()
+	}
+	var configErr *transfer.ConfigError
+	if !errors.As(err, &configErr) {
+		finished = &runOutcome{result, err}
+	}
+	switch {
+	case errors.As(err, &configErr):
+		fail(exitConfigError, err)
+	case ctx.Err() == context.DeadlineExceeded:
+		logger.Summary(result.Totals())
+		fail(exitTimedOut, "Timed out after", *runTimeout, "with", result.Transferred, "objects transferred")
+	case errors.Is(err, context.Canceled):
+		logger.Summary(result.Totals())
+		fail(exitInterrupted, "Aborted")
+	case err != nil:
+		fail(exitFatalError, err)
+	}
+
+	printResult(result)
+
+	switch {
+	case result.Failed > 0 && *failFast:
+		fail(exitPartialFailure, "Stopped at the first failure")
+	case result.Stopped:
+		fail(exitInterrupted, "Interrupted before all objects were synced")
+	case result.Failed > 0:
+		fail(exitPartialFailure, result.Failed, "objects failed to sync")
+	case result.SourceDeleteFailed > 0:
+		fail(exitPartialFailure, result.SourceDeleteFailed, "objects were copied but couldn't be deleted from S3")
+	case result.Discrepancies():
+		fail(exitPartialFailure, "Some objects are missing or differ")
+	}
+}
+
+// printResult shows the plan, the summary and the failures of a run.
+func printResult(result transfer.Result) {
+	if *planFormat != "" {
+		if err := printPlan(os.Stdout, *planFormat, result.Plan); err != nil {
+			logger.Error(transfer.Event{Action: "warning", Err: err}, "Couldn't print the plan:")
 		}
 	}
+	logger.Summary(result.Totals())
+	for _, f := range result.Failures {
+		logger.Error(transfer.Event{Action: "failure", Key: f.Key, Err: f.Err}, "Failed:", f.Key)
+	}
+	if result.Failed > uint64(len(result.Failures)) {
+		logger.Error(transfer.Event{Action: "failure"}, "and", result.Failed-uint64(len(result.Failures)), "more")
+	}
+	if result.MoreRemain {
+		logger.Info(transfer.Event{Action: "limit"}, "Stopped at -maxObjects", *maxObjects, "with more objects left to sync")
+	}
+}
 
-	fmt.Println("Amount transferred", bytefmt.ByteSize(amtTransferred))
+// runWatch syncs every -interval until interrupted, with a summary per
+// pass. A pass that fails is logged and the next one tried; stopping
+// between passes, or letting the pass underway finish, exits 0.
+func runWatch(ctx context.Context, cfg transfer.Config, progress *progressPrinter) {
+	err := transfer.Watch(ctx, cfg, *watchInterval, func(result transfer.Result, err error) {
+		if progress != nil {
+			progress.done()
+		}
+		var configErr *transfer.ConfigError
+		switch {
+		case errors.As(err, &configErr):
+			return
+		case err != nil && !errors.Is(err, context.Canceled):
+			logger.Error(transfer.Event{Action: "pass-failed", Err: err}, "Pass failed, trying again in", *watchInterval, "after:")
+			return
+		}
+		printResult(result)
+	})
+	var configErr *transfer.ConfigError
+	switch {
+	case errors.As(err, &configErr):
+		fail(exitConfigError, err)
+	case err != nil:
+		fail(exitFatalError, err)
+	case ctx.Err() != nil:
+		fail(exitInterrupted, "Aborted")
+	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// endpoints are where the run copies from and to, as URLs.
+func endpoints() (source, dest string) {
+	var sources []string
+	for _, p := range s3Prefix.parse(*gsPrefix, *stripPrefix) {
+		sources = append(sources, "s3://"+*s3Bucket+"/"+p.S3)
+	}
+	source, dest = strings.Join(sources, ","), "gs://"+*gsBucket+"/"+*gsPrefix
+	if *uploadOnly {
+		source = *localDir
+	}
+	if *direction == transfer.GSToS3 {
+		source, dest = dest, source
+	}
+	return source, dest
+}
+
+// destructiveCounts are how many objects a run would delete or
+// overwrite, found by a dry run of it.
+type destructiveCounts struct {
+	deleted, sourceDeleted, overwritten uint64
+}
+
+// countDestructive dry runs cfg to count what it would delete and
+// overwrite. Overwrites are counted from the plan, which several GS
+// buckets and verifying don't make.
+func countDestructive(cfg transfer.Config) (destructiveCounts, error) {
+	cfg.DryRun = true
+	cfg.Plan = len(cfg.ExtraGSBuckets) == 0 && !cfg.Verify
+	cfg.ReportFile = ""
+	if cfg.DisableResume {
+		// Truncated otherwise, before the run itself reads it
+		cfg.StateFile = ""
+	}
+	quiet, err := transfer.NewLogger(transfer.LevelError, *logFormat)
+	if err != nil {
+		return destructiveCounts{}, err
+	}
+	cfg.Logger = quiet
+	result, err := transfer.Transfer(context.Background(), cfg)
+	if err != nil {
+		return destructiveCounts{}, err
+	}
+	counts := destructiveCounts{deleted: uint64(result.Deleted), sourceDeleted: result.SourceWouldDelete}
+	for _, entry := range result.Plan {
+		if entry.Action == "transfer" && entry.Reason != "new" {
+			counts.overwritten++
+		}
+	}
+	return counts, nil
+}
+
+// objectCount is n objects, in words.
+func objectCount(n uint64) string {
+	if n == 1 {
+		return "1 object"
+	}
+	return fmt.Sprint(n, " objects")
+}
+
+// destructiveActions describes what the run will delete, and with counts
+// how many objects it will delete and overwrite, or is empty if it
+// deletes nothing. Jobs of -serve are gated on -yes instead.
+func destructiveActions(counts *destructiveCounts) []string {
+	if *dryRun || *serveAddr != "" {
+		return nil
+	}
+	source, dest := endpoints()
+	var actions []string
+	if *deleteExtra {
+		if counts != nil {
+			actions = append(actions, "delete "+objectCount(counts.deleted)+" from "+dest+" that aren't under "+source)
+		} else {
+			actions = append(actions, "delete every object under "+dest+" that isn't under "+source)
+		}
+	}
+	if *deleteSource {
+		if counts != nil {
+			actions = append(actions, "delete "+objectCount(counts.sourceDeleted)+" from "+source+" once they're copied to "+dest)
+		} else {
+			actions = append(actions, "delete each object under "+source+" once it's copied to "+dest)
+		}
+	}
+	if counts != nil && counts.overwritten > 0 {
+		actions = append(actions, "overwrite "+objectCount(counts.overwritten)+" in "+dest)
+	}
+	return actions
+}
+
+// confirm asks before a run of cfg that deletes objects, unless -yes was
+// passed: it counts, with a dry run, and lists what will be deleted and
+// overwritten, and goes ahead only if "yes" is typed. Without a terminal
+// to ask on it refuses.
+func confirm(cfg transfer.Config) error {
+	if len(destructiveActions(nil)) == 0 || *yes {
+		return nil
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("this run would %s; pass -yes to confirm", strings.Join(destructiveActions(nil), " and "))
+	}
+	fmt.Fprintln(os.Stderr, "Counting what this run will delete...")
+	counts, err := countDestructive(cfg)
+	if err != nil {
+		return fmt.Errorf("counting what would be deleted: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "This run will:")
+	for _, action := range destructiveActions(&counts) {
+		fmt.Fprintln(os.Stderr, "  -", action)
+	}
+	fmt.Fprint(os.Stderr, `Type "yes" to go ahead: `)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("not confirmed, nothing was done")
+	}
+	return nil
+}
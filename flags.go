@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// keyValues is a repeatable k=v flag.
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return fmt.Errorf("expected k=v, got %q", value)
+	}
+	kv[value[:i]] = value[i+1:]
+	return nil
+}
+
+// patterns is a repeatable glob flag.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return err
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// prefixes is the repeatable -s3Prefix flag. Each value is a prefix to
+// sync, or prefix=>gsPrefix to sync it under gsPrefix in its place,
+// whatever -gsPrefix and -stripPrefix say. "=>" rather than "=" as keys
+// often hold "=", as in year=2024/.
+type prefixes []string
+
+func (p *prefixes) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *prefixes) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// parse returns the prefixes to sync, at least one, the first being
+// Config.S3Prefix. gsPrefix and strip apply to those without a GS prefix
+// of their own.
+func (p prefixes) parse(gsPrefix string, strip bool) []transfer.Prefix {
+	if len(p) == 0 {
+		return []transfer.Prefix{{GS: gsPrefix, Strip: strip}}
+	}
+	parsed := make([]transfer.Prefix, len(p))
+	for i, value := range p {
+		if j := strings.Index(value, "=>"); j >= 0 {
+			parsed[i] = transfer.Prefix{S3: value[:j], GS: value[j+2:], Strip: true}
+		} else {
+			parsed[i] = transfer.Prefix{S3: value, GS: gsPrefix, Strip: strip}
+		}
+	}
+	return parsed
+}
+
+// flagDependencies are flags that only mean something alongside another.
+var flagDependencies = []struct{ flag, needs string }{
+	{"uploadOnly", "localDir"},
+	{"flatten", "useDisk"},
+	{"downloadConcurrency", "useDisk"},
+	{"keyReplace", "keyRegex"},
+	{"stripPrefix", "s3Prefix"},
+	{"awsExternalId", "awsRoleArn"},
+	{"maxObjectsCount", "maxObjects"},
+	{"resume", "stateFile"},
+	{"s3VersionId", "s3Prefix"},
+	{"plan", "dryRun"},
+	{"verifySample", "verifyContent"},
+	{"interval", "watch"},
+	{"restoreTier", "restoreDays"},
+	{"restoreWait", "restoreDays"},
+	{"webhookFormat", "webhookUrl"},
+	{"s3SseCustomerAlgorithm", "s3SseCustomerKey"},
+	{"compressInclude", "compress"},
+	{"compressType", "compress"},
+}
+
+// validateFlags checks the flags, from the command line and -config,
+// describe a job before anything is attempted.
+func validateFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// With -serve each job names its buckets, -listOnly needs no GS
+	// bucket and -uploadOnly no S3 one
+	for _, name := range []string{"s3Bucket", "gsBucket"} {
+		if flag.Lookup(name).Value.String() == "" && *serveAddr == "" &&
+			(name != "gsBucket" || *listOnly == "") && (name != "s3Bucket" || !*uploadOnly) {
+			return fmt.Errorf("-%s is required", name)
+		}
+	}
+	if set["localDir"] && !*useDisk && !*uploadOnly {
+		return errors.New("-localDir needs -useDisk or -uploadOnly")
+	}
+	for _, d := range flagDependencies {
+		if set[d.flag] && !set[d.needs] {
+			return fmt.Errorf("-%s needs -%s", d.flag, d.needs)
+		}
+	}
+	if *runTimeout > 0 && (*watch || *serveAddr != "") {
+		return errors.New("-timeout caps a single run and can't be combined with -watch or -serve")
+	}
+	if *listOnly != "" && (*watch || *serveAddr != "") {
+		return errors.New("-listOnly prints one listing and can't be combined with -watch or -serve")
+	}
+	if *diffReport != "" && *serveAddr != "" {
+		return errors.New("-diffReport writes one local file and can't be combined with -serve")
+	}
+	if *uploadOnly && *serveAddr != "" {
+		return errors.New("-uploadOnly uploads this machine's files and can't be combined with -serve")
+	}
+	return nil
+}
+
+// parseSize parses a -minSize or -maxSize value, where "" means zero.
+func parseSize(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return bytefmt.ToBytes(value)
+}
+
+// parseModifiedAfter parses a -modifiedAfter value, either a time in
+// RFC3339 or a duration before now, where "" means no cutoff.
+func parseModifiedAfter(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseMode parses octal permissions like 0640 for -fileMode and
+// -dirMode.
+func parseMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || os.FileMode(perm)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("invalid mode %q, which must be octal permissions like 0640", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// parseBandwidth parses a rate like 50MB/s, or returns 0 for "".
+func parseBandwidth(limit string) (uint64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	bytesPerSecond, err := bytefmt.ToBytes(strings.TrimSuffix(limit, "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %v", limit, err)
+	}
+	return bytesPerSecond, nil
+}
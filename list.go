@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+	"golang.org/x/net/context"
+)
+
+// listFormats are the values accepted for -listOnly.
+var listFormats = map[string]bool{"plain": true, "csv": true, "json": true}
+
+// keyPrinter writes each object -listOnly lists to w as it comes: its
+// key alone per line for plain, as -keysFile reads them, or with its size,
+// ETag, last modified time and storage class as a CSV row or a line of
+// JSON.
+type keyPrinter struct {
+	format string
+	w      *bufio.Writer
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+func newKeyPrinter(w io.Writer, format string) *keyPrinter {
+	p := &keyPrinter{format: format, w: bufio.NewWriter(w)}
+	switch format {
+	case "csv":
+		p.csv = csv.NewWriter(p.w)
+		p.csv.Write([]string{"key", "size", "etag", "lastModified", "storageClass"})
+	case "json":
+		p.json = json.NewEncoder(p.w)
+	}
+	return p
+}
+
+// print is transfer.Config.List.
+func (p *keyPrinter) print(o transfer.Listed) {
+	lastModified := o.LastModified.UTC().Format(time.RFC3339)
+	switch p.format {
+	case "csv":
+		p.csv.Write([]string{o.Key, strconv.FormatInt(o.Size, 10), o.ETag, lastModified, o.StorageClass})
+	case "json":
+		p.json.Encode(struct {
+			Key          string `json:"key"`
+			Size         int64  `json:"size"`
+			ETag         string `json:"etag"`
+			LastModified string `json:"lastModified"`
+			StorageClass string `json:"storageClass,omitempty"`
+		}{o.Key, o.Size, o.ETag, lastModified, o.StorageClass})
+	default:
+		fmt.Fprintln(p.w, o.Key)
+	}
+}
+
+// flush writes out whatever's buffered.
+func (p *keyPrinter) flush() error {
+	if p.csv != nil {
+		p.csv.Flush()
+		if err := p.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return p.w.Flush()
+}
+
+// runList prints the objects of the S3 listing that pass the filters,
+// for -listOnly, and nothing else, so the output can be piped on.
+func runList(ctx context.Context, cfg transfer.Config) {
+	printer := newKeyPrinter(os.Stdout, *listOnly)
+	cfg.List = printer.print
+	result, err := transfer.Transfer(ctx, cfg)
+	if flushErr := printer.flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	var configErr *transfer.ConfigError
+	switch {
+	case errors.As(err, &configErr):
+		fail(exitConfigError, err)
+	case errors.Is(err, context.Canceled):
+		fail(exitInterrupted, "Aborted")
+	case err != nil:
+		fail(exitFatalError, err)
+	case result.Stopped:
+		fail(exitInterrupted, "Interrupted after listing", result.Listed, "objects")
+	}
+	logger.Debug(transfer.Event{Action: "listed", Bytes: int64(result.Listed)}, "Listed", result.Listed, "objects")
+}
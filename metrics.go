@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the per-object
+// duration histogram.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// promMetrics counts objects across every run of the process, for
+// -metricsAddr, and writes them in the Prometheus text format.
+type promMetrics struct {
+	mu          sync.Mutex
+	transferred uint64
+	bytes       uint64
+	failed      uint64
+	skipped     map[string]uint64 // by reason
+	buckets     []uint64          // per durationBuckets, not cumulative
+	count       uint64
+	sum         float64 // seconds
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{skipped: make(map[string]uint64), buckets: make([]uint64, len(durationBuckets))}
+}
+
+func (m *promMetrics) Transferred(size int64, d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transferred++
+	m.bytes += uint64(size)
+	m.count++
+	m.sum += seconds
+	if i := sort.SearchFloat64s(durationBuckets, seconds); i < len(durationBuckets) {
+		m.buckets[i]++
+	}
+}
+
+func (m *promMetrics) Skipped(reason string) {
+	m.mu.Lock()
+	m.skipped[reason]++
+	m.mu.Unlock()
+}
+
+func (m *promMetrics) Failed() {
+	m.mu.Lock()
+	m.failed++
+	m.mu.Unlock()
+}
+
+// write writes the metrics to w in the Prometheus text format.
+func (m *promMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP s3togs_objects_transferred_total Objects transferred.")
+	fmt.Fprintln(w, "# TYPE s3togs_objects_transferred_total counter")
+	fmt.Fprintln(w, "s3togs_objects_transferred_total", m.transferred)
+
+	fmt.Fprintln(w, "# HELP s3togs_objects_skipped_total Objects not transferred, by reason.")
+	fmt.Fprintln(w, "# TYPE s3togs_objects_skipped_total counter")
+	reasons := make([]string, 0, len(m.skipped))
+	for reason := range m.skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "s3togs_objects_skipped_total{reason=%s} %d\n", strconv.Quote(reason), m.skipped[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP s3togs_objects_failed_total Objects that couldn't be synced.")
+	fmt.Fprintln(w, "# TYPE s3togs_objects_failed_total counter")
+	fmt.Fprintln(w, "s3togs_objects_failed_total", m.failed)
+
+	fmt.Fprintln(w, "# HELP s3togs_bytes_transferred_total Bytes of the objects transferred.")
+	fmt.Fprintln(w, "# TYPE s3togs_bytes_transferred_total counter")
+	fmt.Fprintln(w, "s3togs_bytes_transferred_total", m.bytes)
+
+	fmt.Fprintln(w, "# HELP s3togs_object_duration_seconds Time to transfer each object, retries included.")
+	fmt.Fprintln(w, "# TYPE s3togs_object_duration_seconds histogram")
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		cumulative += m.buckets[i]
+		fmt.Fprintf(w, "s3togs_object_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "s3togs_object_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "s3togs_object_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "s3togs_object_duration_seconds_count %d\n", m.count)
+}
+
+// serveMetrics serves m at /metrics on addr until stop is called.
+func serveMetrics(addr string, m *promMetrics) (stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("-metricsAddr: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	go http.Serve(listener, mux)
+	logger.Error(transfer.Event{Action: "metrics"}, "Serving metrics at http://"+listener.Addr().String()+"/metrics")
+	return func() { listener.Close() }, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// planFormats are the values accepted for -plan.
+var planFormats = map[string]bool{"table": true, "csv": true, "json": true}
+
+// planTotal is the objects of a plan with the same action and reason.
+type planTotal struct {
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	Objects int    `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// planTotals adds up plan by action and reason, in that order.
+func planTotals(plan []transfer.PlanEntry) []planTotal {
+	index := make(map[[2]string]int)
+	var totals []planTotal
+	for _, e := range plan {
+		k := [2]string{e.Action, e.Reason}
+		i, ok := index[k]
+		if !ok {
+			i = len(totals)
+			index[k] = i
+			totals = append(totals, planTotal{Action: e.Action, Reason: e.Reason})
+		}
+		totals[i].Objects++
+		totals[i].Bytes += e.Size
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Action != totals[j].Action {
+			return totals[i].Action > totals[j].Action // transfer, skip, filter
+		}
+		return totals[i].Reason < totals[j].Reason
+	})
+	return totals
+}
+
+// printPlan writes the -dryRun plan to w in format: aligned columns with
+// totals for people, CSV with a row per object, or JSON with both.
+func printPlan(w io.Writer, format string, plan []transfer.PlanEntry) error {
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Key < plan[j].Key })
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "action", "reason", "size"})
+		for _, e := range plan {
+			cw.Write([]string{e.Key, e.Action, e.Reason, strconv.FormatInt(e.Size, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		type object struct {
+			Key    string `json:"key"`
+			Action string `json:"action"`
+			Reason string `json:"reason,omitempty"`
+			Size   int64  `json:"size"`
+		}
+		objects := make([]object, len(plan))
+		for i, e := range plan {
+			objects[i] = object{e.Key, e.Action, e.Reason, e.Size}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Objects []object    `json:"objects"`
+			Totals  []planTotal `json:"totals"`
+		}{objects, planTotals(plan)})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tREASON\tSIZE\tKEY")
+	for _, e := range plan {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Action, e.Reason, bytefmt.ByteSize(uint64(e.Size)), e.Key)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "ACTION\tREASON\tOBJECTS\tSIZE")
+	for _, t := range planTotals(plan) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", t.Action, t.Reason, t.Objects, bytefmt.ByteSize(uint64(t.Bytes)))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof" // serves /debug/pprof with -pprofAddr
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// startProfiling starts what -pprofAddr and -cpuProfile ask for. The
+// returned stop ends it and writes -memProfile, and is safe to call from
+// a deferred function while exiting.
+func startProfiling(pprofAddr, cpuProfile, memProfile string) (stop func(), err error) {
+	var stops []func()
+	stop = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if pprofAddr != "" {
+		listener, err := net.Listen("tcp", pprofAddr)
+		if err != nil {
+			return stop, fmt.Errorf("-pprofAddr: %v", err)
+		}
+		go http.Serve(listener, nil)
+		logger.Error(transfer.Event{Action: "pprof"}, "Serving pprof at http://"+listener.Addr().String()+"/debug/pprof/")
+		stops = append(stops, func() { listener.Close() })
+	}
+
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			stop()
+			return func() {}, fmt.Errorf("-cpuProfile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			stop()
+			return func() {}, fmt.Errorf("-cpuProfile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	if memProfile != "" {
+		stops = append(stops, func() {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				logger.Error(transfer.Event{Action: "warning", Err: err}, "Couldn't write -memProfile")
+				return
+			}
+			defer f.Close()
+			runtime.GC() // up to date allocation statistics
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				logger.Error(transfer.Event{Action: "warning", Err: err}, "Couldn't write -memProfile")
+			}
+		})
+	}
+	return stop, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// progressPrinter shows -progress on stderr: a line rewritten in place on
+// a terminal, a line every interval otherwise, or a progress record with
+// -logFormat json.
+type progressPrinter struct {
+	json     bool
+	terminal bool
+	shown    bool
+}
+
+func newProgressPrinter(json bool) *progressPrinter {
+	info, err := os.Stderr.Stat()
+	terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &progressPrinter{json: json, terminal: terminal && !json}
+}
+
+// interval is how often to show progress.
+func (p *progressPrinter) interval() time.Duration {
+	if p.terminal {
+		return time.Second
+	}
+	return 10 * time.Second
+}
+
+func (p *progressPrinter) show(pr transfer.Progress) {
+	if p.json {
+		logger.Progress(pr)
+		return
+	}
+	line := fmt.Sprintf("%d objects done", pr.Done)
+	if pr.ListingDone {
+		line = fmt.Sprintf("%d/%d objects done", pr.Done, pr.Listed)
+	}
+	line += fmt.Sprintf(", %s sent, %s/s", bytefmt.ByteSize(pr.Bytes), bytefmt.ByteSize(pr.BytesPerSecond))
+	if eta, ok := pr.ETA(); ok {
+		line += ", ETA " + eta.Round(time.Second).String()
+	}
+	if p.terminal {
+		// Rewrite the line in place
+		fmt.Fprint(os.Stderr, "\r\x1b[K"+line)
+		p.shown = true
+		return
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// done ends the line being rewritten, if any.
+func (p *progressPrinter) done() {
+	if p.shown {
+		fmt.Fprintln(os.Stderr)
+	}
+}
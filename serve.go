@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+	"golang.org/x/net/context"
+)
+
+// jobSpec is the body of POST /transfer: what to sync, over the defaults
+// the server was started with.
+type jobSpec struct {
+	S3Bucket       string   `json:"s3Bucket"`
+	S3Prefix       string   `json:"s3Prefix"`
+	ExtraPrefixes  []string `json:"extraS3Prefixes"` // as for -s3Prefix
+	GSBucket       string   `json:"gsBucket"`
+	ExtraGSBuckets []string `json:"extraGsBuckets"`
+	GSPrefix       string   `json:"gsPrefix"`
+	Direction      string   `json:"direction"`
+	Includes       []string `json:"include"`
+	Excludes       []string `json:"exclude"`
+	ModifiedAfter  string   `json:"modifiedAfter"`
+	MaxObjects     int      `json:"maxObjects"`
+	CompareMode    string   `json:"compareMode"`
+	Conflict       string   `json:"conflict"`
+	StorageClass   string   `json:"storageClass"`
+	DryRun         bool     `json:"dryRun"`
+	Verify         bool     `json:"verify"`
+	Delete         bool     `json:"delete"`
+}
+
+// config applies spec to base, the server's configuration.
+func (spec jobSpec) config(base transfer.Config) (transfer.Config, error) {
+	cfg := base
+	cfg.S3Bucket, cfg.S3Prefix = spec.S3Bucket, spec.S3Prefix
+	cfg.GSBucket, cfg.GSPrefix = spec.GSBucket, spec.GSPrefix
+	cfg.ExtraPrefixes = nil
+	if len(spec.ExtraPrefixes) > 0 {
+		cfg.ExtraPrefixes = prefixes(spec.ExtraPrefixes).parse(spec.GSPrefix, cfg.StripPrefix)
+	}
+	cfg.ExtraGSBuckets = spec.ExtraGSBuckets
+	if spec.Direction != "" {
+		cfg.Direction = spec.Direction
+	}
+	cfg.Includes, cfg.Excludes = spec.Includes, spec.Excludes
+	cutoff, err := parseModifiedAfter(spec.ModifiedAfter, time.Now())
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ModifiedAfter = cutoff
+	cfg.MaxObjects = spec.MaxObjects
+	if spec.CompareMode != "" {
+		cfg.CompareMode = spec.CompareMode
+	}
+	if spec.Conflict != "" {
+		cfg.Conflict = spec.Conflict
+	}
+	if spec.StorageClass != "" {
+		cfg.StorageClass = spec.StorageClass
+	}
+	cfg.DryRun, cfg.Verify, cfg.Delete = spec.DryRun, spec.Verify, spec.Delete
+	if cfg.Delete && !*yes {
+		return cfg, errors.New("deleting needs the server to be started with -yes")
+	}
+
+	// Concurrent jobs can't share these files, and no one reads a plan
+	cfg.StateFile, cfg.ReportFile, cfg.Plan = "", "", false
+	return cfg, cfg.Validate()
+}
+
+// job is a transfer run by the server.
+type job struct {
+	mu       sync.Mutex
+	ID       string            `json:"id"`
+	Status   string            `json:"status"` // running, done, failed or stopped
+	Spec     jobSpec           `json:"spec"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Progress *jobProgress      `json:"progress,omitempty"`
+	Totals   map[string]uint64 `json:"totals,omitempty"`
+	Failures []webhookFailure  `json:"failures,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type jobProgress struct {
+	Listed      int    `json:"objectsListed"`
+	ListingDone bool   `json:"listingDone"`
+	Done        int    `json:"objectsDone"`
+	Bytes       uint64 `json:"bytesDone"`
+}
+
+// finish records the outcome of the job's Transfer.
+func (j *job) finish(result transfer.Result, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.Totals = make(map[string]uint64)
+	for _, t := range result.Totals() {
+		j.Totals[t.JSONName()] = t.Value
+	}
+	for _, f := range result.Failures {
+		j.Failures = append(j.Failures, webhookFailure{f.Key, f.Err.Error()})
+	}
+	switch {
+	case err != nil:
+		j.Status, j.Error = "failed", err.Error()
+	case result.Stopped:
+		j.Status = "stopped"
+	default:
+		j.Status = "done"
+	}
+}
+
+// jobServer runs the jobs posted to it, keeping them all for GET.
+type jobServer struct {
+	ctx  context.Context
+	base transfer.Config
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	wg   sync.WaitGroup
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// handleTransfer starts the job posted, returning its id.
+func (js *jobServer) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	var spec jobSpec
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cfg, err := spec.config(js.base)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	j := &job{ID: newJobID(), Status: "running", Spec: spec, Started: time.Now()}
+	cfg.Progress = func(p transfer.Progress) {
+		j.mu.Lock()
+		j.Progress = &jobProgress{p.Listed, p.ListingDone, p.Done, p.Bytes}
+		j.mu.Unlock()
+	}
+	js.mu.Lock()
+	js.jobs[j.ID] = j
+	js.mu.Unlock()
+
+	js.wg.Add(1)
+	go func() {
+		defer js.wg.Done()
+		logger.Info(transfer.Event{Action: "job", Key: j.ID}, "Starting job", j.ID, "from", spec.S3Bucket, "to", spec.GSBucket)
+		j.finish(transfer.Transfer(js.ctx, cfg))
+		logger.Info(transfer.Event{Action: "job", Key: j.ID}, "Job", j.ID, j.Status)
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": j.ID})
+}
+
+// handleJob returns the status of the job /jobs/{id}.
+func (js *jobServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	js.mu.Lock()
+	j, ok := js.jobs[id]
+	js.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	writeJSON(w, http.StatusOK, j)
+}
+
+// runServer serves jobs on -serve until stop is closed, then waits for
+// the jobs underway, which stop listing too, to finish.
+func runServer(ctx context.Context, base transfer.Config, stop <-chan struct{}) {
+	js := &jobServer{ctx: ctx, base: base, jobs: make(map[string]*job)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transfer", js.handleTransfer)
+	mux.HandleFunc("/jobs/", js.handleJob)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	server := &http.Server{Addr: *serveAddr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	logger.Info(transfer.Event{Action: "serve"}, "Serving jobs on", *serveAddr)
+	select {
+	case err := <-errs:
+		fail(exitFatalError, err)
+	case <-stop:
+	}
+	shutdown, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	server.Shutdown(shutdown)
+	js.wg.Wait()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
+
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// otlpShutdownTimeout is how long the spans not yet sent are given to
+// reach the collector at exit.
+const otlpShutdownTimeout = 10 * time.Second
+
+// otlpTracesURL is where to send spans: -otlpEndpoint, or else as the
+// OpenTelemetry SDKs read it from OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT. It's "" when tracing is off.
+func otlpTracesURL(endpoint string) string {
+	if endpoint == "" {
+		if url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); url != "" {
+			return url
+		}
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return ""
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// newTracerProvider returns the tracer provider for -otlpEndpoint, which
+// sends spans in batches to the OpenTelemetry collector at url over
+// OTLP/HTTP, and makes it the global one, propagating the W3C trace
+// context, so the GS client traces its requests under it too. The
+// exporter reads OTEL_EXPORTER_OTLP_HEADERS itself; the service is named
+// by OTEL_SERVICE_NAME, s3togs by default.
+func newTracerProvider(url string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(url))
+	if err != nil {
+		return nil, err
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "s3togs"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider, nil
+}
+
+// shutdownTracing sends the spans not yet sent and stops provider.
+func shutdownTracing(provider *sdktrace.TracerProvider) {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpShutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		logger.Error(transfer.Event{Action: "warning", Err: err}, "Couldn't send the last spans:")
+	}
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// gsPredefinedACLs are the values accepted for Config.PredefinedACL.
+var gsPredefinedACLs = map[string]bool{
+	"authenticatedRead":      true,
+	"bucketOwnerFullControl": true,
+	"bucketOwnerRead":        true,
+	"private":                true,
+	"projectPrivate":         true,
+	"publicRead":             true,
+}
+
+// The S3 groups a grant can be to.
+const (
+	s3AllUsers           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	s3AuthenticatedUsers = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
+
+// s3ACL returns the GS predefined ACL nearest the ACL of key, or of
+// version of it if not empty, in S3.
+func (s *syncer) s3ACL(ctx context.Context, key, version string) (string, error) {
+	out, err := s.s3Client.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(version),
+	})
+	if err != nil {
+		return "", err
+	}
+	var owner string
+	if out.Owner != nil {
+		owner = aws.StringValue(out.Owner.ID)
+	}
+	return predefinedACL(out.Grants, owner), nil
+}
+
+// predefinedACL maps the grants of an S3 object owned by owner to the
+// widest GS predefined ACL they amount to:
+//
+//	READ or FULL_CONTROL to AllUsers            publicRead
+//	READ or FULL_CONTROL to AuthenticatedUsers  authenticatedRead
+//	FULL_CONTROL to another account             bucketOwnerFullControl
+//	READ to another account                     bucketOwnerRead
+//	anything else                               "", the bucket's default
+//
+// Another account is assumed to be the bucket owner, as it is for the
+// canned ACLs bucket-owner-full-control and bucket-owner-read.
+func predefinedACL(grants []*s3.Grant, owner string) string {
+	var public, authenticated, otherFull, otherRead bool
+	for _, grant := range grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		permission := aws.StringValue(grant.Permission)
+		readable := permission == s3.PermissionRead || permission == s3.PermissionFullControl
+		switch aws.StringValue(grant.Grantee.Type) {
+		case s3.TypeGroup:
+			switch aws.StringValue(grant.Grantee.URI) {
+			case s3AllUsers:
+				public = public || readable
+			case s3AuthenticatedUsers:
+				authenticated = authenticated || readable
+			}
+		case s3.TypeCanonicalUser:
+			if aws.StringValue(grant.Grantee.ID) == owner {
+				continue
+			}
+			otherFull = otherFull || permission == s3.PermissionFullControl
+			otherRead = otherRead || permission == s3.PermissionRead
+		}
+	}
+	switch {
+	case public:
+		return "publicRead"
+	case authenticated:
+		return "authenticatedRead"
+	case otherFull:
+		return "bucketOwnerFullControl"
+	case otherRead:
+		return "bucketOwnerRead"
+	}
+	return ""
+}
+
+// gsACL is the predefined ACL for an object in d whose S3 ACL maps to
+// sourceACL: Config.PredefinedACL if set, and none at all in a bucket with
+// uniform bucket-level access, where objects can't have ACLs.
+func (s *syncer) gsACL(d *destination, sourceACL string) string {
+	switch {
+	case d.uniformAccess:
+		return ""
+	case s.cfg.PredefinedACL != "":
+		return s.cfg.PredefinedACL
+	}
+	return sourceACL
+}
@@ -0,0 +1,143 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// crc32cTable is the Castagnoli polynomial GS uses for its CRC32C.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// contentHash computes both checksums GS keeps for an object as its
+// content is written through it.
+type contentHash struct {
+	md5    hash.Hash
+	crc32c hash.Hash32
+	size   int64
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{
+		md5:    md5.New(),
+		crc32c: crc32.New(crc32cTable),
+	}
+}
+
+func (h *contentHash) Write(p []byte) (int, error) {
+	h.size += int64(len(p))
+	h.md5.Write(p)
+	return h.crc32c.Write(p)
+}
+
+// matches compares the content hashed so far against gsAttrs, by CRC32C
+// if useCRC32C and otherwise MD5. compared is false if GS has no checksum
+// of that kind, as with MD5 for composite objects.
+func (h *contentHash) matches(gsAttrs *storage.ObjectAttrs, useCRC32C bool) (matched, compared bool) {
+	if useCRC32C {
+		return h.crc32c.Sum32() == gsAttrs.CRC32C, true
+	}
+	if len(gsAttrs.MD5) == 0 {
+		return false, false
+	}
+	return bytes.Equal(h.md5.Sum(nil), gsAttrs.MD5), true
+}
+
+// matchesSource checks the content hashed so far against the size and,
+// when its ETag is one, MD5 that S3 gave for it.
+func (h *contentHash) matchesSource(src sourceAttrs) error {
+	if h.size != src.size {
+		return fmt.Errorf("%w: read %d of %d bytes", errDownloadMismatch, h.size, src.size)
+	}
+	if src.md5 != "" && hex.EncodeToString(h.md5.Sum(nil)) != src.md5 {
+		return fmt.Errorf("%w: md5 %x, S3 etag %s", errDownloadMismatch, h.md5.Sum(nil), src.md5)
+	}
+	return nil
+}
+
+// useCRC32C reports whether to compare gsAttrs by CRC32C rather than MD5,
+// as picked by Config.Checksum. In auto mode that's whenever GS has no MD5
+// for the object.
+func (s *syncer) useCRC32C(gsAttrs *storage.ObjectAttrs) bool {
+	switch s.cfg.Checksum {
+	case "crc32c":
+		return true
+	case "auto":
+		return len(gsAttrs.MD5) == 0
+	}
+	return false
+}
+
+// The GS metadata Config.StoreSourceMD5 records the source's true MD5
+// under, and Config.Checksum crc32c its CRC32C, with the S3 ETag they
+// were computed for. Config.Compress records the ETag and the size.
+const (
+	sourceMD5Key    = "x-source-md5"
+	sourceCRC32CKey = "x-source-crc32c"
+	sourceETagKey   = "x-source-etag"
+	sourceSizeKey   = "x-source-size"
+)
+
+// storeSourceHash adds hashes, by metadata key, and the source's ETag to
+// the metadata of the uploaded gsAttrs in gs. It replaces only the
+// generation just uploaded.
+func (s *syncer) storeSourceHash(ctx context.Context, gs gsObjects, gsAttrs *storage.ObjectAttrs, etag string, hashes map[string]string) error {
+	metadata := make(map[string]string, len(gsAttrs.Metadata)+len(hashes)+1)
+	for k, v := range gsAttrs.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range hashes {
+		metadata[k] = v
+	}
+	metadata[sourceETagKey] = strings.Trim(etag, "\"")
+	return gs.Update(ctx, gsAttrs.Name, gsAttrs.Generation, storage.ObjectAttrsToUpdate{Metadata: metadata})
+}
+
+// formatCRC32C is how a CRC32C is recorded under sourceCRC32CKey.
+func formatCRC32C(sum uint32) string {
+	return fmt.Sprintf("%08x", sum)
+}
+
+// isCompressedCopy reports whether gsAttrs is an object Config.Compress
+// gzipped, whose size and hashes are of the compressed bytes.
+func isCompressedCopy(gsAttrs *storage.ObjectAttrs) bool {
+	_, ok := gsAttrs.Metadata[sourceSizeKey]
+	return ok && strings.EqualFold(gsAttrs.ContentEncoding, "gzip")
+}
+
+// compressedCopyMatches reports whether the compressed copy gsAttrs was
+// made from the S3 object with etag and size.
+func compressedCopyMatches(etag string, size int64, gsAttrs *storage.ObjectAttrs) bool {
+	return gsAttrs.Metadata[sourceETagKey] == strings.Trim(etag, "\"") &&
+		gsAttrs.Metadata[sourceSizeKey] == strconv.FormatInt(size, 10)
+}
+
+// storedHashMatches reports whether gsAttrs records, with
+// Config.StoreSourceMD5, an MD5 for the S3 object etag names that is the
+// GS copy's. The S3 object is unchanged while its ETag is, so this stands
+// in for hashing a multipart object.
+func storedHashMatches(etag string, gsAttrs *storage.ObjectAttrs) bool {
+	stored, ok := gsAttrs.Metadata[sourceMD5Key]
+	if !ok || gsAttrs.Metadata[sourceETagKey] != strings.Trim(etag, "\"") {
+		return false
+	}
+	return len(gsAttrs.MD5) == 0 || strings.EqualFold(stored, hex.EncodeToString(gsAttrs.MD5))
+}
+
+// storedCRC32CMatches reports whether gsAttrs records, from when it was
+// uploaded with Config.Checksum crc32c, a CRC32C for the S3 object etag
+// names that is the GS copy's. The CRC32C recorded is the one GS was
+// checked against on upload, so nothing need be downloaded to compare.
+func storedCRC32CMatches(etag string, gsAttrs *storage.ObjectAttrs) bool {
+	stored, ok := gsAttrs.Metadata[sourceCRC32CKey]
+	return ok && gsAttrs.Metadata[sourceETagKey] == strings.Trim(etag, "\"") &&
+		stored == formatCRC32C(gsAttrs.CRC32C)
+}
@@ -0,0 +1,158 @@
+package transfer
+
+import (
+	"crypto/md5"
+	"hash/crc32"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestIsMultipartETag(t *testing.T) {
+	for _, tc := range []struct {
+		etag string
+		want bool
+	}{
+		{md5Hex("content"), false},
+		{md5Hex("content") + "-1", true},
+		{md5Hex("content") + "-10000", true},
+		{multipartETag("content", 3), true},
+		{"", false},
+	} {
+		if got := isMultipartETag(tc.etag); got != tc.want {
+			t.Errorf("isMultipartETag(%q) = %v, want %v", tc.etag, got, tc.want)
+		}
+	}
+}
+
+func TestSkipReasonMultipartETag(t *testing.T) {
+	const content = "uploaded in parts"
+	sum := md5.Sum([]byte(content))
+	gsAttrs := &storage.ObjectAttrs{Name: "key", Size: int64(len(content)), MD5: sum[:]}
+	// A multipart ETag is a hash of the part hashes, not of the content
+	etag := `"` + multipartETag(content, 2) + `"`
+	for _, tc := range []struct {
+		compareMode, fallback string
+		size                  int64
+		want                  string
+	}{
+		{"both", "size", gsAttrs.Size, "Size matches"},
+		{"both", "size", gsAttrs.Size + 1, ""},
+		{"both", "transfer", gsAttrs.Size, ""},
+		{"hash", "size", gsAttrs.Size, "Size matches"},
+		{"hash", "transfer", gsAttrs.Size, ""},
+		{"size", "transfer", gsAttrs.Size, "Size matches"},
+	} {
+		s := newTestSyncer(t, Config{CompareMode: tc.compareMode, MultipartFallback: tc.fallback}, newFakeS3(), newFakeGS())
+		if got := s.skipReason(s.ctx, "key", "", etag, tc.size, gsAttrs); got != tc.want {
+			t.Errorf("compare %s, fallback %s, size %d: skip reason %q, want %q", tc.compareMode, tc.fallback, tc.size, got, tc.want)
+		}
+	}
+
+	// A single part ETag is still compared as the MD5 it is
+	s := newTestSyncer(t, Config{MultipartFallback: "transfer"}, newFakeS3(), newFakeGS())
+	if got := s.skipReason(s.ctx, "key", "", `"`+md5Hex(content)+`"`, gsAttrs.Size, gsAttrs); got != "Already in sync" {
+		t.Errorf("single part ETag: skip reason %q, want it in sync", got)
+	}
+}
+
+func TestStoredHashMatches(t *testing.T) {
+	const content = "uploaded in parts"
+	sum := md5.Sum([]byte(content))
+	etag := multipartETag(content, 2)
+	gsAttrs := &storage.ObjectAttrs{MD5: sum[:], Metadata: map[string]string{
+		sourceMD5Key:  md5Hex(content),
+		sourceETagKey: etag,
+	}}
+	if !storedHashMatches(`"`+etag+`"`, gsAttrs) {
+		t.Error("the stored hash of this ETag didn't match")
+	}
+	if storedHashMatches(`"`+multipartETag(content+" again", 2)+`"`, gsAttrs) {
+		t.Error("the stored hash of another ETag matched")
+	}
+	gsAttrs.MD5 = make([]byte, md5.Size)
+	if storedHashMatches(`"`+etag+`"`, gsAttrs) {
+		t.Error("the stored hash matched a GS copy with another MD5")
+	}
+}
+
+func TestSyncCRC32C(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		checksum  string
+		synced    bool   // the GS copy was made with -checksum crc32c
+		gs        string // the GS copy otherwise, or what it's changed to
+		composite bool   // the GS copy has no MD5
+		multipart bool   // the S3 ETag isn't an MD5
+		change    string // put in S3 after the sync if set
+		want      uint64 // transferred
+	}{
+		{name: "crc32c, recorded in sync", checksum: "crc32c", synced: true},
+		{name: "crc32c, multipart recorded in sync", checksum: "crc32c", synced: true, multipart: true},
+		{name: "crc32c, source changed since", checksum: "crc32c", synced: true, change: "c0ntent", want: 1},
+		{name: "crc32c, copy changed since", checksum: "crc32c", synced: true, gs: "c0ntent", want: 1},
+		{name: "crc32c, nothing recorded", checksum: "crc32c", gs: "content", want: 1},
+		// The size fallback for multipart ETags doesn't override the CRC32C
+		{name: "crc32c, multipart with nothing recorded", checksum: "crc32c", gs: "content", multipart: true, want: 1},
+		{name: "auto, composite copy", checksum: "auto", gs: "content", composite: true, want: 1},
+		{name: "auto, with an MD5", checksum: "auto", gs: "content"},
+		{name: "md5, composite copy", checksum: "md5", gs: "content", composite: true, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			put := func(data string) {
+				o := src.put("key", data, modified)
+				if tc.multipart {
+					o.etag = multipartETag(data, 2)
+				}
+			}
+			put("content")
+			if tc.synced {
+				mustSync(t, Config{Checksum: "crc32c"}, src, dst)
+				if tc.gs != "" {
+					// Rewritten in place, keeping what was recorded
+					metadata := dst.get("key").attrs.Metadata
+					dst.put("key", tc.gs, storage.ObjectAttrs{Metadata: metadata})
+				}
+			} else {
+				dst.put("key", tc.gs, storage.ObjectAttrs{})
+			}
+			if tc.composite {
+				dst.get("key").attrs.MD5 = nil
+			}
+			if tc.change != "" {
+				put(tc.change)
+			}
+
+			src.getCalls = 0
+			result := mustSync(t, Config{Checksum: tc.checksum}, src, dst)
+			if result.Transferred != tc.want {
+				t.Errorf("transferred %d objects, want %d", result.Transferred, tc.want)
+			}
+			// Only a transfer downloads
+			if uint64(src.getCalls) != tc.want {
+				t.Errorf("downloaded %d times, want %d", src.getCalls, tc.want)
+			}
+		})
+	}
+}
+
+func TestStoredCRC32CMatches(t *testing.T) {
+	const content = "uploaded in parts"
+	etag := multipartETag(content, 2)
+	sum := crc32.Checksum([]byte(content), crc32cTable)
+	gsAttrs := &storage.ObjectAttrs{CRC32C: sum, Metadata: map[string]string{
+		sourceCRC32CKey: formatCRC32C(sum),
+		sourceETagKey:   etag,
+	}}
+	if !storedCRC32CMatches(`"`+etag+`"`, gsAttrs) {
+		t.Error("the stored CRC32C of this ETag didn't match")
+	}
+	if storedCRC32CMatches(`"`+multipartETag(content+" again", 2)+`"`, gsAttrs) {
+		t.Error("the stored CRC32C of another ETag matched")
+	}
+	gsAttrs.CRC32C++
+	if storedCRC32CMatches(`"`+etag+`"`, gsAttrs) {
+		t.Error("the stored CRC32C matched a GS copy with another CRC32C")
+	}
+}
@@ -0,0 +1,218 @@
+package transfer
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// The syncer talks to the buckets only through these interfaces, so they
+// can be replaced with in-memory fakes.
+
+// s3Objects is the part of *s3.S3 the syncer uses.
+type s3Objects interface {
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+	GetObjectTaggingWithContext(aws.Context, *s3.GetObjectTaggingInput, ...request.Option) (*s3.GetObjectTaggingOutput, error)
+	GetObjectAclWithContext(aws.Context, *s3.GetObjectAclInput, ...request.Option) (*s3.GetObjectAclOutput, error)
+	ListObjectsV2WithContext(aws.Context, *s3.ListObjectsV2Input, ...request.Option) (*s3.ListObjectsV2Output, error)
+	ListObjectVersionsWithContext(aws.Context, *s3.ListObjectVersionsInput, ...request.Option) (*s3.ListObjectVersionsOutput, error)
+	RestoreObjectWithContext(aws.Context, *s3.RestoreObjectInput, ...request.Option) (*s3.RestoreObjectOutput, error)
+	DeleteObjectWithContext(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
+}
+
+// sqsQueue is the part of *sqs.SQS the syncer uses, for
+// Config.SQSQueueURL.
+type sqsQueue interface {
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+}
+
+// objectDownloader downloads an S3 object in parallel parts, as
+// *s3manager.Downloader does.
+type objectDownloader interface {
+	DownloadWithContext(aws.Context, io.WriterAt, *s3.GetObjectInput, ...func(*s3manager.Downloader)) (int64, error)
+}
+
+// objectUploader uploads to S3, in parts if need be, as
+// *s3manager.Uploader does.
+type objectUploader interface {
+	UploadWithContext(aws.Context, *s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
+}
+
+// objectLister lists a GS bucket.
+type objectLister interface {
+	Objects(ctx context.Context, q *storage.Query) objectIterator
+}
+
+// objectIterator is a GS listing, as *storage.ObjectIterator is.
+type objectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
+}
+
+// attrsGetter looks up a GS object, returning storage.ErrObjectNotExist
+// if there's none.
+type attrsGetter interface {
+	Attrs(ctx context.Context, key string) (*storage.ObjectAttrs, error)
+}
+
+// objectWriter is an upload to GS, as *storage.Writer is. Nothing is
+// written until Close succeeds.
+type objectWriter interface {
+	io.Writer
+	Close() error
+	CloseWithError(err error) error
+}
+
+// gsObjects is the GS bucket being synced.
+type gsObjects interface {
+	objectLister
+	attrsGetter
+	// NewReader reads key as stored, without decompressing gzip.
+	NewReader(ctx context.Context, key string) (io.ReadCloser, error)
+	// NewWriter starts an upload of an object with attrs, committed only
+	// if the object is still at generation, or doesn't exist for 0.
+	NewWriter(ctx context.Context, attrs storage.ObjectAttrs, generation int64) objectWriter
+	// Update changes the attributes of generation of key.
+	Update(ctx context.Context, key string, generation int64, attrs storage.ObjectAttrsToUpdate) error
+	// Delete removes key, only if it's still at generation unless that's
+	// 0.
+	Delete(ctx context.Context, key string, generation int64) error
+}
+
+// gsBucket is gsObjects backed by a real bucket.
+type gsBucket struct {
+	*storage.BucketHandle
+	chunkSize int // for each Writer; 0 sends each object in one request
+}
+
+func (b gsBucket) Objects(ctx context.Context, q *storage.Query) objectIterator {
+	return b.BucketHandle.Objects(ctx, q)
+}
+
+func (b gsBucket) Attrs(ctx context.Context, key string) (*storage.ObjectAttrs, error) {
+	return b.Object(key).Attrs(ctx)
+}
+
+func (b gsBucket) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.Object(key).ReadCompressed(true).NewReader(ctx)
+}
+
+func (b gsBucket) NewWriter(ctx context.Context, attrs storage.ObjectAttrs, generation int64) objectWriter {
+	cond := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		cond = storage.Conditions{DoesNotExist: true}
+	}
+	w := b.Object(attrs.Name).If(cond).NewWriter(ctx)
+	w.ObjectAttrs = attrs
+	w.ChunkSize = b.chunkSize
+	return w
+}
+
+func (b gsBucket) Update(ctx context.Context, key string, generation int64, attrs storage.ObjectAttrsToUpdate) error {
+	_, err := b.Object(key).If(storage.Conditions{GenerationMatch: generation}).Update(ctx, attrs)
+	return err
+}
+
+func (b gsBucket) Delete(ctx context.Context, key string, generation int64) error {
+	o := b.Object(key)
+	if generation != 0 {
+		o = o.If(storage.Conditions{GenerationMatch: generation})
+	}
+	return o.Delete(ctx)
+}
+
+// renamedObjects is gsObjects storing each S3 key under another GS name,
+// for Config.GSPrefix, Config.StripPrefix and Config.KeyRegex. Keys passed
+// in, including listing prefixes, and the names of the attributes passed
+// back are all S3 keys, so the rest of the syncer never sees a GS name.
+// A regex can't be undone, so with one only lookups, reads, writes and
+// deletes work, not listing.
+type renamedObjects struct {
+	gsObjects
+	s3Prefix, gsPrefix string
+	strip              bool
+	regex              *regexp.Regexp
+	replace            string
+}
+
+// gsName is the GS name of S3 key: key rewritten by Config.KeyRegex, with
+// Config.S3Prefix then stripped if Config.StripPrefix, after
+// Config.GSPrefix.
+func (r renamedObjects) gsName(key string) string {
+	if r.regex != nil {
+		key = r.regex.ReplaceAllString(key, r.replace)
+	}
+	if r.strip {
+		key = strings.TrimPrefix(key, r.s3Prefix)
+	}
+	return r.gsPrefix + key
+}
+
+// s3Key undoes gsName, without a regex.
+func (r renamedObjects) s3Key(name string) string {
+	key := strings.TrimPrefix(name, r.gsPrefix)
+	if r.strip {
+		key = r.s3Prefix + key
+	}
+	return key
+}
+
+func (r renamedObjects) renamed(attrs *storage.ObjectAttrs) *storage.ObjectAttrs {
+	renamed := *attrs
+	renamed.Name = r.s3Key(attrs.Name)
+	return &renamed
+}
+
+func (r renamedObjects) Objects(ctx context.Context, q *storage.Query) objectIterator {
+	gsQuery := *q
+	gsQuery.Prefix = r.gsName(q.Prefix)
+	return renamedIterator{r.gsObjects.Objects(ctx, &gsQuery), r}
+}
+
+func (r renamedObjects) Attrs(ctx context.Context, key string) (*storage.ObjectAttrs, error) {
+	attrs, err := r.gsObjects.Attrs(ctx, r.gsName(key))
+	if err != nil {
+		return nil, err
+	}
+	return r.renamed(attrs), nil
+}
+
+func (r renamedObjects) NewReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	return r.gsObjects.NewReader(ctx, r.gsName(key))
+}
+
+func (r renamedObjects) NewWriter(ctx context.Context, attrs storage.ObjectAttrs, generation int64) objectWriter {
+	attrs.Name = r.gsName(attrs.Name)
+	return r.gsObjects.NewWriter(ctx, attrs, generation)
+}
+
+func (r renamedObjects) Update(ctx context.Context, key string, generation int64, attrs storage.ObjectAttrsToUpdate) error {
+	return r.gsObjects.Update(ctx, r.gsName(key), generation, attrs)
+}
+
+func (r renamedObjects) Delete(ctx context.Context, key string, generation int64) error {
+	return r.gsObjects.Delete(ctx, r.gsName(key), generation)
+}
+
+type renamedIterator struct {
+	objectIterator
+	r renamedObjects
+}
+
+func (it renamedIterator) Next() (*storage.ObjectAttrs, error) {
+	attrs, err := it.objectIterator.Next()
+	if err != nil {
+		return nil, err
+	}
+	return it.r.renamed(attrs), nil
+}
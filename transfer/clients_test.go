@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenamedObjects(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		s3Prefix, gsPrefix string
+		strip              bool
+		key, gsName        string
+	}{
+		{name: "gs prefix", s3Prefix: "logs/", gsPrefix: "backup/", key: "logs/a.txt", gsName: "backup/logs/a.txt"},
+		{name: "gs prefix without a slash", s3Prefix: "logs/", gsPrefix: "backup-", key: "logs/a.txt", gsName: "backup-logs/a.txt"},
+		{name: "strip prefix", s3Prefix: "logs/", strip: true, key: "logs/2020/a.txt", gsName: "2020/a.txt"},
+		{name: "strip partial prefix", s3Prefix: "logs/20", strip: true, key: "logs/2020/a.txt", gsName: "20/a.txt"},
+		{name: "both", s3Prefix: "logs/", gsPrefix: "archive/", strip: true, key: "logs/2020/a.txt", gsName: "archive/2020/a.txt"},
+		{name: "both, just the prefix", s3Prefix: "logs/", gsPrefix: "archive/", strip: true, key: "logs/", gsName: "archive/"},
+		{name: "strip no prefix", strip: true, gsPrefix: "archive/", key: "a.txt", gsName: "archive/a.txt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := renamedObjects{newFakeGS(), tc.s3Prefix, tc.gsPrefix, tc.strip, nil, ""}
+			if got := r.gsName(tc.key); got != tc.gsName {
+				t.Errorf("gsName(%q) = %q, want %q", tc.key, got, tc.gsName)
+			}
+			if got := r.s3Key(tc.gsName); got != tc.key {
+				t.Errorf("s3Key(%q) = %q, want %q", tc.gsName, got, tc.key)
+			}
+		})
+	}
+}
+
+func TestSyncRenamed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		names []string
+	}{
+		{"gs prefix", Config{S3Prefix: "logs/", GSPrefix: "backup/"}, []string{"backup/logs/2020/a.txt", "backup/logs/b.txt"}},
+		{"strip prefix", Config{S3Prefix: "logs/", StripPrefix: true}, []string{"2020/a.txt", "b.txt"}},
+		{"both", Config{S3Prefix: "logs/", GSPrefix: "archive/", StripPrefix: true}, []string{"archive/2020/a.txt", "archive/b.txt"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("logs/2020/a.txt", "a", modified)
+			src.put("logs/b.txt", "b", modified)
+			src.put("other/c.txt", "c", modified)
+
+			if result := mustSync(t, tc.cfg, src, dst); result.Transferred != 2 {
+				t.Fatalf("transferred %d objects, want 2", result.Transferred)
+			}
+			if got := dst.names(); !reflect.DeepEqual(got, tc.names) {
+				t.Errorf("GS has %v, want %v", got, tc.names)
+			}
+			// The listing of the renamed objects finds them in sync
+			if result := mustSync(t, tc.cfg, src, dst); result.Transferred != 0 || result.Skipped.InSync != 2 {
+				t.Errorf("rerun transferred %d and skipped %d in sync, want 0 and 2", result.Transferred, result.Skipped.InSync)
+			}
+		})
+	}
+}
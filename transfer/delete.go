@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// deleteSource removes key from S3 once it has been transferred and
+// checked, for Config.DeleteSource. A failure is logged, counted and
+// reported, but leaves the transfer standing.
+func (s *syncer) deleteSource(ctx context.Context, key string) {
+	err := s.retry(key, func() error {
+		_, err := s.s3Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.cfg.S3Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		s.log.Error(Event{Action: "failed", Key: key, Err: err}, "Failed to delete source", key, "from S3")
+		atomic.AddUint64(&s.numSourceDeleteFailed, 1)
+		s.record(ctx, reportEntry{Key: key, Action: "delete-source-failed", Error: err.Error()})
+		return
+	}
+	s.log.Info(Event{Action: "delete-source", Key: key}, "Deleted source", key, "from S3")
+	atomic.AddUint64(&s.numSourceDeleted, 1)
+	s.record(ctx, reportEntry{Key: key, Action: "delete-source"})
+}
+
+// deleteExtras deletes the objects under s3Prefix in the destination
+// bucket that weren't in the source listing, stopping early on
+// stopListing. Keys left out by Config.Includes and Config.Excludes are
+// never deleted. It returns how many objects were (or with Config.DryRun,
+// would be) deleted.
+func (s *syncer) deleteExtras() (int, error) {
+	if s.cfg.Direction == GSToS3 {
+		return s.deleteExtrasFromS3()
+	}
+	return s.deleteExtrasFromGS()
+}
+
+func (s *syncer) deleteExtrasFromGS() (int, error) {
+	numDeleted := 0
+	it := s.gs.Objects(s.ctx, &storage.Query{Prefix: s.cfg.S3Prefix})
+	for {
+		select {
+		case <-s.stop:
+			return numDeleted, nil
+		default:
+		}
+
+		gsAttrs, err := it.Next()
+		if err == iterator.Done {
+			return numDeleted, nil
+		}
+		if err != nil {
+			return numDeleted, err
+		}
+		if s.sourceKeys[gsAttrs.Name] || !s.included(gsAttrs.Name) {
+			continue
+		}
+
+		if s.cfg.DryRun {
+			s.log.Info(Event{Action: "would-delete", Key: gsAttrs.Name}, "Would delete", gsAttrs.Name, "from GS")
+		} else {
+			s.log.Info(Event{Action: "delete", Key: gsAttrs.Name}, "Deleting", gsAttrs.Name, "from GS")
+			// Only the generation listed, so an object written since isn't
+			// lost
+			err := s.gs.Delete(s.ctx, gsAttrs.Name, gsAttrs.Generation)
+			if isPreconditionFailed(err) || err == storage.ErrObjectNotExist {
+				s.log.Info(Event{Action: "skip", Key: gsAttrs.Name}, "Changed in GS since it was listed, not deleting", gsAttrs.Name)
+				continue
+			}
+			if err != nil {
+				return numDeleted, err
+			}
+		}
+		numDeleted++
+	}
+}
+
+func (s *syncer) deleteExtrasFromS3() (int, error) {
+	numDeleted := 0
+	s3ListInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.cfg.S3Bucket),
+		Prefix: aws.String(s.cfg.S3Prefix),
+	}
+	for {
+		s3List, err := s.s3Client.ListObjectsV2WithContext(s.ctx, s3ListInput)
+		if err != nil {
+			return numDeleted, err
+		}
+
+		for _, key := range s3List.Contents {
+			select {
+			case <-s.stop:
+				return numDeleted, nil
+			default:
+			}
+			if s.sourceKeys[*key.Key] || !s.included(*key.Key) {
+				continue
+			}
+
+			if s.cfg.DryRun {
+				s.log.Info(Event{Action: "would-delete", Key: *key.Key}, "Would delete", *key.Key, "from S3")
+			} else {
+				s.log.Info(Event{Action: "delete", Key: *key.Key}, "Deleting", *key.Key, "from S3")
+				_, err := s.s3Client.DeleteObjectWithContext(s.ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(s.cfg.S3Bucket),
+					Key:    key.Key,
+				})
+				if err != nil {
+					return numDeleted, err
+				}
+			}
+			numDeleted++
+		}
+
+		if !aws.BoolValue(s3List.IsTruncated) {
+			return numDeleted, nil
+		}
+		s3ListInput.ContinuationToken = s3List.NextContinuationToken
+	}
+}
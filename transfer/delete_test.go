@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestDeleteExtras(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("kept.txt", "kept", modified)
+	dst.put("kept.txt", "kept", storage.ObjectAttrs{})
+	dst.put("extra.txt", "extra", storage.ObjectAttrs{})
+	dst.put("excluded.tmp", "excluded", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{Delete: true, Excludes: []string{"*.tmp"}}, src, dst)
+	if result.Deleted != 1 {
+		t.Errorf("deleted %d objects, want 1", result.Deleted)
+	}
+	if got, want := dst.names(), []string{"excluded.tmp", "kept.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GS has %v, want %v", got, want)
+	}
+}
+
+func TestDeleteExtrasDryRun(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	dst.put("extra.txt", "extra", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{Delete: true, DryRun: true}, src, dst)
+	if result.Deleted != 1 || dst.get("extra.txt") == nil {
+		t.Errorf("deleted %d objects with GS left %v, want 1 counted and nothing deleted", result.Deleted, dst.names())
+	}
+}
+
+func TestDeleteExtrasChangedSinceListed(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	dst.put("rewritten.txt", "old", storage.ObjectAttrs{})
+	dst.put("removed.txt", "old", storage.ObjectAttrs{})
+	dst.put("extra.txt", "extra", storage.ObjectAttrs{})
+	// Someone else gets to two of them between the listing and the delete
+	dst.beforeDelete = func(name string) {
+		switch name {
+		case "rewritten.txt":
+			dst.put(name, "new", storage.ObjectAttrs{})
+		case "removed.txt":
+			dst.mu.Lock()
+			delete(dst.objects, name)
+			dst.mu.Unlock()
+		}
+	}
+
+	result := mustSync(t, Config{Delete: true}, src, dst)
+	if result.Deleted != 1 {
+		t.Errorf("deleted %d objects, want just extra.txt", result.Deleted)
+	}
+	if o := dst.get("rewritten.txt"); o == nil || string(o.data) != "new" {
+		t.Errorf("the object rewritten since the listing was deleted")
+	}
+	if got, want := dst.names(), []string{"rewritten.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GS has %v, want %v", got, want)
+	}
+}
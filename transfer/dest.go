@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// destination is a GS bucket S3 objects are copied to: Config.GSBucket,
+// or one of Config.ExtraGSBuckets.
+type destination struct {
+	bucket string
+	base   gsObjects // the bucket as is
+	gs     gsObjects // base for the prefix being synced, as set by usePrefix
+	// label is how logs name the bucket: GS, or gs://bucket when there
+	// are several
+	label string
+
+	// index is the bucket's listing from indexGS, unless
+	// Config.DisableDestinationListing, and isn't modified once the
+	// workers start.
+	index map[string]*storage.ObjectAttrs
+
+	// uniformAccess is set when the bucket has uniform bucket-level
+	// access, so objects can't be given ACLs.
+	uniformAccess bool
+}
+
+// attrs returns the attributes of key in d, from the index if it's there
+// and otherwise by asking GS, in case it was added since.
+func (d *destination) attrs(ctx context.Context, key string) (*storage.ObjectAttrs, error) {
+	if gsAttrs, ok := d.index[key]; ok {
+		return gsAttrs, nil
+	}
+	return d.gs.Attrs(ctx, key)
+}
+
+// target is a destination an object is being transferred to. Its fields
+// are only touched by the worker transferring the object.
+type target struct {
+	*destination
+	reason string // why it's transferred, as from transferReason
+	// generation is the one to upload over, 0 if there's none, and once
+	// the upload is done the one uploaded
+	generation int64
+
+	uploaded bool // committed by the last attempt, but not yet checked
+	done     bool // uploaded and checked
+	changed  bool // another runner wrote the object first
+}
+
+// pendingTargets are those of targets still to be uploaded to.
+func pendingTargets(targets []*target) []*target {
+	var pending []*target
+	for _, t := range targets {
+		if !t.done && !t.changed {
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+// targetWriter is the upload to a target, marking it changed if GS
+// refuses it because another runner wrote the object first.
+type targetWriter struct {
+	objectWriter
+	t *target
+}
+
+func (w targetWriter) Write(p []byte) (int, error) {
+	n, err := w.objectWriter.Write(p)
+	if isPreconditionFailed(err) {
+		w.t.changed = true
+	}
+	return n, err
+}
+
+func (w targetWriter) Close() error {
+	err := w.objectWriter.Close()
+	if isPreconditionFailed(err) {
+		w.t.changed = true
+	}
+	return err
+}
+
+// logName is how name is logged for d: as is with one bucket, and
+// followed by the bucket with several.
+func (s *syncer) logName(d *destination, name string) string {
+	if len(s.dests) == 1 {
+		return name
+	}
+	return name + " (" + d.label + ")"
+}
+
+// reportBucket is the bucket to report for d, none with just one.
+func (s *syncer) reportBucket(d *destination) string {
+	if len(s.dests) == 1 {
+		return ""
+	}
+	return d.bucket
+}
+
+// inBucket adds the bucket to err with several destinations.
+func (s *syncer) inBucket(d *destination, err error) error {
+	if err == nil || len(s.dests) == 1 {
+		return err
+	}
+	return fmt.Errorf("%s: %w", d.label, err)
+}
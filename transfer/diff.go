@@ -0,0 +1,199 @@
+package transfer
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DiffCounts tallies the objects of Config.DiffReport by how they
+// compare. Fields are accessed atomically during a run.
+type DiffCounts struct {
+	Identical        uint64
+	OnlyInS3         uint64
+	OnlyInGS         uint64
+	SizeMismatch     uint64
+	ChecksumMismatch uint64
+	Unverified       uint64 // sizes match but there was no usable hash
+}
+
+// differing is how many objects the diff found out of sync.
+func (c DiffCounts) differing() uint64 {
+	return c.OnlyInS3 + c.OnlyInGS + c.SizeMismatch + c.ChecksumMismatch
+}
+
+// The statuses of a diffEntry.
+const (
+	diffIdentical        = "identical"
+	diffOnlyInS3         = "only-in-s3"
+	diffOnlyInGS         = "only-in-gs"
+	diffSizeMismatch     = "size-mismatch"
+	diffChecksumMismatch = "checksum-mismatch"
+	diffUnverified       = "unverified"
+)
+
+// diffEntry is an object of Config.DiffReport as each side has it. The
+// sizes are nil on the side that doesn't have the object.
+type diffEntry struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	S3Size *int64 `json:"s3Size,omitempty"`
+	GSSize *int64 `json:"gsSize,omitempty"`
+	S3ETag string `json:"s3ETag,omitempty"`
+	GSMD5  string `json:"gsMd5,omitempty"`
+}
+
+// diffColumns is the header of a CSV diff report.
+var diffColumns = []string{"key", "status", "s3_size", "gs_size", "s3_etag", "gs_md5"}
+
+// diffFile writes a diffEntry per object, as CSV if its name ends in
+// .csv and otherwise as a line of JSON. Like reportFile, each entry goes
+// straight to the file.
+type diffFile struct {
+	mu  sync.Mutex
+	f   *os.File
+	csv *csv.Writer // nil for JSON
+	enc *json.Encoder
+	log Logger
+}
+
+// openDiff creates the diff report at path with mode, replacing any old
+// one.
+func openDiff(path string, mode os.FileMode, log Logger) (*diffFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	d := &diffFile{f: f, log: log}
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		d.enc = json.NewEncoder(f)
+		return d, nil
+	}
+	d.csv = csv.NewWriter(f)
+	d.csv.Write(diffColumns)
+	d.csv.Flush()
+	if err := d.csv.Error(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// add appends entry to the report. A failed write is logged rather than
+// failing the run.
+func (d *diffFile) add(entry diffEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	if d.csv != nil {
+		d.csv.Write([]string{entry.Key, entry.Status, formatSize(entry.S3Size), formatSize(entry.GSSize), entry.S3ETag, entry.GSMD5})
+		d.csv.Flush()
+		err = d.csv.Error()
+	} else {
+		err = d.enc.Encode(entry)
+	}
+	if err != nil {
+		d.log.Error(Event{Action: "warning", Key: entry.Key, Err: err}, "Couldn't write diff report for", entry.Key)
+	}
+}
+
+func (d *diffFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.f.Sync(); err != nil {
+		d.f.Close()
+		return err
+	}
+	return d.f.Close()
+}
+
+// formatSize is size as a CSV column, empty if nil.
+func formatSize(size *int64) string {
+	if size == nil {
+		return ""
+	}
+	return strconv.FormatInt(*size, 10)
+}
+
+// diffObject compares key in S3 with the GS listing for Config.DiffReport,
+// from metadata alone.
+func (s *syncer) diffObject(key *s3.Object) (func(worker int) error, error) {
+	entry := diffEntry{Key: *key.Key, S3Size: key.Size, S3ETag: strings.Trim(*key.ETag, `"`)}
+	gsAttrs, ok := s.dests[0].index[*key.Key]
+	if !ok {
+		s.addDiff(entry, diffOnlyInS3, &s.diffed.OnlyInS3)
+		return nil, nil
+	}
+	status, counter := s.diffStatus(key, gsAttrs)
+	entry.GSSize, entry.GSMD5 = aws.Int64(gsAttrs.Size), hex.EncodeToString(gsAttrs.MD5)
+	s.addDiff(entry, status, counter)
+	return nil, nil
+}
+
+// diffStatus is how key compares with gsAttrs, and the count it adds to,
+// as verifyObject would decide but without reading either object.
+func (s *syncer) diffStatus(key *s3.Object, gsAttrs *storage.ObjectAttrs) (string, *uint64) {
+	s3MD5 := strings.Trim(*key.ETag, `"`)
+	switch {
+	case isCompressedCopy(gsAttrs) && compressedCopyMatches(*key.ETag, *key.Size, gsAttrs):
+		return diffIdentical, &s.diffed.Identical
+	case isCompressedCopy(gsAttrs):
+		return diffChecksumMismatch, &s.diffed.ChecksumMismatch
+	case *key.Size != gsAttrs.Size:
+		return diffSizeMismatch, &s.diffed.SizeMismatch
+	case !isMultipartETag(s3MD5) && len(gsAttrs.MD5) > 0:
+		if !strings.EqualFold(s3MD5, hex.EncodeToString(gsAttrs.MD5)) {
+			return diffChecksumMismatch, &s.diffed.ChecksumMismatch
+		}
+		return diffIdentical, &s.diffed.Identical
+	case storedHashMatches(*key.ETag, gsAttrs):
+		return diffIdentical, &s.diffed.Identical
+	default:
+		return diffUnverified, &s.diffed.Unverified
+	}
+}
+
+// diffExtras adds the objects of the GS listing that S3 didn't list to
+// the diff report as only in GS, in key order. Keys left out by
+// Config.Includes and Config.Excludes are left out here too.
+func (s *syncer) diffExtras() {
+	index := s.dests[0].index
+	var names []string
+	for name := range index {
+		if !s.sourceKeys[name] && s.included(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gsAttrs := index[name]
+		entry := diffEntry{Key: name, GSSize: aws.Int64(gsAttrs.Size), GSMD5: hex.EncodeToString(gsAttrs.MD5)}
+		s.addDiff(entry, diffOnlyInGS, &s.diffed.OnlyInGS)
+	}
+}
+
+// addDiff writes entry to the diff report with status, counting it. Only
+// the objects out of sync are logged at info level.
+func (s *syncer) addDiff(entry diffEntry, status string, counter *uint64) {
+	entry.Status = status
+	atomic.AddUint64(counter, 1)
+	event := Event{Action: status, Key: entry.Key}
+	if status == diffIdentical {
+		atomic.AddUint64(&s.numInSync, 1)
+		s.log.Debug(event, "Identical", entry.Key)
+	} else {
+		s.log.Info(event, "Differs:", entry.Key, status)
+	}
+	s.diff.add(entry)
+}
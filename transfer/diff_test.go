@@ -0,0 +1,36 @@
+package transfer
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestDiffFromIndex(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("compressed.txt", strings.Repeat("compressible ", 100), modified)
+	src.put("same.txt", "same", modified)
+	src.put("resized.txt", "longer in S3", modified)
+	src.put("s3-only.txt", "s3", modified)
+	mustSync(t, Config{Compress: true, Includes: []string{"compressed.txt"}}, src, dst)
+	dst.put("same.txt", "same", storage.ObjectAttrs{})
+	dst.put("resized.txt", "shorter", storage.ObjectAttrs{})
+	dst.put("gs-only.txt", "gs", storage.ObjectAttrs{})
+
+	cfg := Config{DiffReport: filepath.Join(t.TempDir(), "diff.json")}
+	s := newTestSyncer(t, cfg, src, dst)
+	var err error
+	if s.diff, err = openDiff(cfg.DiffReport, s.cfg.FileMode, s.log); err != nil {
+		t.Fatal(err)
+	}
+	defer s.diff.Close()
+	if _, _, err := s.syncPrefix(Prefix{}, true); err != nil {
+		t.Fatal(err)
+	}
+	want := DiffCounts{Identical: 2, OnlyInS3: 1, OnlyInGS: 1, SizeMismatch: 1}
+	if s.diffed != want {
+		t.Errorf("diffed %+v, want %+v", s.diffed, want)
+	}
+}
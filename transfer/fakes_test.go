@@ -0,0 +1,510 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// fakeS3Object is an object in a fakeS3.
+type fakeS3Object struct {
+	data         []byte
+	etag         string // the MD5 of data if empty
+	lastModified time.Time
+	contentType  string
+	encoding     string
+	sse          string // server-side encryption, as s3.ServerSideEncryptionAwsKms
+}
+
+// fakeS3 is an in-memory S3 bucket, standing in for the client, the
+// downloader and the uploader.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]*fakeS3Object
+	pageSize int // keys per listing page; 1000 if 0
+
+	listCalls int
+	getCalls  int // GetObjects and downloads
+	deleted   []string
+	getErr    error // returned by every GetObject and download if set
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]*fakeS3Object)}
+}
+
+// put adds key with data, modified at lastModified, returning the object
+// to adjust.
+func (f *fakeS3) put(key, data string, lastModified time.Time) *fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := &fakeS3Object{data: []byte(data), lastModified: lastModified}
+	f.objects[key] = o
+	return o
+}
+
+func (o *fakeS3Object) eTag() string {
+	if o.etag != "" {
+		return `"` + o.etag + `"`
+	}
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) object(key *string) (*fakeS3Object, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[aws.StringValue(key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "fake")
+	}
+	return o, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(_ aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	o, err := f.object(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength:   aws.Int64(int64(len(o.data))),
+		ETag:            aws.String(o.eTag()),
+		LastModified:    aws.Time(o.lastModified),
+		ContentType:     optionalString(o.contentType),
+		ContentEncoding: optionalString(o.encoding),
+
+		ServerSideEncryption: optionalString(o.sse),
+	}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.countGet()
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	o, err := f.object(in.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(o.data)),
+		ContentLength: aws.Int64(int64(len(o.data))),
+		ETag:          aws.String(o.eTag()),
+	}, nil
+}
+
+func (f *fakeS3) countGet() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getCalls++
+}
+
+func (f *fakeS3) GetObjectTaggingWithContext(aws.Context, *s3.GetObjectTaggingInput, ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	return &s3.GetObjectTaggingOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectAclWithContext(aws.Context, *s3.GetObjectAclInput, ...request.Option) (*s3.GetObjectAclOutput, error) {
+	return &s3.GetObjectAclOutput{}, nil
+}
+
+// ListObjectsV2WithContext lists the keys under the prefix in order,
+// pageSize at a time, the continuation token being the last key sent.
+func (f *fakeS3) ListObjectsV2WithContext(_ aws.Context, in *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listCalls++
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(in.Prefix)) && key > aws.StringValue(in.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pageSize := f.pageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > pageSize)}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		o := f.objects[key]
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(o.data))),
+			ETag:         aws.String(o.eTag()),
+			LastModified: aws.Time(o.lastModified),
+			StorageClass: aws.String(s3.ObjectStorageClassStandard),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents)))
+	return out, nil
+}
+
+func (f *fakeS3) ListObjectVersionsWithContext(aws.Context, *s3.ListObjectVersionsInput, ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	return nil, errors.New("fake S3 has no versions")
+}
+
+func (f *fakeS3) RestoreObjectWithContext(aws.Context, *s3.RestoreObjectInput, ...request.Option) (*s3.RestoreObjectOutput, error) {
+	return nil, errors.New("fake S3 has no archived objects")
+}
+
+func (f *fakeS3) DeleteObjectWithContext(_ aws.Context, in *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.StringValue(in.Key))
+	f.deleted = append(f.deleted, aws.StringValue(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// DownloadWithContext is s3manager.Downloader's, writing the object in one
+// part.
+func (f *fakeS3) DownloadWithContext(_ aws.Context, w io.WriterAt, in *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
+	f.countGet()
+	if f.getErr != nil {
+		return 0, f.getErr
+	}
+	o, err := f.object(in.Key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.WriteAt(o.data, 0)
+	return int64(n), err
+}
+
+// UploadWithContext is s3manager.Uploader's, storing the object whole.
+func (f *fakeS3) UploadWithContext(_ aws.Context, in *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.put(aws.StringValue(in.Key), string(data), time.Now())
+	return &s3manager.UploadOutput{}, nil
+}
+
+// fakeGSObject is an object in a fakeGS.
+type fakeGSObject struct {
+	attrs storage.ObjectAttrs
+	data  []byte
+}
+
+// fakeGS is an in-memory GS bucket, honouring the generation conditions
+// of writes and deletes as GS does.
+type fakeGS struct {
+	mu         sync.Mutex
+	objects    map[string]*fakeGSObject
+	generation int64
+
+	writeErr error // fails every upload's Write if set
+	closeErr error // fails every upload's Close, after committing it, if set
+	attrsErr error // fails every Attrs if set
+	writes   int   // uploads committed
+
+	// beforeDelete is called with the name of each object to delete
+	// before it's deleted, if set
+	beforeDelete func(name string)
+}
+
+func newFakeGS() *fakeGS {
+	return &fakeGS{objects: make(map[string]*fakeGSObject)}
+}
+
+// put stores name with data and attrs, filling in the size, hashes,
+// generation and update time as GS would, and returns its attributes.
+func (f *fakeGS) put(name, data string, attrs storage.ObjectAttrs) *storage.ObjectAttrs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commit(name, []byte(data), attrs)
+}
+
+// commit stores an object, holding mu.
+func (f *fakeGS) commit(name string, data []byte, attrs storage.ObjectAttrs) *storage.ObjectAttrs {
+	f.generation++
+	sum := md5.Sum(data)
+	attrs.Name = name
+	attrs.Size = int64(len(data))
+	attrs.MD5 = sum[:]
+	attrs.CRC32C = crc32.Checksum(data, crc32cTable)
+	attrs.Generation = f.generation
+	if attrs.Updated.IsZero() {
+		attrs.Updated = time.Now()
+	}
+	f.objects[name] = &fakeGSObject{attrs, data}
+	return f.attrsOf(name)
+}
+
+// attrsOf is a copy of the attributes of name, holding mu.
+func (f *fakeGS) attrsOf(name string) *storage.ObjectAttrs {
+	attrs := f.objects[name].attrs
+	if attrs.Metadata != nil {
+		metadata := make(map[string]string, len(attrs.Metadata))
+		for k, v := range attrs.Metadata {
+			metadata[k] = v
+		}
+		attrs.Metadata = metadata
+	}
+	return &attrs
+}
+
+// get returns the object named name, or nil.
+func (f *fakeGS) get(name string) *fakeGSObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[name]
+}
+
+func (f *fakeGS) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type fakeIterator struct {
+	objects []*storage.ObjectAttrs
+}
+
+func (it *fakeIterator) Next() (*storage.ObjectAttrs, error) {
+	if len(it.objects) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := it.objects[0]
+	it.objects = it.objects[1:]
+	return attrs, nil
+}
+
+func (f *fakeGS) Objects(_ context.Context, q *storage.Query) objectIterator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	it := &fakeIterator{}
+	for _, name := range f.sortedNames() {
+		if strings.HasPrefix(name, q.Prefix) {
+			it.objects = append(it.objects, f.attrsOf(name))
+		}
+	}
+	return it
+}
+
+func (f *fakeGS) sortedNames() []string {
+	names := make([]string, 0, len(f.objects))
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeGS) Attrs(_ context.Context, key string) (*storage.ObjectAttrs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.attrsErr != nil {
+		return nil, f.attrsErr
+	}
+	if _, ok := f.objects[key]; !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return f.attrsOf(key), nil
+}
+
+func (f *fakeGS) NewReader(_ context.Context, key string) (io.ReadCloser, error) {
+	o := f.get(key)
+	if o == nil {
+		return nil, storage.ErrObjectNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (f *fakeGS) NewWriter(_ context.Context, attrs storage.ObjectAttrs, generation int64) objectWriter {
+	return &fakeWriter{gs: f, attrs: attrs, generation: generation}
+}
+
+// preconditionFailed is the error GS gives a write or delete whose
+// generation condition doesn't hold.
+var preconditionFailed = &googleapi.Error{Code: http.StatusPreconditionFailed, Message: "precondition failed"}
+
+// matches reports whether name is at generation, or doesn't exist for 0,
+// holding mu.
+func (f *fakeGS) matches(name string, generation int64) bool {
+	o, ok := f.objects[name]
+	if generation == 0 {
+		return !ok
+	}
+	return ok && o.attrs.Generation == generation
+}
+
+func (f *fakeGS) Update(_ context.Context, key string, generation int64, attrs storage.ObjectAttrsToUpdate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.matches(key, generation) {
+		return preconditionFailed
+	}
+	if attrs.Metadata != nil {
+		f.objects[key].attrs.Metadata = attrs.Metadata
+	}
+	return nil
+}
+
+func (f *fakeGS) Delete(_ context.Context, key string, generation int64) error {
+	if f.beforeDelete != nil {
+		f.beforeDelete(key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.objects[key]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	if generation != 0 && !f.matches(key, generation) {
+		return preconditionFailed
+	}
+	delete(f.objects, key)
+	return nil
+}
+
+// fakeWriter is an upload to a fakeGS, committed by Close.
+type fakeWriter struct {
+	gs         *fakeGS
+	attrs      storage.ObjectAttrs
+	generation int64
+	buf        bytes.Buffer
+	aborted    error
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	if w.aborted != nil {
+		return 0, w.aborted
+	}
+	if w.gs.writeErr != nil {
+		return 0, w.gs.writeErr
+	}
+	return w.buf.Write(p)
+}
+
+func (w *fakeWriter) Close() error {
+	if w.aborted != nil {
+		return w.aborted
+	}
+	w.gs.mu.Lock()
+	defer w.gs.mu.Unlock()
+	if !w.gs.matches(w.attrs.Name, w.generation) {
+		return preconditionFailed
+	}
+	w.gs.commit(w.attrs.Name, w.buf.Bytes(), w.attrs)
+	w.gs.writes++
+	return w.gs.closeErr
+}
+
+func (w *fakeWriter) CloseWithError(err error) error {
+	w.aborted = err
+	return nil
+}
+
+// testLogger logs through t, so a failing test shows what the run did.
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Info(e Event, v ...interface{})  { l.log("INFO", v) }
+func (l testLogger) Debug(e Event, v ...interface{}) { l.log("DEBUG", v) }
+func (l testLogger) Error(e Event, v ...interface{}) { l.log("ERROR", v) }
+
+func (l testLogger) log(level string, v []interface{}) {
+	l.t.Helper()
+	l.t.Log(append([]interface{}{level}, v...)...)
+}
+
+// newTestSyncer sets up a syncer for cfg, with its defaults, between the
+// fakes, as Transfer would between real buckets.
+func newTestSyncer(t *testing.T, cfg Config, src *fakeS3, dst *fakeGS) *syncer {
+	t.Helper()
+	if cfg.S3Bucket == "" {
+		cfg.S3Bucket = "s3-bucket"
+	}
+	if cfg.GSBucket == "" {
+		cfg.GSBucket = "gs-bucket"
+	}
+	cfg.Logger = testLogger{t}
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &syncer{
+		cfg:          cfg,
+		log:          cfg.Logger,
+		ctx:          context.Background(),
+		s3Client:     src,
+		s3Downloader: src,
+		s3Uploader:   src,
+		sourceKeys:   make(map[string]bool),
+		sample:       rand.New(rand.NewSource(1)),
+		stop:         make(chan struct{}),
+		limit:        make(chan struct{}),
+		tracer:       newTracer(cfg.TracerProvider),
+	}
+	s.ctx, s.runSpan = s.startSpan(s.ctx, "run")
+	s.dests = []*destination{{bucket: cfg.GSBucket, base: dst, label: "GS"}}
+	s.usePrefix(Prefix{cfg.S3Prefix, cfg.GSPrefix, cfg.StripPrefix})
+	return s
+}
+
+// runSync syncs cfg.S3Prefix between the fakes, as Transfer would.
+func runSync(t *testing.T, cfg Config, src *fakeS3, dst *fakeGS) (Result, error) {
+	t.Helper()
+	s := newTestSyncer(t, cfg, src, dst)
+	p := Prefix{s.cfg.S3Prefix, s.cfg.GSPrefix, s.cfg.StripPrefix}
+	numObjects, numDeleted, err := s.syncPrefix(p, true)
+	result := s.result(numObjects)
+	result.Deleted = numDeleted
+	return result, err
+}
+
+// mustSync is runSync for a run that must succeed without failures.
+func mustSync(t *testing.T, cfg Config, src *fakeS3, dst *fakeGS) Result {
+	t.Helper()
+	result, err := runSync(t, cfg, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed > 0 {
+		t.Fatalf("%d objects failed: %v", result.Failed, result.Failures)
+	}
+	return result
+}
+
+// md5Hex is the hex MD5 of data, as an S3 ETag of a single part upload
+// has it.
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// multipartETag is an ETag as S3 gives a multipart upload of parts
+// parts, which isn't the MD5 of the content.
+func multipartETag(data string, parts int) string {
+	return fmt.Sprintf("%s-%d", md5Hex("parts of "+data), parts)
+}
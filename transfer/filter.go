@@ -0,0 +1,96 @@
+package transfer
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// patterns are globs as given by Config.Includes and Config.Excludes.
+type patterns []string
+
+// validate reports the first malformed pattern.
+func (p patterns) validate() error {
+	for _, pattern := range p {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether any pattern matches key. Patterns containing a
+// slash match the whole key, others just its last element, so *.parquet
+// matches a/b.parquet.
+func (p patterns) match(key string) bool {
+	for _, pattern := range p {
+		name := key
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(key)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether key passes Config.Includes and
+// Config.Excludes. Excludes win over includes, and with no includes every
+// key is included.
+func (s *syncer) included(key string) bool {
+	if patterns(s.cfg.Excludes).match(key) {
+		return false
+	}
+	return len(s.cfg.Includes) == 0 || patterns(s.cfg.Includes).match(key)
+}
+
+// compresses reports whether Config.Compress applies to key, of
+// contentType, from a source encoded with contentEncoding.
+func (s *syncer) compresses(key, contentType, contentEncoding string) bool {
+	if !s.cfg.Compress || contentEncoding != "" {
+		return false
+	}
+	if len(s.cfg.CompressIncludes) == 0 && len(s.cfg.CompressTypes) == 0 {
+		return true
+	}
+	if patterns(s.cfg.CompressIncludes).match(key) {
+		return true
+	}
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, pattern := range s.cfg.CompressTypes {
+		if matched, _ := path.Match(pattern, mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeInRange reports whether an object of size bytes is within
+// Config.MinSize and Config.MaxSize.
+func (s *syncer) sizeInRange(size int64) bool {
+	if uint64(size) < s.cfg.MinSize {
+		return false
+	}
+	return s.cfg.MaxSize == 0 || uint64(size) <= s.cfg.MaxSize
+}
+
+// isFolder reports whether an object is a folder placeholder, an empty
+// object whose key ends in a slash, as the S3 console makes.
+func isFolder(key string, size int64) bool {
+	return size == 0 && strings.HasSuffix(key, "/")
+}
+
+// modifiedInRange reports whether an object the source last modified at
+// modified is after Config.ModifiedAfter. It compares the source's own
+// timestamps, so the local clock only matters for working out the cutoff.
+func (s *syncer) modifiedInRange(modified time.Time) bool {
+	return s.cfg.ModifiedAfter.IsZero() || modified.After(s.cfg.ModifiedAfter)
+}
+
+// leaveOut counts key, left out of the listing for reason, in counter,
+// one of the syncer's listing counts.
+func (s *syncer) leaveOut(counter *int, reason, key string, size int64) {
+	*counter++
+	s.report.add(reportEntry{Key: key, Action: "filter", Reason: reason, Size: size})
+}
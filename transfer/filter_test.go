@@ -0,0 +1,129 @@
+package transfer
+
+import "testing"
+
+func TestIncluded(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		includes, excludes []string
+		included, excluded []string // keys
+	}{
+		{
+			name:     "no patterns",
+			included: []string{"a.txt", "dir/b.parquet", "", "dir/"},
+		},
+		{
+			name:     "include by name",
+			includes: []string{"*.parquet"},
+			included: []string{"b.parquet", "dir/sub/b.parquet"},
+			excluded: []string{"a.txt", "dir/b.parquet.tmp", "dir/"},
+		},
+		{
+			name:     "include by path",
+			includes: []string{"dir/*"},
+			included: []string{"dir/a.txt", "dir/b.parquet"},
+			excluded: []string{"a.txt", "other/a.txt", "dir/sub/a.txt"},
+		},
+		{
+			name:     "exclude wins",
+			includes: []string{"*.parquet"},
+			excludes: []string{"tmp-*"},
+			included: []string{"dir/b.parquet"},
+			excluded: []string{"tmp-b.parquet", "dir/tmp-b.parquet", "a.txt"},
+		},
+		{
+			name:     "overlapping includes",
+			includes: []string{"*.parquet", "b.*"},
+			included: []string{"a.parquet", "b.txt", "b.parquet"},
+			excluded: []string{"a.txt"},
+		},
+		{
+			name:     "overlapping excludes",
+			excludes: []string{"*.tmp", "dir/*"},
+			included: []string{"a.txt", "other/a.txt"},
+			excluded: []string{"a.tmp", "dir/a.txt", "dir/a.tmp"},
+		},
+		{
+			name:     "include and exclude the same",
+			includes: []string{"*.txt"},
+			excludes: []string{"*.txt"},
+			excluded: []string{"a.txt"},
+		},
+		{
+			// An empty pattern matches no key, so it includes nothing and
+			// excludes nothing
+			name:     "empty include",
+			includes: []string{""},
+			excluded: []string{"a.txt", ""},
+		},
+		{
+			name:     "empty exclude",
+			excludes: []string{""},
+			included: []string{"a.txt", ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSyncer(t, Config{Includes: tc.includes, Excludes: tc.excludes}, newFakeS3(), newFakeGS())
+			for _, key := range tc.included {
+				if !s.included(key) {
+					t.Errorf("%q excluded", key)
+				}
+			}
+			for _, key := range tc.excluded {
+				if s.included(key) {
+					t.Errorf("%q included", key)
+				}
+			}
+		})
+	}
+}
+
+func TestPatternsValidate(t *testing.T) {
+	if err := (patterns{"*.txt", "dir/*", "", "[a-c]?"}).validate(); err != nil {
+		t.Errorf("valid patterns: %v", err)
+	}
+	if err := (patterns{"*.txt", "[a-"}).validate(); err == nil {
+		t.Error("malformed pattern accepted")
+	}
+	if _, err := (Config{S3Bucket: "s3", GSBucket: "gs", Excludes: []string{"[a-"}}).withDefaults(); err == nil {
+		t.Error("config with a malformed exclude accepted")
+	}
+}
+
+func TestSyncSkipsFiltered(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.parquet", "a", modified)
+	src.put("tmp-b.parquet", "b", modified)
+	src.put("c.txt", "c", modified)
+
+	result := mustSync(t, Config{Includes: []string{"*.parquet"}, Excludes: []string{"tmp-*"}}, src, dst)
+	if result.Transferred != 1 || result.Filtered != 2 {
+		t.Errorf("transferred %d and filtered %d, want 1 and 2", result.Transferred, result.Filtered)
+	}
+	if names := dst.names(); len(names) != 1 || names[0] != "a.parquet" {
+		t.Errorf("copied %v, want just a.parquet", names)
+	}
+}
+
+func TestCompresses(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		includes, types  []string
+		key, contentType string
+		encoding         string
+		want             bool
+	}{
+		{name: "everything", key: "a.bin", contentType: "application/octet-stream", want: true},
+		{name: "encoded source", key: "a.txt", encoding: "br"},
+		{name: "by key", includes: []string{"*.txt"}, key: "dir/a.txt", want: true},
+		{name: "by type", types: []string{"text/*"}, key: "a", contentType: "text/csv; charset=utf-8", want: true},
+		{name: "neither", includes: []string{"*.txt"}, types: []string{"text/*"}, key: "a.png", contentType: "image/png"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSyncer(t, Config{Compress: true, CompressIncludes: tc.includes, CompressTypes: tc.types}, newFakeS3(), newFakeGS())
+			if got := s.compresses(tc.key, tc.contentType, tc.encoding); got != tc.want {
+				t.Errorf("compresses = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
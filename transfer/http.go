@@ -0,0 +1,62 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// newHTTPClient returns the client every AWS and GS request goes
+// through, sent via proxy, or the proxy the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables name if nil. It has no overall timeout,
+// as objects can take any time to stream; Config.ObjectTimeout bounds
+// those.
+func newHTTPClient(proxy *url.URL, concurrency int) *http.Client {
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != nil {
+		proxyFunc = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		// Keep a connection per worker to each host between objects
+		MaxIdleConnsPerHost: concurrency,
+	}}
+}
+
+// tracedHTTPClient returns base with each request traced by provider,
+// under the span in the request's context.
+func tracedHTTPClient(base *http.Client, provider trace.TracerProvider) *http.Client {
+	return &http.Client{Transport: otelhttp.NewTransport(base.Transport, otelhttp.WithTracerProvider(provider))}
+}
+
+// newGSHTTPClient returns base authorized for GS with opts. Fetching
+// tokens goes through base too, so through the same proxy.
+func newGSHTTPClient(ctx context.Context, base *http.Client, opts ...option.ClientOption) (*http.Client, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+	opts = append(opts, option.WithScopes(storage.ScopeFullControl))
+	transport, err := htransport.NewTransport(ctx, base.Transport, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,43 @@
+package transfer
+
+import (
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// indexGS lists the objects under s3Prefix in gs once, keeping just what
+// comparing them with S3 needs, so that syncing each key is a map lookup
+// rather than a request. That includes when each was updated and its
+// metadata and encoding, which record the source of a compressed copy,
+// a stored source hash and the source's last modified time.
+func (s *syncer) indexGS(gs gsObjects) (map[string]*storage.ObjectAttrs, error) {
+	index := make(map[string]*storage.ObjectAttrs)
+	it := gs.Objects(s.ctx, &storage.Query{Prefix: s.cfg.S3Prefix})
+	for {
+		gsAttrs, err := it.Next()
+		if err == iterator.Done {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		index[gsAttrs.Name] = &storage.ObjectAttrs{
+			Name:       gsAttrs.Name,
+			Size:       gsAttrs.Size,
+			MD5:        gsAttrs.MD5,
+			CRC32C:     gsAttrs.CRC32C,
+			Generation: gsAttrs.Generation,
+			Updated:    gsAttrs.Updated,
+			Metadata:   gsAttrs.Metadata,
+
+			ContentEncoding: gsAttrs.ContentEncoding,
+		}
+	}
+}
+
+// gsAttrs returns the attributes of key in Config.GSBucket, as
+// destination.attrs does.
+func (s *syncer) gsAttrs(ctx context.Context, key string) (*storage.ObjectAttrs, error) {
+	return s.dests[0].attrs(ctx, key)
+}
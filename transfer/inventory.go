@@ -0,0 +1,474 @@
+package transfer
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+	"github.com/scritchley/orc"
+)
+
+// inventoryManifest is the manifest.json of an S3 Inventory report, as
+// named by Config.InventoryManifest.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"` // an ARN, arn:aws:s3:::bucket
+	FileFormat        string `json:"fileFormat"`        // CSV, ORC or Parquet
+	FileSchema        string `json:"fileSchema"`        // the CSV columns, e.g. "Bucket, Key, Size"
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// errNoInventoryFiles is returned for a manifest listing no data files.
+var errNoInventoryFiles = errors.New("the inventory manifest lists no files")
+
+// inventoryPageSize is how many inventory rows are filtered at once, as
+// a page of the S3 listing would be.
+const inventoryPageSize = 1000
+
+// parseS3URL splits s3://bucket/key.
+func parseS3URL(rawURL string) (bucket, key string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || len(u.Path) < 2 {
+		return "", "", fmt.Errorf("%q isn't an s3://bucket/key URL", rawURL)
+	}
+	return u.Host, u.Path[1:], nil
+}
+
+// listInventory is listS3 for the objects under Config.S3Prefix in the S3
+// Inventory report Config.InventoryManifest, instead of a listing. Rows
+// with all the fields the run goes by are filtered as a listing would be;
+// any without are looked up by the worker that syncs them, as for
+// Config.KeysFile. Old versions and delete markers in a report of all
+// versions are left out.
+func (s *syncer) listInventory(tasks chan<- task) (int, error) {
+	manifest, err := s.inventoryManifest()
+	if err != nil {
+		return 0, err
+	}
+	reportBucket := manifest.DestinationBucket[strings.LastIndex(manifest.DestinationBucket, ":")+1:]
+
+	numObjects := 0
+	for _, file := range manifest.Files {
+		done, err := s.listInventoryFile(tasks, manifest, reportBucket, file.Key, &numObjects)
+		if err != nil {
+			return numObjects, fmt.Errorf("reading inventory file %s: %w", file.Key, err)
+		}
+		if done {
+			break
+		}
+	}
+	return numObjects, nil
+}
+
+// inventoryManifest reads and checks Config.InventoryManifest.
+func (s *syncer) inventoryManifest() (*inventoryManifest, error) {
+	bucket, key, err := parseS3URL(s.cfg.InventoryManifest)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.s3Client.GetObjectWithContext(s.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting inventory manifest: %w", err)
+	}
+	defer object.Body.Close()
+
+	var manifest inventoryManifest
+	if err := json.NewDecoder(object.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading inventory manifest: %w", err)
+	}
+	switch {
+	case manifest.SourceBucket != s.cfg.S3Bucket:
+		return nil, fmt.Errorf("the inventory is of %s, not %s", manifest.SourceBucket, s.cfg.S3Bucket)
+	case manifest.FileFormat != "CSV" && manifest.FileFormat != "ORC" && manifest.FileFormat != "Parquet":
+		return nil, fmt.Errorf("the inventory is in %s, not CSV, ORC or Parquet", manifest.FileFormat)
+	case manifest.FileFormat == "CSV" && !parseCSVColumns(manifest.FileSchema).has("Key"):
+		return nil, fmt.Errorf("inventory schema %q has no Key", manifest.FileSchema)
+	case len(manifest.Files) == 0:
+		return nil, errNoInventoryFiles
+	}
+	return &manifest, nil
+}
+
+// listInventoryFile sends the objects in one data file of the inventory
+// to tasks, reporting whether the listing should stop.
+func (s *syncer) listInventoryFile(tasks chan<- task, manifest *inventoryManifest, bucket, key string, numObjects *int) (done bool, err error) {
+	rows, err := s.openInventoryFile(manifest, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var page []*s3.Object
+	for {
+		field, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if field("IsLatest") == "false" || field("IsDeleteMarker") == "true" {
+			continue
+		}
+		objectKey := field("Key")
+		if !strings.HasPrefix(objectKey, s.cfg.S3Prefix) {
+			continue
+		}
+
+		object, complete := s.inventoryObject(objectKey, field)
+		if complete {
+			if page = append(page, object); len(page) == inventoryPageSize {
+				if s.listS3Page(tasks, page, numObjects) {
+					return true, nil
+				}
+				page = nil
+			}
+			continue
+		}
+		if len(page) > 0 {
+			if s.listS3Page(tasks, page, numObjects) {
+				return true, nil
+			}
+			page = nil
+		}
+		if s.sendKey(tasks, objectKey, numObjects) {
+			return true, nil
+		}
+	}
+	return len(page) > 0 && s.listS3Page(tasks, page, numObjects), nil
+}
+
+// inventoryObject is the listing entry for key from the fields of its
+// inventory row. complete is false if the row lacks any field the run
+// goes by: the size and ETag it's compared by, the storage class that
+// says whether it has to be restored first, and the last modified date
+// for Config.ModifiedAfter and Config.Conflict newer.
+func (s *syncer) inventoryObject(key string, field func(name string) string) (object *s3.Object, complete bool) {
+	size, err := strconv.ParseInt(field("Size"), 10, 64)
+	etag, class := field("ETag"), field("StorageClass")
+	if err != nil || etag == "" || class == "" {
+		return nil, false
+	}
+	object = &s3.Object{
+		Key:  aws.String(key),
+		Size: aws.Int64(size),
+		// Listings quote ETags, inventories don't
+		ETag:         aws.String(`"` + etag + `"`),
+		StorageClass: aws.String(class),
+	}
+	modified, err := time.Parse(time.RFC3339, field("LastModifiedDate"))
+	if err == nil {
+		object.LastModified = aws.Time(modified)
+	} else if !s.cfg.ModifiedAfter.IsZero() || s.cfg.Conflict == "newer" {
+		return nil, false
+	}
+	return object, true
+}
+
+// inventoryRows reads the rows of one data file of an inventory.
+type inventoryRows interface {
+	// next returns the fields of the next row by their CSV column names,
+	// "" for any it doesn't have, or io.EOF after the last row.
+	next() (field func(name string) string, err error)
+	Close() error
+}
+
+// openInventoryFile opens key in bucket, a data file of manifest, for
+// reading its rows. An ORC or Parquet file has to be read out of order,
+// so it's downloaded to a temporary file first.
+func (s *syncer) openInventoryFile(manifest *inventoryManifest, bucket, key string) (inventoryRows, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if manifest.FileFormat == "CSV" {
+		object, err := s.s3Client.GetObjectWithContext(s.ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := newCSVInventoryRows(object.Body, parseCSVColumns(manifest.FileSchema))
+		if err != nil {
+			object.Body.Close()
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	file, err := os.CreateTemp("", "inventory-*")
+	if err != nil {
+		return nil, err
+	}
+	// Removed once closed, however reading it ends
+	os.Remove(file.Name())
+	size, err := s.s3Downloader.DownloadWithContext(s.ctx, file, input)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var rows inventoryRows
+	if manifest.FileFormat == "ORC" {
+		rows, err = newORCInventoryRows(file, size)
+	} else {
+		rows, err = newParquetInventoryRows(file, size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// csvColumns maps the column names of a CSV inventory's schema, as in
+// its manifest, to their indexes.
+type csvColumns map[string]int
+
+func (c csvColumns) has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// parseCSVColumns parses schema, e.g. "Bucket, Key, Size".
+func parseCSVColumns(schema string) csvColumns {
+	columns := make(map[string]int)
+	for i, name := range strings.Split(schema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	return columns
+}
+
+// csvInventoryRows reads a gzipped CSV data file, whose keys are URL
+// encoded.
+type csvInventoryRows struct {
+	body    io.ReadCloser
+	rows    *csv.Reader
+	columns csvColumns
+}
+
+func newCSVInventoryRows(body io.ReadCloser, columns csvColumns) (*csvInventoryRows, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	rows := csv.NewReader(gz)
+	rows.FieldsPerRecord = len(columns)
+	return &csvInventoryRows{body, rows, columns}, nil
+}
+
+func (r *csvInventoryRows) next() (func(name string) string, error) {
+	row, err := r.rows.Read()
+	if err != nil {
+		return nil, err
+	}
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+	key, err := url.QueryUnescape(field("Key"))
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", field("Key"), err)
+	}
+	return func(name string) string {
+		if name == "Key" {
+			return key
+		}
+		return field(name)
+	}, nil
+}
+
+func (r *csvInventoryRows) Close() error { return r.body.Close() }
+
+// inventoryColumns are the ORC and Parquet column names of the CSV
+// columns read.
+var inventoryColumns = map[string]string{
+	"Key":              "key",
+	"Size":             "size",
+	"ETag":             "e_tag",
+	"StorageClass":     "storage_class",
+	"LastModifiedDate": "last_modified_date",
+	"IsLatest":         "is_latest",
+	"IsDeleteMarker":   "is_delete_marker",
+}
+
+// inventoryValue formats an ORC or Parquet value as it would be in a CSV
+// inventory, "" if it's null.
+func inventoryValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// sizedFile is an *os.File of a known size, as orc.NewReader reads.
+type sizedFile struct {
+	*os.File
+	size int64
+}
+
+func (f sizedFile) Size() int64 { return f.size }
+
+// orcInventoryRows reads an ORC data file one stripe at a time.
+type orcInventoryRows struct {
+	file    *os.File
+	reader  *orc.Reader
+	cursor  *orc.Cursor
+	columns map[string]int // the selected columns by CSV name
+	inRows  bool           // whether a stripe is being read
+}
+
+func newORCInventoryRows(file *os.File, size int64) (*orcInventoryRows, error) {
+	reader, err := orc.NewReader(sizedFile{file, size})
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool)
+	for _, name := range reader.Schema().Columns() {
+		present[name] = true
+	}
+	if !present["key"] {
+		return nil, errors.New("the ORC schema has no key")
+	}
+	columns := make(map[string]int)
+	var selected []string
+	for csvName, name := range inventoryColumns {
+		if present[name] {
+			columns[csvName] = len(selected)
+			selected = append(selected, name)
+		}
+	}
+	return &orcInventoryRows{file: file, reader: reader, cursor: reader.Select(selected...), columns: columns}, nil
+}
+
+func (r *orcInventoryRows) next() (func(name string) string, error) {
+	for {
+		if r.inRows && r.cursor.Next() {
+			break
+		}
+		if r.inRows = r.cursor.Stripes(); !r.inRows {
+			if err := r.cursor.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	}
+	row := r.cursor.Row()
+	return func(name string) string {
+		if i, ok := r.columns[name]; ok {
+			return inventoryValue(row[i])
+		}
+		return ""
+	}, nil
+}
+
+func (r *orcInventoryRows) Close() error {
+	r.reader.Close()
+	return r.file.Close()
+}
+
+// parquetInventoryRows reads a Parquet data file a batch of rows at a
+// time.
+type parquetInventoryRows struct {
+	file    *os.File
+	reader  *parquet.Reader
+	columns map[string]parquet.LeafColumn // by CSV name
+	rows    []parquet.Row
+	n, i    int // rows read into rows and returned
+}
+
+func newParquetInventoryRows(file *os.File, size int64) (*parquetInventoryRows, error) {
+	f, err := parquet.OpenFile(file, size)
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]parquet.LeafColumn)
+	for csvName, name := range inventoryColumns {
+		if leaf, ok := f.Schema().Lookup(name); ok {
+			columns[csvName] = leaf
+		}
+	}
+	if _, ok := columns["Key"]; !ok {
+		return nil, errors.New("the Parquet schema has no key")
+	}
+	return &parquetInventoryRows{
+		file:    file,
+		reader:  parquet.NewReader(f),
+		columns: columns,
+		rows:    make([]parquet.Row, inventoryPageSize),
+	}, nil
+}
+
+func (r *parquetInventoryRows) next() (func(name string) string, error) {
+	for r.i == r.n {
+		n, err := r.reader.ReadRows(r.rows)
+		r.n, r.i = n, 0
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, err
+		}
+	}
+	row := r.rows[r.i]
+	r.i++
+	return func(name string) string {
+		leaf, ok := r.columns[name]
+		if !ok {
+			return ""
+		}
+		for _, v := range row {
+			if v.Column() == leaf.ColumnIndex {
+				return parquetValue(v, leaf.Node)
+			}
+		}
+		return ""
+	}, nil
+}
+
+func (r *parquetInventoryRows) Close() error {
+	r.reader.Close()
+	return r.file.Close()
+}
+
+// parquetValue formats v, a value of the column node, as inventoryValue
+// does. Timestamps are integers of the unit their logical type gives.
+func parquetValue(v parquet.Value, node parquet.Node) string {
+	switch v.Kind() {
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(v.ByteArray())
+	case parquet.Boolean:
+		return inventoryValue(v.Boolean())
+	case parquet.Int32:
+		return inventoryValue(v.Int32())
+	case parquet.Int64:
+		if logical := node.Type().LogicalType(); logical != nil {
+			if timestamp, ok := logical.Value.(*format.TimestampType); ok && timestamp.Unit.Value != nil {
+				return inventoryValue(time.Unix(0, v.Int64()*int64(timestamp.Unit.Value.Duration())))
+			}
+		}
+		return inventoryValue(v.Int64())
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/parquet-go/parquet-go"
+	"github.com/scritchley/orc"
+)
+
+// inventoryRow is a row of a test inventory. A zero size, ETag, storage
+// class or last modified date is left out.
+type inventoryRow struct {
+	key      string
+	size     int64
+	etag     string
+	class    string
+	modified time.Time
+	old      bool // not the latest version
+}
+
+// parquetInventoryRow is an inventoryRow in the Parquet schema S3 uses.
+type parquetInventoryRow struct {
+	Bucket       string     `parquet:"bucket"`
+	Key          string     `parquet:"key"`
+	IsLatest     bool       `parquet:"is_latest"`
+	Size         *int64     `parquet:"size,optional"`
+	Modified     *time.Time `parquet:"last_modified_date,optional,timestamp(millisecond)"`
+	ETag         *string    `parquet:"e_tag,optional"`
+	StorageClass *string    `parquet:"storage_class,optional"`
+}
+
+// putInventory adds an inventory of rows in format to src, with the
+// manifest at inventory/manifest.json, and returns its s3:// URL. A CSV
+// inventory has the columns of schema.
+func putInventory(t *testing.T, src *fakeS3, format, schema string, rows []inventoryRow) string {
+	t.Helper()
+	var data bytes.Buffer
+	switch format {
+	case "CSV":
+		gz := gzip.NewWriter(&data)
+		w := csv.NewWriter(gz)
+		for _, row := range rows {
+			values := map[string]string{
+				"Bucket":   "s3-bucket",
+				"Key":      url.QueryEscape(row.key),
+				"IsLatest": strconv.FormatBool(!row.old),
+				"ETag":     row.etag,
+			}
+			if row.size != 0 {
+				values["Size"] = strconv.FormatInt(row.size, 10)
+			}
+			if row.class != "" {
+				values["StorageClass"] = row.class
+			}
+			if !row.modified.IsZero() {
+				values["LastModifiedDate"] = row.modified.Format(time.RFC3339)
+			}
+			columns := parseCSVColumns(schema)
+			record := make([]string, len(columns))
+			for name, i := range columns {
+				record[i] = values[name]
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		gz.Close()
+	case "ORC":
+		orcSchema, err := orc.ParseSchema("struct<bucket:string,key:string,is_latest:boolean,size:bigint,last_modified_date:timestamp,e_tag:string,storage_class:string>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := orc.NewWriter(&data, orc.SetSchema(orcSchema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			var size, modified, etag, class interface{}
+			if row.size != 0 {
+				size = row.size
+			}
+			if !row.modified.IsZero() {
+				modified = row.modified
+			}
+			if row.etag != "" {
+				etag = row.etag
+			}
+			if row.class != "" {
+				class = row.class
+			}
+			if err := w.Write("s3-bucket", row.key, !row.old, size, modified, etag, class); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "Parquet":
+		w := parquet.NewGenericWriter[parquetInventoryRow](&data)
+		for _, row := range rows {
+			row := row
+			pr := parquetInventoryRow{Bucket: "s3-bucket", Key: row.key, IsLatest: !row.old}
+			if row.size != 0 {
+				pr.Size = &row.size
+			}
+			if !row.modified.IsZero() {
+				pr.Modified = &row.modified
+			}
+			if row.etag != "" {
+				pr.ETag = &row.etag
+			}
+			if row.class != "" {
+				pr.StorageClass = &row.class
+			}
+			if _, err := w.Write([]parquetInventoryRow{pr}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.put("inventory/data", data.String(), modified)
+
+	manifest := map[string]interface{}{
+		"sourceBucket":      "s3-bucket",
+		"destinationBucket": "arn:aws:s3:::s3-bucket",
+		"fileFormat":        format,
+		"fileSchema":        schema,
+		"files":             []map[string]string{{"key": "inventory/data"}},
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.put("inventory/manifest.json", string(body), modified)
+	return "s3://s3-bucket/inventory/manifest.json"
+}
+
+func TestSyncInventory(t *testing.T) {
+	const fullSchema = "Bucket, Key, IsLatest, Size, LastModifiedDate, ETag, StorageClass"
+	const undatedSchema = "Bucket, Key, IsLatest, Size, ETag, StorageClass"
+	for _, tc := range []struct {
+		name           string
+		format, schema string
+		cfg            Config
+	}{
+		{name: "CSV", format: "CSV", schema: fullSchema},
+		{name: "ORC", format: "ORC"},
+		{name: "Parquet", format: "Parquet"},
+		// Each object is looked up for the date it's filtered by
+		{name: "undated, modified after", format: "CSV", schema: undatedSchema, cfg: Config{ModifiedAfter: modified.Add(-time.Hour)}},
+		{name: "undated, newer", format: "CSV", schema: undatedSchema, cfg: Config{Conflict: "newer"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("data/a b", "a", modified)
+			src.put("data/b", "b", modified)
+			src.put("data/c", "c", modified)
+			src.put("other/d", "d", modified)
+			cfg := tc.cfg
+			cfg.S3Prefix = "data/"
+			cfg.InventoryManifest = putInventory(t, src, tc.format, tc.schema, []inventoryRow{
+				{key: "data/a b", size: 1, etag: md5Hex("a"), class: "STANDARD", modified: modified},
+				// Looked up in S3
+				{key: "data/b"},
+				{key: "data/c", size: 1, etag: md5Hex("c"), class: "STANDARD", modified: modified, old: true},
+				{key: "other/d", size: 1, etag: md5Hex("d"), class: "STANDARD", modified: modified},
+			})
+			if tc.cfg.Conflict == "newer" {
+				dst.put("data/a b", "older", storage.ObjectAttrs{Updated: modified.Add(-time.Hour)})
+			}
+
+			result := mustSync(t, cfg, src, dst)
+			if names := dst.names(); result.Transferred != 2 || len(names) != 2 || names[0] != "data/a b" || names[1] != "data/b" {
+				t.Errorf("transferred %d objects, %v, want data/a b and data/b", result.Transferred, names)
+			}
+		})
+	}
+}
+
+func TestInventoryObject(t *testing.T) {
+	full := map[string]string{
+		"Size":             "1",
+		"ETag":             md5Hex("a"),
+		"StorageClass":     "STANDARD",
+		"LastModifiedDate": modified.Format(time.RFC3339),
+	}
+	without := func(name string) map[string]string {
+		row := make(map[string]string)
+		for k, v := range full {
+			if k != name {
+				row[k] = v
+			}
+		}
+		return row
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		row  map[string]string
+		want bool // complete
+	}{
+		{name: "full", row: full, want: true},
+		{name: "no size", row: without("Size")},
+		{name: "no ETag", row: without("ETag")},
+		// Whether it has to be restored first is down to its storage class
+		{name: "no storage class", row: without("StorageClass")},
+		{name: "no date", row: without("LastModifiedDate"), want: true},
+		{name: "no date to filter by", cfg: Config{ModifiedAfter: modified}, row: without("LastModifiedDate")},
+		{name: "no date to compare", cfg: Config{Conflict: "newer"}, row: without("LastModifiedDate")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSyncer(t, tc.cfg, newFakeS3(), newFakeGS())
+			object, complete := s.inventoryObject("key", func(name string) string { return tc.row[name] })
+			if complete != tc.want {
+				t.Fatalf("complete = %v, want %v", complete, tc.want)
+			}
+			if complete && (*object.Size != 1 || *object.ETag != `"`+md5Hex("a")+`"` || *object.StorageClass != "STANDARD") {
+				t.Errorf("got %v", object)
+			}
+		})
+	}
+}
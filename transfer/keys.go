@@ -0,0 +1,132 @@
+package transfer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// listKeysFile is listS3 and listGS for the keys in Config.KeysFile, one
+// per line, instead of a listing. Each key's attributes are looked up by
+// the worker that syncs it, so a key missing from the source fails on its
+// own without stopping the run.
+func (s *syncer) listKeysFile(tasks chan<- task) (int, error) {
+	f, err := os.Open(s.cfg.KeysFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	numObjects := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" {
+			continue
+		}
+		if s.sendKey(tasks, key, &numObjects) {
+			return numObjects, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return numObjects, fmt.Errorf("reading %s: %v", s.cfg.KeysFile, err)
+	}
+	return numObjects, nil
+}
+
+// sendKey sends key, from a list of keys rather than a listing, to tasks
+// to be looked up by its worker, reporting whether the listing should
+// stop.
+func (s *syncer) sendKey(tasks chan<- task, key string, numObjects *int) (done bool) {
+	if !s.included(key) {
+		s.leaveOut(&s.numFiltered, reasonFiltered, key, 0)
+		return false
+	}
+	if s.listLimitReached(*numObjects) {
+		s.moreRemain = true
+		return true
+	}
+	select {
+	case tasks <- task{key, 0, s.keyTask(key, "")}:
+		*numObjects++
+		return false
+	case <-s.stop:
+		return true
+	}
+}
+
+// listVersion is listKeysFile for the one version Config.S3VersionID of
+// the key Config.S3Prefix.
+func (s *syncer) listVersion(tasks chan<- task) (int, error) {
+	key := s.cfg.S3Prefix
+	select {
+	case tasks <- task{versionedName(key, s.cfg.S3VersionID), 0, s.keyTask(key, s.cfg.S3VersionID)}:
+		return 1, nil
+	case <-s.stop:
+		return 0, nil
+	}
+}
+
+// keyTask returns the comparison for a key from Config.KeysFile, or with
+// version that version of it: it looks the key up in the source, then
+// compares or verifies it as if it had been listed.
+func (s *syncer) keyTask(key, version string) func(ctx context.Context) (func(worker int) error, error) {
+	return func(ctx context.Context) (func(worker int) error, error) {
+		if s.cfg.Direction == GSToS3 && !s.cfg.Verify {
+			gsAttrs, err := s.gs.Attrs(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("looking up in GS: %w", err)
+			}
+			if !s.sizeInRange(gsAttrs.Size) {
+				s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonOutOfRange, "S3"), key)
+				s.countSkip(reasonOutOfRange)
+				s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonOutOfRange, Size: gsAttrs.Size})
+				return nil, nil
+			}
+			if !s.modifiedInRange(gsAttrs.Updated) {
+				s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonTooOld, "S3"), key)
+				s.countSkip(reasonTooOld)
+				s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonTooOld, Size: gsAttrs.Size})
+				return nil, nil
+			}
+			return s.syncObjectToS3(ctx, gsAttrs)
+		}
+
+		head, err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(s.cfg.S3Bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(version),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("looking up in S3: %w", err)
+		}
+		object := &s3.Object{
+			Key:          aws.String(key),
+			Size:         head.ContentLength,
+			ETag:         head.ETag,
+			LastModified: head.LastModified,
+			StorageClass: head.StorageClass,
+		}
+		if !s.sizeInRange(*object.Size) {
+			s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonOutOfRange, "GS"), key)
+			s.countSkip(reasonOutOfRange)
+			s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonOutOfRange, Size: *object.Size})
+			return nil, nil
+		}
+		if !s.modifiedInRange(aws.TimeValue(object.LastModified)) {
+			s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonTooOld, "GS"), key)
+			s.countSkip(reasonTooOld)
+			s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonTooOld, Size: *object.Size})
+			return nil, nil
+		}
+		if s.cfg.Verify {
+			return s.verifyObject(ctx, object)
+		}
+		return s.syncObject(ctx, object, version)
+	}
+}
@@ -0,0 +1,29 @@
+package transfer
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Listed is an S3 object passed to Config.List.
+type Listed struct {
+	Key          string
+	Size         int64
+	ETag         string // without quotes
+	LastModified time.Time
+	StorageClass string
+}
+
+// listed is key as passed to Config.List.
+func listed(key *s3.Object) Listed {
+	return Listed{
+		Key:          *key.Key,
+		Size:         *key.Size,
+		ETag:         strings.Trim(aws.StringValue(key.ETag), "\""),
+		LastModified: aws.TimeValue(key.LastModified),
+		StorageClass: aws.StringValue(key.StorageClass),
+	}
+}
@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// putKeys adds n objects to src, key-0 to key-(n-1).
+func putKeys(src *fakeS3, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		src.put(key, key, modified)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// drain collects the keys of tasks until it's closed.
+func drain(tasks <-chan task) <-chan []string {
+	keys := make(chan []string, 1)
+	go func() {
+		var listed []string
+		for t := range tasks {
+			listed = append(listed, t.key)
+		}
+		keys <- listed
+	}()
+	return keys
+}
+
+func TestListS3Pages(t *testing.T) {
+	src := newFakeS3()
+	src.pageSize = 2
+	want := putKeys(src, 5)
+	s := newTestSyncer(t, Config{}, src, newFakeGS())
+
+	tasks := make(chan task)
+	listed := drain(tasks)
+	n, err := s.listS3(tasks)
+	close(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-listed; n != 5 || !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %d objects %v, want %v", n, got, want)
+	}
+	if src.listCalls != 3 {
+		t.Errorf("listed %d pages, want 3", src.listCalls)
+	}
+}
+
+func TestListS3StopsAtMaxObjects(t *testing.T) {
+	src := newFakeS3()
+	src.pageSize = 2
+	keys := putKeys(src, 5)
+	s := newTestSyncer(t, Config{MaxObjects: 3}, src, newFakeGS())
+
+	tasks := make(chan task)
+	listed := drain(tasks)
+	n, err := s.listS3(tasks)
+	close(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-listed; n != 3 || !reflect.DeepEqual(got, keys[:3]) {
+		t.Errorf("listed %d objects %v, want %v", n, got, keys[:3])
+	}
+	// The limit falls in the middle of the second page
+	if src.listCalls != 2 || !s.moreRemain {
+		t.Errorf("listed %d pages with more remaining %v, want 2 and true", src.listCalls, s.moreRemain)
+	}
+}
+
+func TestListS3StopsMidPage(t *testing.T) {
+	src := newFakeS3()
+	src.pageSize = 3
+	keys := putKeys(src, 6)
+	s := newTestSyncer(t, Config{}, src, newFakeGS())
+
+	tasks := make(chan task)
+	listedKeys := make(chan string, len(keys))
+	go func() {
+		first := <-tasks
+		listedKeys <- first.key
+		// Nothing more is taken, so the lister is stuck on the second key
+		// until it's stopped
+		s.stopListing()
+	}()
+	n, err := s.listS3(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || <-listedKeys != keys[0] {
+		t.Errorf("listed %d objects, want just %s", n, keys[0])
+	}
+	if src.listCalls != 1 {
+		t.Errorf("listed %d pages after stopping, want 1", src.listCalls)
+	}
+}
+
+func TestSyncManyPages(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.pageSize = 10
+	keys := putKeys(src, 25)
+
+	result := mustSync(t, Config{Concurrency: 4}, src, dst)
+	if result.Listed != 25 || result.Transferred != 25 {
+		t.Errorf("listed %d and transferred %d, want 25 and 25", result.Listed, result.Transferred)
+	}
+	if got := dst.names(); len(got) != len(keys) {
+		t.Errorf("GS has %d objects, want %d", len(got), len(keys))
+	}
+}
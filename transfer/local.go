@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// errStopWalk ends the walk of Config.LocalDir early.
+var errStopWalk = errors.New("stop walking")
+
+// listLocal is listS3 for Config.UploadOnly: it walks Config.LocalDir,
+// sending each regular file to tasks as if S3 had listed it under its
+// path relative to the directory. Symlinks aren't followed.
+func (s *syncer) listLocal(tasks chan<- task) (int, error) {
+	numObjects := 0
+	err := filepath.Walk(s.cfg.LocalDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.cfg.LocalDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !s.included(key) {
+			s.leaveOut(&s.numFiltered, reasonFiltered, key, info.Size())
+			return nil
+		}
+		if !s.sizeInRange(info.Size()) {
+			s.leaveOut(&s.numOutOfRange, reasonOutOfRange, key, info.Size())
+			return nil
+		}
+		if !s.modifiedInRange(info.ModTime()) {
+			s.leaveOut(&s.numTooOld, reasonTooOld, key, info.Size())
+			return nil
+		}
+		if s.listLimitReached(numObjects) {
+			s.moreRemain = true
+			return errStopWalk
+		}
+		compare := func(ctx context.Context) (func(worker int) error, error) {
+			object, err := s.localObject(key, info)
+			if err != nil {
+				return nil, err
+			}
+			return s.syncObject(ctx, object, "")
+		}
+		select {
+		case tasks <- task{key, info.Size(), compare}:
+			numObjects++
+		case <-s.stop:
+			return errStopWalk
+		}
+		return nil
+	})
+	if err == errStopWalk {
+		err = nil
+	}
+	return numObjects, err
+}
+
+// localFile is where the file for key is with Config.UploadOnly.
+func (s *syncer) localFile(key string) string {
+	return filepath.Join(s.cfg.LocalDir, filepath.FromSlash(key))
+}
+
+// localObject describes the file for key as S3 would list it, its MD5
+// standing in for the ETag, so syncObject compares it with GS the same
+// way. With Config.CompareMode size it isn't read to hash it.
+func (s *syncer) localObject(key string, info os.FileInfo) (*s3.Object, error) {
+	object := &s3.Object{
+		Key:          aws.String(key),
+		Size:         aws.Int64(info.Size()),
+		ETag:         aws.String(""),
+		LastModified: aws.Time(info.ModTime()),
+	}
+	if s.cfg.CompareMode == "size" {
+		return object, nil
+	}
+	file, err := os.Open(s.localFile(key))
+	if err != nil {
+		return nil, fmt.Errorf("opening local file: %w", err)
+	}
+	defer file.Close()
+	hasher := newContentHash()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("hashing local file: %w", err)
+	}
+	object.Size = aws.Int64(hasher.size)
+	object.ETag = aws.String(fmt.Sprintf(`"%x"`, hasher.md5.Sum(nil)))
+	return object, nil
+}
+
+// uploadLocalFile is transferObject's upload of key to targets with
+// Config.UploadOnly, from its file rather than S3, hashing it into
+// hasher on the way.
+func (s *syncer) uploadLocalFile(ctx context.Context, key *s3.Object, targets []*target, hasher *contentHash) (compressed *contentHash, err error) {
+	path := s.localFile(*key.Key)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening local file: %w", err)
+	}
+	defer file.Close()
+
+	md5 := strings.Trim(*key.ETag, `"`)
+	src := sourceAttrs{
+		size:         *key.Size,
+		etag:         md5,
+		md5:          md5,
+		lastModified: aws.TimeValue(key.LastModified),
+	}
+	s.log.Debug(Event{Action: "upload", Key: *key.Key}, "Uploading", path, "to GS at", *key.Key)
+	ctx, upload := s.startSpan(ctx, "upload")
+	compressed, err = s.writeToGS(ctx, *key.Key, targets, io.TeeReader(s.throttle(file), hasher), src,
+		func() error { return hasher.matchesSource(src) })
+	endSpan(upload, err)
+	return compressed, err
+}
@@ -0,0 +1,232 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// Level is how much a Logger shows, each level including the ones before
+// it.
+type Level int
+
+// Log levels
+const (
+	LevelError Level = iota // errors, warnings and the summary
+	LevelInfo               // what happened to each object
+	LevelDebug              // each step of a transfer, checksums and sizes
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return Level(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Event describes something that happened during the run, such as an
+// object being skipped or uploaded. Only JSON logs show the fields; people
+// get the message.
+type Event struct {
+	Action   string
+	Key      string
+	Bytes    int64
+	Duration time.Duration
+	Attempt  int // of a retried object, from 1
+	Err      error
+}
+
+// jsonRecord is an event as written in JSON.
+type jsonRecord struct {
+	Time     string            `json:"time"`
+	Level    string            `json:"level"`
+	Action   string            `json:"action"`
+	Key      string            `json:"key,omitempty"`
+	Bytes    int64             `json:"bytes,omitempty"`
+	Duration float64           `json:"durationSeconds,omitempty"`
+	Attempt  int               `json:"attempt,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Msg      string            `json:"msg,omitempty"`
+	Totals   map[string]uint64 `json:"totals,omitempty"`
+}
+
+// Logger receives the events of a run. Each call gets the event's fields
+// and a message for people in v, as for fmt.Println. Implementations must
+// be safe for concurrent use, and decide for themselves which levels to
+// show.
+type Logger interface {
+	// Info is what happened to each object.
+	Info(e Event, v ...interface{})
+	// Debug is each step of a transfer.
+	Debug(e Event, v ...interface{})
+	// Error is errors, warnings and other notes about the run.
+	Error(e Event, v ...interface{})
+}
+
+// StdLogger is the default Logger, built on the standard library. It
+// reports events as lines for people, info and debug on stdout and errors
+// on stderr, or as one JSON object per event on stderr.
+type StdLogger struct {
+	level Level
+	json  bool
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewLogger returns a StdLogger showing events up to level, in format
+// text or json.
+func NewLogger(level Level, format string) (*StdLogger, error) {
+	switch format {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &StdLogger{level: level, json: format == "json", enc: json.NewEncoder(os.Stderr)}, nil
+}
+
+func (l *StdLogger) writeJSON(record jsonRecord) {
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	l.mu.Lock()
+	l.enc.Encode(record)
+	l.mu.Unlock()
+}
+
+func (l *StdLogger) logJSON(level Level, e Event, v []interface{}) {
+	record := jsonRecord{
+		Level:    level.String(),
+		Action:   e.Action,
+		Key:      e.Key,
+		Bytes:    e.Bytes,
+		Duration: e.Duration.Seconds(),
+		Attempt:  e.Attempt,
+		Msg:      strings.TrimSuffix(fmt.Sprintln(v...), "\n"),
+	}
+	if e.Err != nil {
+		record.Error = e.Err.Error()
+	}
+	l.writeJSON(record)
+}
+
+// Info reports e at info level, printing v to stdout as fmt.Println
+// would.
+func (l *StdLogger) Info(e Event, v ...interface{}) {
+	l.printAt(LevelInfo, e, v)
+}
+
+// Debug is Info at debug level.
+func (l *StdLogger) Debug(e Event, v ...interface{}) {
+	l.printAt(LevelDebug, e, v)
+}
+
+func (l *StdLogger) printAt(level Level, e Event, v []interface{}) {
+	if l.level < level {
+		return
+	}
+	if l.json {
+		l.logJSON(level, e, v)
+		return
+	}
+	fmt.Println(v...)
+}
+
+// Error reports e, logging v and any error to stderr as log.Println
+// would. It's shown at every level.
+func (l *StdLogger) Error(e Event, v ...interface{}) {
+	if l.json {
+		l.logJSON(LevelError, e, v)
+		return
+	}
+	if e.Err != nil {
+		v = append(v, e.Err)
+	}
+	log.Println(v...)
+}
+
+// Total is one line of the end of run summary.
+type Total struct {
+	Name     string
+	Value    uint64
+	Bytes    bool // format Value as a byte size for people
+	Duration bool // Value is a time.Duration
+}
+
+// JSONName is how t is named in JSON, e.g. objectsListed.
+func (t Total) JSONName() string {
+	return camelCase(t.Name)
+}
+
+// Summary prints the totals, one per line, or as a single summary record
+// in JSON.
+func (l *StdLogger) Summary(totals []Total) {
+	if l.json {
+		record := jsonRecord{Level: LevelError.String(), Action: "summary", Totals: make(map[string]uint64)}
+		for _, t := range totals {
+			if t.Duration {
+				record.Duration = time.Duration(t.Value).Seconds()
+				continue
+			}
+			record.Totals[t.JSONName()] = t.Value
+		}
+		l.writeJSON(record)
+		return
+	}
+	for _, t := range totals {
+		if t.Bytes {
+			fmt.Println(t.Name, bytefmt.ByteSize(t.Value))
+		} else if t.Duration {
+			fmt.Println(t.Name, time.Duration(t.Value))
+		} else {
+			fmt.Println(t.Name, t.Value)
+		}
+	}
+}
+
+// Progress writes p as a progress record. It does nothing for text,
+// where showing progress is up to the caller.
+func (l *StdLogger) Progress(p Progress) {
+	if !l.json {
+		return
+	}
+	record := jsonRecord{Level: LevelInfo.String(), Action: "progress", Duration: p.Elapsed.Seconds(), Totals: map[string]uint64{
+		"objectsListed":  uint64(p.Listed),
+		"objectsDone":    uint64(p.Done),
+		"bytesDone":      p.Bytes,
+		"bytesPerSecond": p.BytesPerSecond,
+	}}
+	if p.ListingDone {
+		record.Totals["objectsTotal"] = uint64(p.Listed)
+	}
+	if eta, ok := p.ETA(); ok {
+		record.Totals["etaSeconds"] = uint64(eta.Seconds())
+	}
+	l.writeJSON(record)
+}
+
+// camelCase turns "Objects listed" into "objectsListed".
+func camelCase(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		if i == 0 {
+			words[i] = strings.ToLower(word)
+		} else {
+			words[i] = strings.ToUpper(word[:1]) + strings.ToLower(word[1:])
+		}
+	}
+	return strings.Join(words, "")
+}
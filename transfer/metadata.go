@@ -0,0 +1,196 @@
+package transfer
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// sourceAttrs are the attributes of a source object carried over to its
+// copy. Fields are empty when the source doesn't set them.
+type sourceAttrs struct {
+	contentType        string
+	contentEncoding    string
+	cacheControl       string
+	contentLanguage    string
+	contentDisposition string
+	metadata           map[string]string
+	tags               map[string]string // with Config.CopyTags
+	acl                string            // GS predefined ACL, with Config.CopyACL
+	size               int64
+	etag               string // without quotes
+	lastModified       time.Time
+	md5                string // hex, from the ETag when it is the content MD5
+}
+
+func sourceAttrsFromHead(head *s3.HeadObjectOutput) sourceAttrs {
+	return sourceAttrs{
+		contentType:        aws.StringValue(head.ContentType),
+		contentEncoding:    aws.StringValue(head.ContentEncoding),
+		cacheControl:       aws.StringValue(head.CacheControl),
+		contentLanguage:    aws.StringValue(head.ContentLanguage),
+		contentDisposition: aws.StringValue(head.ContentDisposition),
+		metadata:           aws.StringValueMap(head.Metadata),
+		size:               aws.Int64Value(head.ContentLength),
+		etag:               strings.Trim(aws.StringValue(head.ETag), "\""),
+		lastModified:       aws.TimeValue(head.LastModified),
+		md5:                etagMD5(head.ETag, head.ServerSideEncryption, head.SSECustomerAlgorithm),
+	}
+}
+
+// etagMD5 returns the MD5 in an S3 ETag, or "" if it isn't one: the ETag
+// of a multipart upload, or of an object encrypted with SSE-KMS or SSE-C,
+// is something else.
+func etagMD5(etag, sse, sseCustomerAlgorithm *string) string {
+	md5 := strings.Trim(aws.StringValue(etag), "\"")
+	if isMultipartETag(md5) || aws.StringValue(sse) == s3.ServerSideEncryptionAwsKms || sseCustomerAlgorithm != nil {
+		return ""
+	}
+	return md5
+}
+
+// defaultMimeTypes are the content types of common web assets by
+// extension, which http.DetectContentType gets wrong or passes off as
+// text. Config.MimeTypes is applied over them.
+var defaultMimeTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".txt":         "text/plain; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".xml":         "application/xml",
+	".wasm":        "application/wasm",
+	".pdf":         "application/pdf",
+	".svg":         "image/svg+xml",
+	".ico":         "image/vnd.microsoft.icon",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+}
+
+// mimeType is the content type of key by its extension, from
+// Config.MimeTypes or else defaultMimeTypes, or "" for an extension in
+// neither.
+func (s *syncer) mimeType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if contentType, ok := s.cfg.MimeTypes[ext]; ok {
+		return contentType
+	}
+	return defaultMimeTypes[ext]
+}
+
+// gsReservedMetadata are names GS keeps for its own object metadata.
+// Custom metadata under these names is renamed to avoid confusing the two.
+var gsReservedMetadata = map[string]bool{
+	"cache-control":       true,
+	"content-disposition": true,
+	"content-encoding":    true,
+	"content-language":    true,
+	"content-type":        true,
+	"custom-time":         true,
+}
+
+// s3TagPrefix prefixes the metadata names S3 object tags are copied to.
+const s3TagPrefix = "s3-tag-"
+
+// sourceLastModifiedKey is the GS metadata recording when the S3 object
+// copied was last modified, in RFC3339, as GS only knows when it was
+// uploaded.
+const sourceLastModifiedKey = "x-source-last-modified"
+
+// destModified is when the source of gsAttrs was last modified, as
+// recorded under sourceLastModifiedKey, or failing that when it was
+// uploaded.
+func destModified(gsAttrs *storage.ObjectAttrs) time.Time {
+	if modified, err := time.Parse(time.RFC3339, gsAttrs.Metadata[sourceLastModifiedKey]); err == nil {
+		return modified
+	}
+	return gsAttrs.Updated
+}
+
+// gsMetadata returns the custom metadata for the GS copy of key: the S3
+// user metadata, lowercased as S3 stores it, then its tags under
+// s3TagPrefix, with Config.Metadata applied over the top.
+func (s *syncer) gsMetadata(key string, s3Metadata, tags map[string]string) map[string]string {
+	metadata := make(map[string]string, len(s3Metadata)+len(tags)+len(s.cfg.Metadata))
+	for k, v := range s3Metadata {
+		k = strings.ToLower(k)
+		if gsReservedMetadata[k] || strings.HasPrefix(k, "x-goog-") {
+			s.log.Error(Event{Action: "warning", Key: key}, "Renaming reserved metadata", k, "to s3-"+k, "for", key)
+			k = "s3-" + k
+		}
+		metadata[k] = v
+	}
+	for k, v := range tags {
+		metadata[s3TagPrefix+k] = v
+	}
+	for k, v := range s.cfg.Metadata {
+		metadata[k] = v
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// s3Metadata is gsMetadata for the S3 copy of a GS object.
+func (s *syncer) s3Metadata(gsMetadata map[string]string) map[string]*string {
+	metadata := make(map[string]string, len(gsMetadata)+len(s.cfg.Metadata))
+	for k, v := range gsMetadata {
+		metadata[k] = v
+	}
+	for k, v := range s.cfg.Metadata {
+		metadata[k] = v
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return aws.StringMap(metadata)
+}
+
+// s3Tags returns the tags of key, or of version of it if not empty, in
+// S3, or nil if it has none.
+func (s *syncer) s3Tags(ctx context.Context, key, version string) (map[string]string, error) {
+	out, err := s.s3Client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(version),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.TagSet) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// optionalString returns nil for an empty attribute so S3 doesn't get an
+// empty header for it.
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
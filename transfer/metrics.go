@@ -0,0 +1,28 @@
+package transfer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives a count of each object as the run goes, for
+// Config.Metrics. Implementations must be safe for concurrent use. Dry
+// runs transfer nothing, so only skips and failures are counted.
+type Metrics interface {
+	// Transferred counts an object of size bytes transferred in d.
+	Transferred(size int64, d time.Duration)
+	// Skipped counts an object not transferred for reason, such as
+	// "Hash matches".
+	Skipped(reason string)
+	// Failed counts an object that couldn't be synced.
+	Failed()
+}
+
+// countTransfer counts an object of size bytes transferred in d.
+func (s *syncer) countTransfer(size int64, d time.Duration) {
+	atomic.AddUint64(&s.numTransferred, 1)
+	atomic.AddUint64(&s.amtTransferred, uint64(size))
+	if s.cfg.Metrics != nil {
+		s.cfg.Metrics.Transferred(size, d)
+	}
+}
@@ -0,0 +1,167 @@
+package transfer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Prefix is one more prefix of Config.S3Bucket to sync, for
+// Config.ExtraPrefixes, with its own GSPrefix and StripPrefix.
+type Prefix struct {
+	S3    string
+	GS    string // put before each key to make its GS name
+	Strip bool   // take S3 off each key before adding GS
+}
+
+// String is p as S3=>GS, the GS prefix that replaces S3 in each key.
+// The same names come out whether or not p strips S3, so it says what p
+// does.
+func (p Prefix) String() string {
+	if p.Strip {
+		return p.S3 + "=>" + p.GS
+	}
+	return p.S3 + "=>" + p.GS + p.S3
+}
+
+// prefixList is prefixes as recorded in the state file, comma-separated.
+func prefixList(prefixes []Prefix) string {
+	list := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		list[i] = p.String()
+	}
+	return strings.Join(list, ",")
+}
+
+// usePrefix points the syncer at p, one of the prefixes of the run: from
+// then on the listing, the GS names and the destination listing follow
+// it. It's only called while no workers are running.
+func (s *syncer) usePrefix(p Prefix) {
+	s.cfg.S3Prefix, s.cfg.GSPrefix, s.cfg.StripPrefix = p.S3, p.GS, p.Strip
+	for _, d := range s.dests {
+		d.gs, d.index = d.base, nil
+		if p.GS != "" || p.Strip || s.cfg.keyRegex != nil {
+			d.gs = renamedObjects{d.base, p.S3, p.GS, p.Strip, s.cfg.keyRegex, s.cfg.KeyReplace}
+		}
+	}
+	s.gs = s.dests[0].gs
+}
+
+// syncPrefix syncs the objects under p and, with Config.Delete, deletes
+// the extras under it, returning how many objects were listed and how
+// many deleted. last is whether p is the run's last prefix, so the
+// listing is done once it is.
+func (s *syncer) syncPrefix(p Prefix, last bool) (numObjects, numDeleted int, err error) {
+	s.usePrefix(p)
+	if len(s.cfg.ExtraPrefixes) > 0 {
+		s.log.Info(Event{Action: "prefix"}, "Syncing", "s3://"+s.cfg.S3Bucket+"/"+p.S3)
+	}
+
+	if !s.cfg.DisableDestinationListing && (s.cfg.Direction == S3ToGS || s.cfg.Verify) &&
+		s.cfg.KeysFile == "" && s.cfg.SQSQueueURL == "" && s.cfg.keyRegex == nil && s.cfg.List == nil {
+		for _, d := range s.dests {
+			s.log.Debug(Event{Action: "index"}, "Listing", d.bucket, "to compare with S3")
+			d.index, err = s.indexGS(d.gs)
+			if err != nil {
+				return 0, 0, s.inBucket(d, fmt.Errorf("listing GS: %w", err))
+			}
+		}
+	}
+
+	// Comparison workers decide what each listed object needs, queueing
+	// those to transfer for the transfer workers, so the cheap lookups
+	// of objects already in sync aren't held up behind transfers
+	tasks := make(chan task)
+	transfers := make(chan queuedTransfer, transferQueueSize)
+	var comparing, transferring sync.WaitGroup
+	var numCompared, numQueued int64
+	inSyncBefore := atomic.LoadUint64(&s.numInSync)
+	for i := 0; i < s.cfg.CompareConcurrency; i++ {
+		comparing.Add(1)
+		go func() {
+			defer comparing.Done()
+			for t := range tasks {
+				atomic.AddInt64(&s.numStarted, 1)
+				ctx, span := s.startSpan(s.ctx, "object", attribute.String("key", t.key))
+				if t.size > 0 {
+					span.SetAttributes(attribute.Int64("size", t.size))
+				}
+				transfer, err := t.compare(ctx)
+				atomic.AddInt64(&numCompared, 1)
+				if err != nil || transfer == nil {
+					s.finishTask(ctx, t, span, err)
+					continue
+				}
+				atomic.AddInt64(&numQueued, 1)
+				transfers <- queuedTransfer{t, ctx, span, transfer}
+			}
+		}()
+	}
+	for i := 0; i < s.cfg.Concurrency; i++ {
+		transferring.Add(1)
+		go func(worker int) {
+			defer transferring.Done()
+			for q := range transfers {
+				if s.stopped() {
+					// Only the transfers under way are let finish; the
+					// queued ones are left for a later run
+					s.finishTask(q.ctx, q.task, q.span, nil)
+					continue
+				}
+				s.finishTask(q.ctx, q.task, q.span, q.transfer(worker))
+			}
+		}(i)
+	}
+
+	if s.cfg.UploadOnly {
+		numObjects, err = s.listLocal(tasks)
+	} else if s.cfg.KeysFile != "" {
+		numObjects, err = s.listKeysFile(tasks)
+	} else if s.cfg.InventoryManifest != "" {
+		numObjects, err = s.listInventory(tasks)
+	} else if s.cfg.SQSQueueURL != "" {
+		numObjects, err = s.listSQS(tasks)
+	} else if s.cfg.S3VersionID != "" {
+		numObjects, err = s.listVersion(tasks)
+	} else if s.cfg.AllVersions {
+		numObjects, err = s.listS3Versions(tasks)
+	} else if s.cfg.Direction == GSToS3 && !s.cfg.Verify {
+		numObjects, err = s.listGS(tasks)
+	} else if s.cfg.ListShards > 1 {
+		numObjects, err = s.listS3Shards(tasks)
+	} else {
+		numObjects, err = s.listS3(tasks)
+	}
+	if last || s.stopped() {
+		atomic.StoreInt32(&s.listingDone, 1)
+	}
+	close(tasks)
+	comparing.Wait()
+	if s.cfg.List == nil {
+		s.log.Info(Event{Action: "compared"}, "Compared", numCompared, "objects:",
+			atomic.LoadUint64(&s.numInSync)-inSyncBefore, "in sync,", numQueued, "to transfer")
+	}
+	close(transfers)
+	transferring.Wait()
+	if s.ctx.Err() != nil {
+		return numObjects, 0, s.ctx.Err()
+	}
+	if err != nil {
+		return numObjects, 0, fmt.Errorf("listing: %w", err)
+	}
+
+	// Only an uninterrupted listing has the whole key set to diff against
+	if s.cfg.DiffReport != "" && !s.stopped() {
+		s.diffExtras()
+	}
+	if s.cfg.Delete && !s.stopped() {
+		numDeleted, err = s.deleteExtras()
+		if err != nil {
+			return numObjects, 0, fmt.Errorf("deleting: %w", err)
+		}
+	}
+	return numObjects, numDeleted, nil
+}
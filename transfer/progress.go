@@ -0,0 +1,88 @@
+package transfer
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// defaultProgressInterval is how often Config.Progress is called unless
+// Config.ProgressInterval says otherwise.
+const defaultProgressInterval = time.Second
+
+// Progress is a snapshot of a run, passed to Config.Progress.
+type Progress struct {
+	Listed      int    // objects handed to the workers so far
+	ListingDone bool   // Listed is the final count
+	Done        int    // objects finished, whether transferred, skipped or failed
+	Bytes       uint64 // bytes sent to the destination, including objects still in flight
+	Elapsed     time.Duration
+
+	BytesPerSecond uint64 // since the last snapshot
+}
+
+// ETA estimates the time left at the average rate so far. ok is false
+// until the listing is done and an object has finished.
+func (p Progress) ETA() (eta time.Duration, ok bool) {
+	if !p.ListingDone || p.Done == 0 {
+		return 0, false
+	}
+	perObject := p.Elapsed / time.Duration(p.Done)
+	return perObject * time.Duration(p.Listed-p.Done), true
+}
+
+// progress is the current snapshot, with the rate since last.
+func (s *syncer) progress(start time.Time, last Progress) Progress {
+	p := Progress{
+		Listed:      int(atomic.LoadInt64(&s.numStarted)),
+		ListingDone: atomic.LoadInt32(&s.listingDone) == 1,
+		Done:        int(atomic.LoadInt64(&s.numDone)),
+		Bytes:       atomic.LoadUint64(&s.bytesSent),
+		Elapsed:     time.Since(start),
+	}
+	if interval := p.Elapsed - last.Elapsed; interval > 0 {
+		p.BytesPerSecond = uint64(float64(p.Bytes-last.Bytes) / interval.Seconds())
+	}
+	return p
+}
+
+// startProgress calls Config.Progress every Config.ProgressInterval until
+// the returned stop is called, which makes a last call before returning.
+// All calls come from one goroutine, so Config.Progress needn't be safe
+// for concurrent use.
+func (s *syncer) startProgress(start time.Time) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.cfg.ProgressInterval)
+		defer ticker.Stop()
+		var last Progress
+		for {
+			select {
+			case <-ticker.C:
+				last = s.progress(start, last)
+				s.cfg.Progress(last)
+			case <-done:
+				s.cfg.Progress(s.progress(start, last))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// reportEntry is one line of Config.ReportFile: what happened to one
+// object.
+// Checksum is the source's S3 ETag or, for gs-to-s3, its GS MD5. Bucket
+// is the GS bucket, only with Config.ExtraGSBuckets.
+type reportEntry struct {
+	Key      string `json:"key"`
+	Bucket   string `json:"bucket,omitempty"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PlanEntry is what a dry run would do with one object, for Config.Plan.
+type PlanEntry struct {
+	Key    string
+	Action string // "transfer", "skip" or "filter"
+	Reason string // e.g. "new" or "size-differs" for a transfer
+	Size   int64
+}
+
+// planActions are the report actions kept for Config.Plan, by what the
+// plan calls them.
+var planActions = map[string]string{
+	"would-transfer": "transfer",
+	"skip":           "skip",
+	"filter":         "filter",
+}
+
+// reportFile writes a reportEntry per object as a line of JSON. Each line
+// goes straight to the file, so an aborted run leaves a report of
+// everything done up to then. With Config.Plan it also keeps the entries
+// of a dry run, with or without a file. A nil *reportFile reports nothing.
+type reportFile struct {
+	mu  sync.Mutex
+	f   *os.File // nil if only keeping a plan
+	enc *json.Encoder
+	log Logger
+
+	keepPlan bool
+	plan     []PlanEntry
+}
+
+// openReport creates the report file at path with mode, replacing any
+// old one.
+func openReport(path string, mode os.FileMode, log Logger) (*reportFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &reportFile{f: f, enc: json.NewEncoder(f), log: log}, nil
+}
+
+// add appends entry to the report. A failed write is logged rather than
+// failing the object it describes.
+func (r *reportFile) add(entry reportEntry) {
+	if r == nil {
+		return
+	}
+	entry.Checksum = strings.Trim(entry.Checksum, "\"")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if action, ok := planActions[entry.Action]; ok && r.keepPlan {
+		r.plan = append(r.plan, PlanEntry{entry.Key, action, entry.Reason, entry.Size})
+	}
+	if r.f == nil {
+		return
+	}
+	if err := r.enc.Encode(entry); err != nil {
+		r.log.Error(Event{Action: "warning", Key: entry.Key, Err: err}, "Couldn't write report for", entry.Key)
+	}
+}
+
+// planned returns the plan kept so far.
+func (r *reportFile) planned() []PlanEntry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.plan
+}
+
+func (r *reportFile) Close() error {
+	if r == nil || r.f == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.f.Sync(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,104 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// restorePollInterval is how often an object being restored is checked
+// on with Config.RestoreWait.
+const restorePollInterval = time.Minute
+
+// isArchived reports whether objects of storageClass have to be restored
+// before they can be read.
+func isArchived(storageClass string) bool {
+	return storageClass == s3.ObjectStorageClassGlacier || storageClass == s3.ObjectStorageClassDeepArchive
+}
+
+// restoreReason is why version of key, an archived object, can't be
+// transferred yet, or "" once a restored copy can be read. With
+// Config.RestoreDays it requests a restore if there isn't one, then waits
+// up to Config.RestoreWait for it.
+func (s *syncer) restoreReason(ctx context.Context, key, version string) (string, error) {
+	restored, ongoing, err := s.restoreStatus(ctx, key, version)
+	if err != nil || restored {
+		return "", err
+	}
+	switch {
+	case s.cfg.RestoreDays == 0:
+		return reasonArchived, nil
+	case s.cfg.DryRun:
+		return reasonRestoring, nil
+	case !ongoing:
+		if err := s.requestRestore(ctx, key, version); err != nil {
+			return "", fmt.Errorf("requesting restore: %w", err)
+		}
+		s.log.Info(Event{Action: "restore", Key: key}, "Requested restore of", key, "for", s.cfg.RestoreDays, "days")
+	}
+
+	deadline := time.Now().Add(s.cfg.RestoreWait)
+	for time.Now().Before(deadline) {
+		wait := restorePollInterval
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if restored, _, err = s.restoreStatus(ctx, key, version); err != nil || restored {
+			return "", err
+		}
+	}
+	return reasonRestoring, nil
+}
+
+// restoreStatus reports whether a restored copy of an archived object can
+// be read, and otherwise whether a restore is under way.
+func (s *syncer) restoreStatus(ctx context.Context, key, version string) (restored, ongoing bool, err error) {
+	head, err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(version),
+	})
+	if err != nil {
+		return false, false, fmt.Errorf("checking restore: %w", err)
+	}
+	// e.g. ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+	restore := aws.StringValue(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return true, false, nil
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// requestRestore asks S3 for a temporary copy of an archived object for
+// Config.RestoreDays, at Config.RestoreTier. A restore already under way
+// is fine.
+func (s *syncer) requestRestore(ctx context.Context, key, version string) error {
+	_, err := s.s3Client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(version),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(s.cfg.RestoreDays)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(s.cfg.RestoreTier)},
+		},
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,329 @@
+package transfer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Result is what a Transfer did.
+type Result struct {
+	Listed     int // objects handed to the workers
+	Filtered   int // objects left out by Config.Includes and Config.Excludes
+	OutOfRange int // objects left out by Config.MinSize and Config.MaxSize
+	TooOld     int // objects left out by Config.ModifiedAfter
+	Folders    int // folder placeholders left out by Config.SkipFolders
+
+	InSync           uint64 // objects the comparison found in every destination already
+	Transferred      uint64 // objects transferred, or that would be with Config.DryRun
+	BytesTransferred uint64
+	Skipped          SkipCounts
+	Failed           uint64
+	Failures         []Failure   // the first maxFailures of Failed, in the order they happened
+	Deleted          int         // with Config.Delete
+	Plan             []PlanEntry // with Config.Plan, in the order decided
+
+	SourceDeleted      uint64 // with Config.DeleteSource
+	SourceDeleteFailed uint64 // transferred, but couldn't be deleted from S3
+	SourceWouldDelete  uint64 // with Config.DeleteSource and Config.DryRun
+	Verified           VerifyCounts
+	Diff               DiffCounts // with Config.DiffReport
+
+	MoreRemain bool // stopped at Config.MaxObjects with objects left to sync
+	Stopped    bool // stopped listing early, by Config.Stop or Config.FailFast
+
+	Elapsed time.Duration
+
+	verify, repair, delete, deleteSource, diff, verifyContent, dryRun bool
+}
+
+// Failure is an object that couldn't be synced.
+type Failure struct {
+	Key string
+	Err error // after any retries
+}
+
+// maxFailures caps Result.Failures, so a run that fails everything
+// doesn't keep every error.
+const maxFailures = 1000
+
+// addFailure records that key failed with err.
+func (s *syncer) addFailure(key string, err error) {
+	atomic.AddUint64(&s.numFailed, 1)
+	if s.cfg.Metrics != nil {
+		s.cfg.Metrics.Failed()
+	}
+	s.failuresMu.Lock()
+	if len(s.failures) < maxFailures {
+		s.failures = append(s.failures, Failure{key, err})
+	}
+	s.failuresMu.Unlock()
+}
+
+// Discrepancies reports whether Config.Verify found any object missing or
+// different, and not put right by Config.Repair, or Config.DiffReport
+// any object not identical on both sides.
+func (r Result) Discrepancies() bool {
+	return r.Verified.Mismatched > r.Verified.Repaired || r.Verified.Missing > 0 || r.Diff.differing() > 0
+}
+
+// SkipCounts tallies the objects that weren't transferred, by why. Fields
+// are accessed atomically during a run.
+type SkipCounts struct {
+	PreviousRun uint64 // recorded in Config.StateFile
+	InSync      uint64
+	Hash        uint64
+	ContentHash uint64
+	StoredHash  uint64 // Config.StoreSourceMD5 metadata
+	Size        uint64
+	OutOfRange  uint64 // Config.MinSize and Config.MaxSize with Config.KeysFile
+	TooOld      uint64 // Config.ModifiedAfter with Config.KeysFile
+	Exists      uint64 // Config.Conflict skip
+	NotNewer    uint64 // Config.Conflict newer
+	Changed     uint64 // changed in GS by someone else during the transfer
+	Archived    uint64 // in Glacier and not restored, without Config.RestoreDays
+	Restoring   uint64 // being restored for a later run
+	Limit       uint64 // Config.MaxObjectsCount transferred
+}
+
+// countSkip counts an object skipped for reason, as passed to skipMessage.
+func (s *syncer) countSkip(reason string) {
+	counter := &s.skipped.InSync
+	switch reason {
+	case reasonPreviousRun:
+		counter = &s.skipped.PreviousRun
+	case "Hash matches":
+		counter = &s.skipped.Hash
+	case "Content hash matches":
+		counter = &s.skipped.ContentHash
+	case reasonStoredHash:
+		counter = &s.skipped.StoredHash
+	case "Size matches":
+		counter = &s.skipped.Size
+	case reasonOutOfRange:
+		counter = &s.skipped.OutOfRange
+	case reasonTooOld:
+		counter = &s.skipped.TooOld
+	case reasonExists:
+		counter = &s.skipped.Exists
+	case reasonNotNewer:
+		counter = &s.skipped.NotNewer
+	case reasonChanged:
+		counter = &s.skipped.Changed
+	case reasonArchived:
+		counter = &s.skipped.Archived
+	case reasonRestoring:
+		counter = &s.skipped.Restoring
+	case reasonLimit:
+		counter = &s.skipped.Limit
+	}
+	atomic.AddUint64(counter, 1)
+	if s.cfg.Metrics != nil {
+		s.cfg.Metrics.Skipped(reason)
+	}
+}
+
+// Skip reasons besides those from skipReason.
+const (
+	reasonPreviousRun = "Synced by a previous run"
+	reasonOutOfRange  = "Outside the size range"
+	reasonTooOld      = "Not modified since the cutoff"
+	reasonExists      = "Already exists"
+	reasonNotNewer    = "Not newer than the destination"
+	reasonChanged     = "Changed in the destination during the transfer"
+	reasonLimit       = "Reached the object limit"
+	reasonStoredHash  = "Stored source hash matches"
+	reasonArchived    = "Archived and not restored"
+	reasonRestoring   = "Being restored from the archive"
+)
+
+// Reasons objects are left out of the listing, for Config.ReportFile and
+// Config.Plan.
+const (
+	reasonFiltered = "Excluded by the include and exclude patterns"
+	reasonFolder   = "Folder placeholder"
+)
+
+// Reasons objects are transferred, for Config.ReportFile and Config.Plan.
+const (
+	reasonNew               = "new"
+	reasonOverwrite         = "overwrite"
+	reasonNewer             = "newer"
+	reasonSizeDiffers       = "size-differs"
+	reasonMultipartFallback = "multipart-fallback"
+	reasonChecksumDiffers   = "checksum-differs"
+)
+
+// transferReason says why an object is transferred once conflictReason
+// has found no reason to skip it. existing is the destination copy, and
+// etag and size describe the S3 side.
+func (s *syncer) transferReason(existing bool, etag string, s3Size, gsSize int64) string {
+	switch {
+	case !existing:
+		return reasonNew
+	case s.cfg.Conflict == "overwrite":
+		return reasonOverwrite
+	case s.cfg.Conflict == "newer":
+		return reasonNewer
+	case s3Size != gsSize:
+		return reasonSizeDiffers
+	case isMultipartETag(etag):
+		return reasonMultipartFallback
+	}
+	return reasonChecksumDiffers
+}
+
+// result collects the counts of a finished run.
+func (s *syncer) result(numObjects int) Result {
+	return Result{
+		Listed:           numObjects,
+		Filtered:         s.numFiltered,
+		OutOfRange:       s.numOutOfRange,
+		TooOld:           s.numTooOld,
+		Folders:          s.numFolders,
+		InSync:           atomic.LoadUint64(&s.numInSync),
+		Transferred:      atomic.LoadUint64(&s.numTransferred),
+		BytesTransferred: atomic.LoadUint64(&s.amtTransferred),
+		Skipped: SkipCounts{
+			PreviousRun: atomic.LoadUint64(&s.skipped.PreviousRun),
+			InSync:      atomic.LoadUint64(&s.skipped.InSync),
+			Hash:        atomic.LoadUint64(&s.skipped.Hash),
+			ContentHash: atomic.LoadUint64(&s.skipped.ContentHash),
+			StoredHash:  atomic.LoadUint64(&s.skipped.StoredHash),
+			Size:        atomic.LoadUint64(&s.skipped.Size),
+			OutOfRange:  atomic.LoadUint64(&s.skipped.OutOfRange),
+			TooOld:      atomic.LoadUint64(&s.skipped.TooOld),
+			Exists:      atomic.LoadUint64(&s.skipped.Exists),
+			NotNewer:    atomic.LoadUint64(&s.skipped.NotNewer),
+			Changed:     atomic.LoadUint64(&s.skipped.Changed),
+			Archived:    atomic.LoadUint64(&s.skipped.Archived),
+			Restoring:   atomic.LoadUint64(&s.skipped.Restoring),
+			Limit:       atomic.LoadUint64(&s.skipped.Limit),
+		},
+		Failed:   atomic.LoadUint64(&s.numFailed),
+		Failures: s.failures,
+		Verified: VerifyCounts{
+			Matched:    atomic.LoadUint64(&s.verified.Matched),
+			Mismatched: atomic.LoadUint64(&s.verified.Mismatched),
+			Missing:    atomic.LoadUint64(&s.verified.Missing),
+			Unverified: atomic.LoadUint64(&s.verified.Unverified),
+			Repaired:   atomic.LoadUint64(&s.verified.Repaired),
+
+			ContentChecked:    atomic.LoadUint64(&s.verified.ContentChecked),
+			ContentMismatched: atomic.LoadUint64(&s.verified.ContentMismatched),
+		},
+		Diff: DiffCounts{
+			Identical:        atomic.LoadUint64(&s.diffed.Identical),
+			OnlyInS3:         atomic.LoadUint64(&s.diffed.OnlyInS3),
+			OnlyInGS:         atomic.LoadUint64(&s.diffed.OnlyInGS),
+			SizeMismatch:     atomic.LoadUint64(&s.diffed.SizeMismatch),
+			ChecksumMismatch: atomic.LoadUint64(&s.diffed.ChecksumMismatch),
+			Unverified:       atomic.LoadUint64(&s.diffed.Unverified),
+		},
+		SourceDeleted:      atomic.LoadUint64(&s.numSourceDeleted),
+		SourceDeleteFailed: atomic.LoadUint64(&s.numSourceDeleteFailed),
+		SourceWouldDelete:  atomic.LoadUint64(&s.numSourceWouldDelete),
+		Plan:               s.report.planned(),
+		MoreRemain:         s.moreRemain,
+		verify:             s.cfg.Verify,
+		repair:             s.cfg.Repair,
+		delete:             s.cfg.Delete,
+		deleteSource:       s.cfg.DeleteSource,
+		diff:               s.cfg.DiffReport != "",
+		verifyContent:      s.cfg.VerifyContent,
+		dryRun:             s.cfg.DryRun,
+	}
+}
+
+// Totals returns r as the lines of an end of run summary, leaving out
+// counts that don't apply or never came up.
+func (r Result) Totals() []Total {
+	totals := []Total{{Name: "Objects listed", Value: uint64(r.Listed)}}
+	if r.Filtered > 0 {
+		totals = append(totals, Total{Name: "Objects filtered", Value: uint64(r.Filtered)})
+	}
+	if r.OutOfRange > 0 {
+		totals = append(totals, Total{Name: "Objects skipped by size", Value: uint64(r.OutOfRange)})
+	}
+	if r.TooOld > 0 {
+		totals = append(totals, Total{Name: "Objects skipped by age", Value: uint64(r.TooOld)})
+	}
+	if r.Folders > 0 {
+		totals = append(totals, Total{Name: "Folder placeholders skipped", Value: uint64(r.Folders)})
+	}
+	if r.diff {
+		totals = append(totals,
+			Total{Name: "Objects identical", Value: r.Diff.Identical},
+			Total{Name: "Objects only in S3", Value: r.Diff.OnlyInS3},
+			Total{Name: "Objects only in GS", Value: r.Diff.OnlyInGS},
+			Total{Name: "Objects differing in size", Value: r.Diff.SizeMismatch},
+			Total{Name: "Objects differing in checksum", Value: r.Diff.ChecksumMismatch},
+		)
+		if r.Diff.Unverified > 0 {
+			totals = append(totals, Total{Name: "Objects with matching size but no usable hash", Value: r.Diff.Unverified})
+		}
+	} else if r.verify {
+		totals = append(totals,
+			Total{Name: "Objects matching", Value: r.Verified.Matched},
+			Total{Name: "Objects differing", Value: r.Verified.Mismatched},
+			Total{Name: "Objects missing from GS", Value: r.Verified.Missing},
+		)
+		if r.Verified.Unverified > 0 {
+			totals = append(totals, Total{Name: "Objects with matching size but no usable hash", Value: r.Verified.Unverified})
+		}
+		if r.verifyContent {
+			totals = append(totals,
+				Total{Name: "Sampled objects content checked", Value: r.Verified.ContentChecked},
+				Total{Name: "Sampled objects passing the content check", Value: r.Verified.ContentChecked - r.Verified.ContentMismatched},
+				Total{Name: "Sampled objects failing the content check", Value: r.Verified.ContentMismatched},
+			)
+		}
+		if r.repair {
+			totals = append(totals,
+				Total{Name: "Objects repaired", Value: r.Verified.Repaired},
+				Total{Name: "Amount repaired", Value: r.BytesTransferred, Bytes: true},
+			)
+		}
+	} else {
+		totals = append(totals,
+			Total{Name: "Objects found in sync", Value: r.InSync},
+			Total{Name: "Objects transferred", Value: r.Transferred},
+			Total{Name: "Amount transferred", Value: r.BytesTransferred, Bytes: true},
+		)
+		for _, t := range []Total{
+			{Name: "Skipped as already in sync", Value: r.Skipped.InSync},
+			{Name: "Skipped as synced by a previous run", Value: r.Skipped.PreviousRun},
+			{Name: "Skipped on hash match", Value: r.Skipped.Hash},
+			{Name: "Skipped on content hash match", Value: r.Skipped.ContentHash},
+			{Name: "Skipped on stored source hash match", Value: r.Skipped.StoredHash},
+			{Name: "Skipped on size match", Value: r.Skipped.Size},
+			{Name: "Skipped outside size range", Value: r.Skipped.OutOfRange},
+			{Name: "Skipped as not modified since the cutoff", Value: r.Skipped.TooOld},
+			{Name: "Skipped as already existing", Value: r.Skipped.Exists},
+			{Name: "Skipped as not newer than the destination", Value: r.Skipped.NotNewer},
+			{Name: "Skipped as changed in GS during the transfer", Value: r.Skipped.Changed},
+			{Name: "Skipped as archived and not restored", Value: r.Skipped.Archived},
+			{Name: "Skipped while being restored", Value: r.Skipped.Restoring},
+			{Name: "Skipped at object limit", Value: r.Skipped.Limit},
+		} {
+			if t.Value > 0 {
+				totals = append(totals, t)
+			}
+		}
+	}
+	if r.Failed > 0 {
+		totals = append(totals, Total{Name: "Objects failed", Value: r.Failed})
+	}
+	if r.delete {
+		totals = append(totals, Total{Name: "Objects deleted", Value: uint64(r.Deleted)})
+	}
+	switch {
+	case r.deleteSource && r.dryRun:
+		totals = append(totals, Total{Name: "Sources that would be deleted", Value: r.SourceWouldDelete})
+	case r.deleteSource:
+		totals = append(totals, Total{Name: "Sources deleted", Value: r.SourceDeleted})
+		if r.SourceDeleteFailed > 0 {
+			totals = append(totals, Total{Name: "Sources failed to delete", Value: r.SourceDeleteFailed})
+		}
+	}
+	return append(totals, Total{Name: "Elapsed", Value: uint64(r.Elapsed), Duration: true})
+}
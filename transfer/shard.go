@@ -0,0 +1,84 @@
+package transfer
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listS3Shards is listS3 split by the next path segment under
+// Config.S3Prefix, for Config.ListShards. The objects directly under the
+// prefix are listed first, then the prefixes beneath it each as a shard,
+// Config.ListShards at a time, all feeding tasks.
+func (s *syncer) listS3Shards(tasks chan<- task) (int, error) {
+	var numObjects int
+	prefixes, done, err := s.listS3TopLevel(tasks, &numObjects)
+	if err != nil || done {
+		return numObjects, err
+	}
+	s.log.Debug(Event{Action: "shard"}, "Listing", len(prefixes), "prefixes under", s.cfg.S3Prefix, s.cfg.ListShards, "at a time")
+
+	shards := make(chan string)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var shardErr error
+	for i := 0; i < s.cfg.ListShards; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefix := range shards {
+				if err := s.listS3Prefix(tasks, prefix, "", &numObjects); err != nil {
+					// The rest of the listing is abandoned, as it is
+					// without shards
+					errOnce.Do(func() { shardErr = err })
+					s.stopListing()
+				}
+			}
+		}()
+	}
+send:
+	for _, prefix := range prefixes {
+		select {
+		case shards <- prefix:
+		case <-s.stop:
+			break send
+		}
+	}
+	close(shards)
+	wg.Wait()
+	return numObjects, shardErr
+}
+
+// listS3TopLevel lists Config.S3Prefix with a "/" delimiter, sending the
+// objects directly under it to tasks and returning the prefixes below it.
+// done is set when the listing should stop there.
+func (s *syncer) listS3TopLevel(tasks chan<- task, numObjects *int) (prefixes []string, done bool, err error) {
+	s3ListInput := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Prefix:    aws.String(s.cfg.S3Prefix),
+		Delimiter: aws.String("/"),
+	}
+	for {
+		select {
+		case <-s.stop:
+			return nil, true, nil
+		default:
+		}
+
+		s3List, err := s.s3Client.ListObjectsV2WithContext(s.ctx, s3ListInput)
+		if err != nil {
+			return nil, true, err
+		}
+		for _, p := range s3List.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(p.Prefix))
+		}
+		if s.listS3Page(tasks, s3List.Contents, numObjects) {
+			return nil, true, nil
+		}
+		if !aws.BoolValue(s3List.IsTruncated) {
+			return prefixes, false, nil
+		}
+		s3ListInput.ContinuationToken = s3List.NextContinuationToken
+	}
+}
@@ -0,0 +1,213 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/net/context"
+)
+
+// sqsWaitSeconds is how long each receive waits for a message, the most
+// SQS allows.
+const sqsWaitSeconds = 20
+
+// errNotS3Event is a message that is JSON but not an S3 event.
+var errNotS3Event = errors.New("no S3 event records")
+
+// s3Event is an S3 event notification, as delivered to SQS directly or
+// wrapped in an SNS notification.
+type s3Event struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		EventName   string `json:"eventName"`
+		S3          struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+
+	// Set on the test event S3 sends when notifications are set up
+	Event string
+
+	// Set when the event comes through SNS
+	Type    string
+	Message string
+}
+
+// sqsRegion returns the region in an SQS queue URL such as
+// https://sqs.us-east-1.amazonaws.com/123456789012/queue, or fallback if
+// it has none.
+func sqsRegion(queueURL, fallback string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return fallback
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) < 3 || parts[0] != "sqs" {
+		return fallback
+	}
+	return parts[1]
+}
+
+// listSQS is listKeysFile for the objects created in Config.S3Bucket, as
+// announced by S3 event notifications on Config.SQSQueueURL. It long-polls
+// the queue until stopListing is called. A message is deleted once each
+// object it names has synced; otherwise it becomes visible again for a
+// later attempt. Messages that aren't S3 events are logged and deleted.
+func (s *syncer) listSQS(tasks chan<- task) (int, error) {
+	// Cut a receive short when the listing is stopped
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	numObjects := 0
+	for {
+		out, err := s.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.cfg.SQSQueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(sqsWaitSeconds),
+		})
+		select {
+		case <-s.stop:
+			return numObjects, nil
+		default:
+		}
+		if err != nil {
+			return numObjects, err
+		}
+
+		for _, msg := range out.Messages {
+			keys, err := s.eventKeys(aws.StringValue(msg.Body))
+			if err != nil {
+				s.log.Error(Event{Action: "warning", Err: err}, "Dropping SQS message", aws.StringValue(msg.MessageId), "that isn't an S3 event:")
+				s.deleteMessage(msg)
+				continue
+			}
+			if len(keys) == 0 {
+				s.log.Debug(Event{Action: "sqs"}, "Dropping SQS message", aws.StringValue(msg.MessageId), "with no created objects")
+				s.deleteMessage(msg)
+				continue
+			}
+
+			m := &pendingMessage{s: s, msg: msg, pending: int32(len(keys))}
+			for _, key := range keys {
+				if !s.included(key) {
+					s.leaveOut(&s.numFiltered, reasonFiltered, key, 0)
+					m.done(nil)
+					continue
+				}
+				if s.listLimitReached(numObjects) {
+					// The message comes back for a later run
+					s.moreRemain = true
+					return numObjects, nil
+				}
+				select {
+				case tasks <- task{key, 0, m.compare(s.keyTask(key, ""))}:
+					numObjects++
+				case <-s.stop:
+					return numObjects, nil
+				}
+			}
+		}
+	}
+}
+
+// eventKeys returns the keys of the objects created in Config.S3Bucket
+// that an SQS message body announces.
+func (s *syncer) eventKeys(body string) ([]string, error) {
+	var event s3Event
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, err
+	}
+	if event.Type == "Notification" {
+		message := event.Message
+		event = s3Event{}
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			return nil, err
+		}
+	}
+	if event.Event == "s3:TestEvent" {
+		return nil, nil
+	}
+	if event.Records == nil {
+		return nil, errNotS3Event
+	}
+
+	var keys []string
+	for _, r := range event.Records {
+		if r.EventSource != "aws:s3" || !strings.HasPrefix(r.EventName, "ObjectCreated:") || r.S3.Bucket.Name != s.cfg.S3Bucket {
+			continue
+		}
+		// Keys come URL-encoded, with spaces as +
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, s.cfg.S3Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// pendingMessage is an SQS message whose objects are being synced.
+type pendingMessage struct {
+	s       *syncer
+	msg     *sqs.Message
+	pending int32 // objects not yet done, accessed atomically
+	failed  int32 // accessed atomically
+}
+
+// compare wraps the comparison of one of m's objects so that m is done
+// with it once it has been compared, and transferred if it needs to be.
+func (m *pendingMessage) compare(compare func(ctx context.Context) (func(worker int) error, error)) func(ctx context.Context) (func(worker int) error, error) {
+	return func(ctx context.Context) (func(worker int) error, error) {
+		transfer, err := compare(ctx)
+		if err != nil || transfer == nil {
+			return nil, m.done(err)
+		}
+		return func(worker int) error { return m.done(transfer(worker)) }, nil
+	}
+}
+
+// done notes that one of m's objects finished with err, deleting m once
+// they all have without an error. It returns err.
+func (m *pendingMessage) done(err error) error {
+	if err != nil {
+		atomic.StoreInt32(&m.failed, 1)
+	}
+	if atomic.AddInt32(&m.pending, -1) == 0 && atomic.LoadInt32(&m.failed) == 0 {
+		m.s.deleteMessage(m.msg)
+	}
+	return err
+}
+
+// deleteMessage removes msg from the queue. A failure is only logged, as
+// the message comes back and its objects are found in sync.
+func (s *syncer) deleteMessage(msg *sqs.Message) {
+	if s.cfg.DryRun {
+		return
+	}
+	_, err := s.sqs.DeleteMessageWithContext(s.ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.cfg.SQSQueueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		s.log.Error(Event{Action: "warning", Err: err}, "Couldn't delete SQS message", aws.StringValue(msg.MessageId))
+	}
+}
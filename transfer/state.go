@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// stateHeader is the first line of a state file and ties it to one job.
+type stateHeader struct {
+	Direction string `json:"direction"`
+	S3Bucket  string `json:"s3Bucket"`
+	S3Prefix  string `json:"s3Prefix"`
+	GSBucket  string `json:"gsBucket"`
+
+	ExtraGSBuckets string `json:"extraGsBuckets,omitempty"` // comma-separated
+	ExtraPrefixes  string `json:"extraPrefixes,omitempty"`  // as from prefixList
+	GSPrefix       string `json:"gsPrefix,omitempty"`
+	StripPrefix    bool   `json:"stripPrefix,omitempty"`
+	KeyRegex       string `json:"keyRegex,omitempty"`
+	KeyReplace     string `json:"keyReplace,omitempty"`
+}
+
+// stateEntry records an object found in sync. ETag identifies the source
+// version: the S3 ETag, or the GS generation for gs-to-s3.
+type stateEntry struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// stateFile is an append-only log of the objects confirmed in sync, one
+// JSON entry per line after the header, so an interrupted run loses at
+// most the line being written. A nil *stateFile records nothing.
+type stateFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	synced map[string]stateEntry
+}
+
+// openState opens the state file at path for the job described by header,
+// loading its entries if resume is set and starting it afresh otherwise.
+func openState(path string, header stateHeader, resume bool, mode os.FileMode, log Logger) (*stateFile, error) {
+	st := &stateFile{synced: make(map[string]stateEntry)}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	st.f = f
+
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		var fileHeader stateHeader
+		if err := json.Unmarshal(scanner.Bytes(), &fileHeader); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("state file %s: bad header: %v", path, err)
+		}
+		if fileHeader != header {
+			f.Close()
+			return nil, fmt.Errorf("state file %s is for %s %s/%s to %s, not this job",
+				path, fileHeader.Direction, fileHeader.S3Bucket, fileHeader.S3Prefix, fileHeader.GSBucket)
+		}
+
+		// A crash can leave a torn last line behind, so skip bad lines
+		bad := 0
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var entry stateEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				bad++
+				continue
+			}
+			st.synced[entry.Key] = entry
+		}
+		if err := scanner.Err(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("state file %s: %v", path, err)
+		}
+		if bad > 0 {
+			log.Error(Event{Action: "warning"}, "Skipped", bad, "unreadable lines in state file", path)
+		}
+		// Start appending on a fresh line
+		if _, err := f.Write([]byte("\n")); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		if err := st.writeLine(header); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// isSynced reports whether a previous run found entry in sync, with the
+// source unchanged since.
+func (st *stateFile) isSynced(entry stateEntry) bool {
+	if st == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.synced[entry.Key] == entry
+}
+
+// record appends entry to the state file.
+func (st *stateFile) record(entry stateEntry) error {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.synced[entry.Key] = entry
+	return st.writeLine(entry)
+}
+
+func (st *stateFile) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = st.f.Write(append(line, '\n'))
+	return err
+}
+
+func (st *stateFile) Close() error {
+	if st == nil {
+		return nil
+	}
+	return st.f.Close()
+}
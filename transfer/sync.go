@@ -0,0 +1,1467 @@
+package transfer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// gsStorageClasses are the values accepted for Config.StorageClass.
+var gsStorageClasses = map[string]bool{
+	"STANDARD":                     true,
+	"NEARLINE":                     true,
+	"COLDLINE":                     true,
+	"ARCHIVE":                      true,
+	"MULTI_REGIONAL":               true,
+	"REGIONAL":                     true,
+	"DURABLE_REDUCED_AVAILABILITY": true,
+}
+
+// minPartSize is the smallest part S3 allows in a multipart transfer.
+const minPartSize = 5 * 1024 * 1024
+
+// defaultRegion is used when Config.AWSRegion is unset and the bucket
+// region can't be detected.
+const defaultRegion = "us-east-1"
+
+// The permissions of what's written locally when Config.FileMode and
+// Config.DirMode are unset: for the owner only.
+const (
+	defaultFileMode os.FileMode = 0600
+	defaultDirMode  os.FileMode = 0700
+)
+
+// Backoff between retries of an object
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// Rechecks of an upload that isn't visible yet, after 100ms, 200ms and
+// 400ms
+const (
+	uploadCheckAttempts = 4
+	uploadCheckDelay    = 100 * time.Millisecond
+)
+
+// bucketRegions caches the regions detectBucketRegion finds, by endpoint
+// and bucket, so the runs of Serve and each Transfer in one process look
+// a bucket up only once.
+var bucketRegions sync.Map
+
+// detectBucketRegion looks up the region of bucket with GetBucketRegion,
+// using awsConfig for everything but the region, falling back to
+// defaultRegion if the lookup fails. GetBucketRegion asks S3 where the
+// bucket is with an unsigned HEAD, so unlike GetBucketLocation it needs
+// no permission on the bucket.
+func detectBucketRegion(ctx context.Context, log Logger, awsConfig *aws.Config, bucket string) string {
+	cacheKey := aws.StringValue(awsConfig.Endpoint) + "/" + bucket
+	if region, ok := bucketRegions.Load(cacheKey); ok {
+		return region.(string)
+	}
+	region, err := s3manager.GetBucketRegion(ctx, session.New(awsConfig.Copy()), bucket, defaultRegion)
+	if err != nil {
+		// Not cached, so a later run looks again
+		log.Error(Event{Action: "warning", Err: err}, "Failed to detect bucket region, using", defaultRegion)
+		return defaultRegion
+	}
+	log.Info(Event{Action: "region"}, "Detected region", region, "for", bucket)
+	bucketRegions.Store(cacheKey, region)
+	return region
+}
+
+// writeToGS uploads content as key to each of targets at once, carrying
+// over the attributes of the source object. Each upload replaces only the
+// target's generation of key, or creates it if that's 0, failing with a
+// precondition error, and marking the target changed, if that's no longer
+// there. Once content is used up it calls check, and abandons the uploads
+// if that fails. An upload abandoned before it's closed is never
+// committed, and one whose close fails is removed if GS committed it
+// anyway, so a failure leaves no object behind. The targets whose upload
+// was committed are marked uploaded even if another's failed. It leaves it
+// to the caller to decide what a failure means for the run. With
+// Config.Compress it returns the hash of the gzipped bytes sent, nil if it
+// sent content as is.
+func (s *syncer) writeToGS(ctx context.Context, key string, targets []*target, content io.Reader, src sourceAttrs, check func() error) (compressed *contentHash, err error) {
+	// Peek at no more than http.DetectContentType looks at, so memory
+	// stays bounded whatever the object's size
+	peeked := bufio.NewReaderSize(content, sniffLen)
+	head, err := peeked.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading source: %w", err)
+	}
+
+	attrs := storage.ObjectAttrs{
+		Name:               key,
+		ContentEncoding:    src.contentEncoding,
+		CacheControl:       src.cacheControl,
+		ContentLanguage:    src.contentLanguage,
+		ContentDisposition: src.contentDisposition,
+		StorageClass:       s.cfg.StorageClass,
+		KMSKeyName:         s.cfg.KMSKey,
+		Metadata:           s.gsMetadata(key, src.metadata, src.tags),
+	}
+	// Prefer Config.ContentType, then the source's content type, and only go
+	// by the key's extension or else sniff the first bytes when the source
+	// has none or a generic one. There's nothing to sniff in an empty
+	// object, which would pass for text.
+	switch {
+	case s.cfg.ContentType != "":
+		attrs.ContentType = s.cfg.ContentType
+	case src.contentType != "" && src.contentType != "application/octet-stream":
+		attrs.ContentType = src.contentType
+	case s.mimeType(key) != "":
+		attrs.ContentType = s.mimeType(key)
+	case len(head) == 0:
+		attrs.ContentType = "application/octet-stream"
+	default:
+		attrs.ContentType = http.DetectContentType(head)
+	}
+	if s.cfg.CacheControl != "" {
+		attrs.CacheControl = s.cfg.CacheControl
+	}
+	if s.cfg.ContentLanguage != "" {
+		attrs.ContentLanguage = s.cfg.ContentLanguage
+	}
+	if s.cfg.ContentDisposition != "" {
+		attrs.ContentDisposition = s.cfg.ContentDisposition
+	}
+	if !src.lastModified.IsZero() {
+		if attrs.Metadata == nil {
+			attrs.Metadata = make(map[string]string)
+		}
+		attrs.Metadata[sourceLastModifiedKey] = src.lastModified.UTC().Format(time.RFC3339)
+	}
+	if s.compresses(key, attrs.ContentType, src.contentEncoding) {
+		attrs.ContentEncoding = "gzip"
+		if attrs.Metadata == nil {
+			attrs.Metadata = make(map[string]string)
+		}
+		attrs.Metadata[sourceETagKey] = src.etag
+		attrs.Metadata[sourceSizeKey] = strconv.FormatInt(src.size, 10)
+		compressed = newContentHash()
+	}
+	if s.cfg.NoTranscode && strings.EqualFold(attrs.ContentEncoding, "gzip") {
+		// GS transcodes gzip objects for clients that don't accept gzip
+		// unless told not to
+		attrs.CacheControl = addDirective(attrs.CacheControl, "no-transform")
+	}
+
+	// https://github.com/golang/build/blob/master/cmd/upload/upload.go
+	// The content is read once and fanned out to every target
+	writers := make([]objectWriter, len(targets))
+	fanOut := make([]io.Writer, len(targets))
+	for i, t := range targets {
+		t.uploaded = false
+		attrs := attrs
+		attrs.PredefinedACL = s.gsACL(t.destination, src.acl)
+		writers[i] = targetWriter{t.gs.NewWriter(ctx, attrs, t.generation), t}
+		fanOut[i] = writers[i]
+	}
+	abort := func(err error) {
+		for _, w := range writers {
+			w.CloseWithError(err)
+		}
+	}
+	var dest io.Writer = io.MultiWriter(fanOut...)
+	var gz *gzip.Writer
+	if compressed != nil {
+		gz = gzip.NewWriter(io.MultiWriter(dest, compressed))
+		dest = gz
+	}
+	if _, err := io.Copy(dest, peeked); err != nil {
+		err = fmt.Errorf("copying to GS: %w", err)
+		abort(err)
+		return nil, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			err = fmt.Errorf("compressing: %w", err)
+			abort(err)
+			return nil, err
+		}
+	}
+	if err := check(); err != nil {
+		abort(err)
+		return nil, err
+	}
+	// One upload failing to finish doesn't stop the others
+	var uploadErr error
+	for i, t := range targets {
+		closeErr := writers[i].Close()
+		if closeErr == nil {
+			t.uploaded = true
+			continue
+		}
+		// On a precondition failure what's there is another runner's
+		if !isPreconditionFailed(closeErr) {
+			s.removeFailedUpload(t.destination, key, t.generation)
+		}
+		if uploadErr == nil {
+			uploadErr = s.inBucket(t.destination, fmt.Errorf("finishing GS upload: %w", closeErr))
+		}
+	}
+	return compressed, uploadErr
+}
+
+// removeFailedUpload deletes what an upload to d over generation of key
+// committed even though closing it failed, as when GS finishes the upload
+// but the response is lost, so that the retry or the next run doesn't
+// find it and take it for another runner's. The delete is conditional on
+// the generation found, to leave alone any object written since.
+func (s *syncer) removeFailedUpload(d *destination, key string, generation int64) {
+	attrs, err := d.gs.Attrs(s.ctx, key)
+	if err == storage.ErrObjectNotExist || (err == nil && attrs.Generation == generation) {
+		return
+	}
+	if err == nil {
+		err = d.gs.Delete(s.ctx, key, attrs.Generation)
+	}
+	if err != nil {
+		s.log.Error(Event{Action: "warning", Key: key, Err: err}, "Couldn't remove what a failed upload left of", key+":")
+		return
+	}
+	s.log.Debug(Event{Action: "removed-failed-upload", Key: key}, "Removed the object a failed upload left of", key)
+}
+
+// sniffLen is how much of an object writeToGS peeks at to detect its
+// content type.
+const sniffLen = 512
+
+// addDirective adds directive to the Cache-Control header value unless
+// it's already there.
+func addDirective(value, directive string) string {
+	if value == "" {
+		return directive
+	}
+	for _, d := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return value
+		}
+	}
+	return value + ", " + directive
+}
+
+// isMultipartETag reports whether etag belongs to a multipart upload, in
+// which case it is a hash of the part hashes rather than the content MD5.
+func isMultipartETag(etag string) bool {
+	return strings.Contains(etag, "-")
+}
+
+// syncer holds the configuration and clients shared by the transfer
+// workers.
+type syncer struct {
+	cfg          Config
+	log          Logger
+	ctx          context.Context
+	s3Client     s3Objects
+	s3Downloader objectDownloader
+	s3Uploader   objectUploader
+	gs           gsObjects      // Config.GSBucket
+	dests        []*destination // Config.GSBucket first, then Config.ExtraGSBuckets
+	sqs          sqsQueue       // with Config.SQSQueueURL
+	state        *stateFile
+	report       *reportFile
+	diff         *diffFile    // with Config.DiffReport
+	bandwidth    *tokenBucket // nil without Config.BandwidthLimit
+
+	// tracer traces the run under runSpan, for Config.TracerProvider
+	tracer  trace.Tracer
+	runSpan trace.Span
+
+	amtTransferred uint64 // accessed atomically
+	numTransferred uint64 // accessed atomically
+	numInSync      uint64 // accessed atomically
+	numFailed      uint64 // accessed atomically
+	failures       []Failure
+	failuresMu     sync.Mutex
+
+	numSourceDeleted      uint64 // accessed atomically
+	numSourceDeleteFailed uint64 // accessed atomically
+	numSourceWouldDelete  uint64 // with Config.DryRun, accessed atomically
+
+	// For Progress, all accessed atomically
+	numStarted  int64
+	numDone     int64
+	listingDone int32
+	bytesSent   uint64
+	skipped     SkipCounts
+	verified    VerifyCounts
+
+	// sample picks the objects Config.VerifyContent checks, holding
+	// sampleMu
+	sample   *rand.Rand
+	sampleMu sync.Mutex
+	diffed   DiffCounts
+
+	// sourceKeys is every key in the source listing, kept for
+	// Config.Delete and Config.DiffReport, numFiltered counts keys left out by Config.Includes
+	// and Config.Excludes, numOutOfRange those left out by
+	// Config.MinSize and Config.MaxSize, numTooOld those left out by
+	// Config.ModifiedAfter and numFolders those left out by
+	// Config.SkipFolders. Only the listers touch them, the S3 shards
+	// holding listMu.
+	listMu        sync.Mutex
+	sourceKeys    map[string]bool
+	numFiltered   int
+	numOutOfRange int
+	numTooOld     int
+	numFolders    int
+
+	// moreRemain is set by the lister when it stops at Config.MaxObjects
+	// with objects left unlisted; limit is closed once Config.MaxObjects
+	// transfers have been started.
+	moreRemain  bool
+	limit       chan struct{}
+	limitOnce   sync.Once
+	numReserved int64 // accessed atomically
+
+	// listedBefore is how many objects the prefixes synced before the
+	// current one listed, with Config.ExtraPrefixes
+	listedBefore int
+
+	stop     chan struct{} // closed by stopListing
+	stopOnce sync.Once
+}
+
+// stopListing stops the listers handing out new objects, letting the
+// in-flight transfers finish. It can be called more than once.
+func (s *syncer) stopListing() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// syncObject compares key, or with version that version of it, in S3
+// with each GS bucket, returning the transfer to those it isn't already
+// in for a transfer worker to run, or nil if there's nothing to
+// transfer. Each transfer worker stages files under its own subdirectory
+// of Config.LocalDir.
+func (s *syncer) syncObject(ctx context.Context, key *s3.Object, version string) (func(worker int) error, error) {
+	// name is the object in GS, and how it's logged, recorded and reported
+	name := versionedName(*key.Key, version)
+	entry := stateEntry{name, *key.Size, *key.ETag}
+	if s.state.isSynced(entry) {
+		s.log.Info(Event{Action: "skip", Key: name}, skipMessage(reasonPreviousRun, "GS"), name)
+		s.countSkip(reasonPreviousRun)
+		s.record(ctx, reportEntry{Key: name, Action: "skip", Reason: reasonPreviousRun, Size: *key.Size, Checksum: *key.ETag})
+		return nil, nil
+	}
+
+	s3Size := *key.Size
+
+	// Decide once for each bucket whether the object needs transferring to
+	// it, then act on it
+	var targets []*target
+	for _, d := range s.dests {
+		t, reason, err := s.compareWith(ctx, d, key, version)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			s.log.Info(Event{Action: "skip", Key: name}, skipMessage(reason, d.label), s.logName(d, name))
+			s.countSkip(reason)
+			s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(d), Action: "skip", Reason: reason, Size: s3Size, Checksum: *key.ETag})
+			continue
+		}
+		targets = append(targets, t)
+	}
+	// An archived object can only be read once restored
+	restoreReason := ""
+	if len(targets) > 0 && isArchived(aws.StringValue(key.StorageClass)) {
+		var err error
+		if restoreReason, err = s.restoreReason(ctx, *key.Key, version); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(targets) == 0:
+		atomic.AddUint64(&s.numInSync, 1)
+	case restoreReason != "":
+		// Not recorded in the state file, so a later run picks it up
+		for _, t := range targets {
+			s.log.Info(Event{Action: "skip", Key: name}, skipMessage(restoreReason, t.label), s.logName(t.destination, name))
+			s.countSkip(restoreReason)
+			s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(t.destination), Action: "skip", Reason: restoreReason, Size: s3Size, Checksum: *key.ETag})
+		}
+		return nil, nil
+	case !s.reserveTransfer():
+		for _, t := range targets {
+			s.log.Info(Event{Action: "skip", Key: name}, skipMessage(reasonLimit, t.label), s.logName(t.destination, name))
+			s.countSkip(reasonLimit)
+			s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(t.destination), Action: "skip", Reason: reasonLimit, Size: s3Size, Checksum: *key.ETag})
+		}
+		return nil, nil
+	case s.cfg.DryRun:
+		for _, t := range targets {
+			atomic.AddUint64(&s.numTransferred, 1)
+			atomic.AddUint64(&s.amtTransferred, uint64(s3Size))
+			s.log.Info(Event{Action: "would-transfer", Key: name, Bytes: s3Size}, "Would download/upload", s.logName(t.destination, name))
+			s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(t.destination), Action: "would-transfer", Reason: t.reason, Size: s3Size, Checksum: *key.ETag})
+		}
+		if s.cfg.DeleteSource {
+			s.log.Info(Event{Action: "would-delete-source", Key: name}, "Would delete source", name, "from S3")
+			atomic.AddUint64(&s.numSourceWouldDelete, 1)
+			s.record(ctx, reportEntry{Key: name, Action: "would-delete-source"})
+		}
+	default:
+		return func(worker int) error {
+			return s.transferTargets(ctx, key, version, s.localPath(worker, name), targets, entry)
+		}, nil
+	}
+
+	if s.cfg.DryRun {
+		return nil, nil
+	}
+	return nil, s.state.record(entry)
+}
+
+// transferTargets copies key, or with version that version of it, to
+// the targets syncObject found it needs transferring to, staging it at
+// localFilepath with Config.UseDisk, and records entry in the state file
+// once it's in all of them.
+func (s *syncer) transferTargets(ctx context.Context, key *s3.Object, version, localFilepath string, targets []*target, entry stateEntry) error {
+	name := versionedName(*key.Key, version)
+	s3Size := *key.Size
+	start := time.Now()
+	transfer := func() error {
+		return s.transferObject(ctx, key, version, localFilepath, targets)
+	}
+	err := s.retry(name, transfer)
+	// Another runner writing the object to one bucket stops the uploads
+	// to the others too, so carry on with those
+	for isPreconditionFailed(err) && len(pendingTargets(targets)) > 0 {
+		err = s.retry(name, transfer)
+	}
+	if isPreconditionFailed(err) {
+		err = nil
+	}
+	elapsed := time.Since(start)
+	transferred, changed := false, false
+	for _, t := range targets {
+		switch {
+		case t.changed:
+			changed = true
+			if skipErr := s.skipChanged(ctx, key, version, t.destination); err == nil {
+				err = skipErr
+			}
+		case t.done:
+			transferred = true
+			s.countTransfer(s3Size, elapsed)
+			s.log.Info(Event{Action: "transferred", Key: name, Bytes: s3Size, Duration: elapsed},
+				"Transferred", s.logName(t.destination, name), "in", elapsed)
+			s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(t.destination), Action: "transferred", Reason: t.reason, Size: s3Size, Checksum: *key.ETag})
+		}
+	}
+	if !transferred {
+		s.releaseTransfer()
+	}
+	if err != nil || changed {
+		return err
+	}
+	if s.cfg.DeleteSource {
+		s.deleteSource(ctx, *key.Key)
+	}
+	return s.state.record(entry)
+}
+
+// compareWith decides whether version of key needs transferring to d,
+// returning a target for it if so, and otherwise why it's skipped.
+func (s *syncer) compareWith(ctx context.Context, d *destination, key *s3.Object, version string) (t *target, skip string, err error) {
+	name := versionedName(*key.Key, version)
+	gsAttrs, gsErr := d.attrs(ctx, name)
+	existsInGS := gsErr == nil
+	if !existsInGS && !errors.Is(gsErr, storage.ErrObjectNotExist) {
+		return nil, "", s.inBucket(d, fmt.Errorf("looking up in GS: %w", gsErr))
+	}
+	// Upload only over the object compared, so as not to clobber one
+	// another runner has written since
+	t = &target{destination: d}
+	var gsSize int64
+	if existsInGS {
+		reason := s.conflictReason(aws.TimeValue(key.LastModified), destModified(gsAttrs), func() string {
+			return s.skipReason(ctx, *key.Key, version, *key.ETag, *key.Size, gsAttrs)
+		})
+		if reason != "" {
+			return nil, reason, nil
+		}
+		t.generation, gsSize = gsAttrs.Generation, gsAttrs.Size
+	}
+	t.reason = s.transferReason(existsInGS, *key.ETag, *key.Size, gsSize)
+	return t, "", nil
+}
+
+// localPath is where worker stages key with Config.UseDisk. The whole key
+// is kept as nested directories, cleaned of any ".." so it can't escape
+// Config.LocalDir, so keys sharing a last element don't share a file.
+// With Config.Flatten it's instead the last element after a hash of the
+// whole key, all in one directory.
+func (s *syncer) localPath(worker int, key string) string {
+	workerDir := filepath.Join(s.cfg.LocalDir, fmt.Sprintf("worker-%d", worker))
+	if s.cfg.Flatten {
+		sum := sha1.Sum([]byte(key))
+		return filepath.Join(workerDir, hex.EncodeToString(sum[:8])+"-"+path.Base(path.Clean("/"+key)))
+	}
+	return filepath.Join(workerDir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// conflictReason is why an object that's already in the destination is
+// skipped under Config.Conflict, or "" to transfer it. compare decides
+// under Config.Conflict compare.
+func (s *syncer) conflictReason(srcModified, destModified time.Time, compare func() string) string {
+	switch s.cfg.Conflict {
+	case "skip":
+		return reasonExists
+	case "overwrite":
+		return ""
+	case "newer":
+		if srcModified.After(destModified) {
+			return ""
+		}
+		return reasonNotNewer
+	}
+	return compare()
+}
+
+// skipMessage describes skipping an object for reason, as returned by
+// skipReason, when it's already in dest.
+func skipMessage(reason, dest string) string {
+	if reason == "Already in sync" {
+		return "Already in " + dest + ", skipping"
+	}
+	return reason + ", skipping"
+}
+
+// reserveTransfer reports whether another object may be transferred under
+// Config.MaxObjectsCount transferred, and stops the listing once the last
+// one has been handed out.
+func (s *syncer) reserveTransfer() bool {
+	if s.cfg.MaxObjects <= 0 || s.cfg.MaxObjectsCount != "transferred" {
+		return true
+	}
+	n := atomic.AddInt64(&s.numReserved, 1)
+	if n >= int64(s.cfg.MaxObjects) {
+		s.limitOnce.Do(func() { close(s.limit) })
+	}
+	return n <= int64(s.cfg.MaxObjects)
+}
+
+// releaseTransfer gives back the reservation of a transfer that failed.
+func (s *syncer) releaseTransfer() {
+	atomic.AddInt64(&s.numReserved, -1)
+}
+
+// listLimitReached reports whether the lister should stop at
+// Config.MaxObjects, having already dispatched numObjects of the prefix
+// being synced.
+func (s *syncer) listLimitReached(numObjects int) bool {
+	if s.cfg.MaxObjects > 0 && s.cfg.MaxObjectsCount == "considered" && s.listedBefore+numObjects >= s.cfg.MaxObjects {
+		return true
+	}
+	select {
+	case <-s.limit:
+		return true
+	default:
+		return false
+	}
+}
+
+// skipReason compares an object that exists in both S3 and GS and returns
+// why it doesn't need transferring, or "" if it does.
+func (s *syncer) skipReason(ctx context.Context, key, version, s3ETag string, s3Size int64, gsAttrs *storage.ObjectAttrs) string {
+	s3MD5 := strings.Replace(s3ETag, "\"", "", -1)
+	multipart := isMultipartETag(s3MD5)
+	hashMatches := strings.EqualFold(s3MD5, hex.EncodeToString(gsAttrs.MD5))
+	sizeMatches := s3Size == gsAttrs.Size
+	s.log.Debug(Event{Action: "compare", Key: key, Bytes: s3Size}, "Comparing", key,
+		"S3 etag", s3MD5, "size", s3Size, "GS md5", hex.EncodeToString(gsAttrs.MD5), "size", gsAttrs.Size)
+
+	// A compressed copy's size and hashes are of what was stored, so it's
+	// down to the source it records
+	if isCompressedCopy(gsAttrs) {
+		if compressedCopyMatches(s3ETag, s3Size, gsAttrs) {
+			return reasonStoredHash
+		}
+		return ""
+	}
+
+	// A multipart ETag isn't an MD5, so unless Config.CompareMode size
+	// it's down to Config.MultipartFallback
+	hashComparison := s.cfg.CompareMode != "size"
+
+	// Comparing by CRC32C goes by the CRC32C recorded on upload for this
+	// ETag, so whether that's an MD5 doesn't come into it
+	if hashComparison && s.useCRC32C(gsAttrs) {
+		hashMatches = sizeMatches && s3Size > 0 && storedCRC32CMatches(s3ETag, gsAttrs)
+		multipart = false
+	}
+	switch {
+	case hashMatches && sizeMatches:
+		return "Already in sync"
+	case s3Size == 0 && sizeMatches:
+		// Empty objects are alike whatever their ETag, which for SSE-KMS
+		// isn't an MD5
+		return "Already in sync"
+	case s.cfg.CompareMode == "size" && sizeMatches:
+		return "Size matches"
+	case s.cfg.CompareMode == "hash" && hashMatches:
+		return "Hash matches"
+	case hashComparison && sizeMatches && storedHashMatches(s3ETag, gsAttrs):
+		return reasonStoredHash
+	case multipart && hashComparison && sizeMatches && s.cfg.MultipartFallback == "hash" && s.contentMatches(ctx, key, version, gsAttrs):
+		return "Content hash matches"
+	case multipart && hashComparison && sizeMatches && s.cfg.MultipartFallback == "size":
+		return "Size matches"
+	}
+	return ""
+}
+
+// syncObjectToS3 compares the GS object described by gsAttrs with S3,
+// using the same comparison as syncObject, and returns its transfer to
+// S3 unless it is already there.
+func (s *syncer) syncObjectToS3(ctx context.Context, gsAttrs *storage.ObjectAttrs) (func(worker int) error, error) {
+	key := gsAttrs.Name
+	entry := stateEntry{key, gsAttrs.Size, strconv.FormatInt(gsAttrs.Generation, 10)}
+	if s.state.isSynced(entry) {
+		s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonPreviousRun, "S3"), key)
+		s.countSkip(reasonPreviousRun)
+		s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonPreviousRun, Size: gsAttrs.Size, Checksum: hex.EncodeToString(gsAttrs.MD5)})
+		return nil, nil
+	}
+
+	s3Attrs, s3Err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.S3Bucket),
+		Key:    aws.String(key),
+	})
+
+	existsInS3 := s3Err == nil
+	if !existsInS3 && !isNotFound(s3Err) {
+		return nil, fmt.Errorf("looking up in S3: %w", s3Err)
+	}
+
+	// s3Attrs is nil unless existsInS3
+	reason := ""
+	if existsInS3 {
+		reason = s.conflictReason(gsAttrs.Updated, aws.TimeValue(s3Attrs.LastModified), func() string {
+			return s.skipReason(ctx, key, "", aws.StringValue(s3Attrs.ETag), aws.Int64Value(s3Attrs.ContentLength), gsAttrs)
+		})
+	}
+	needsTransfer := reason == ""
+	if needsTransfer {
+		var etag string
+		var s3Size int64
+		if existsInS3 {
+			etag, s3Size = aws.StringValue(s3Attrs.ETag), aws.Int64Value(s3Attrs.ContentLength)
+		}
+		reason = s.transferReason(existsInS3, etag, s3Size, gsAttrs.Size)
+	}
+
+	switch {
+	case !needsTransfer:
+		atomic.AddUint64(&s.numInSync, 1)
+		s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reason, "S3"), key)
+		s.countSkip(reason)
+		s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reason, Size: gsAttrs.Size, Checksum: hex.EncodeToString(gsAttrs.MD5)})
+	case !s.reserveTransfer():
+		s.log.Info(Event{Action: "skip", Key: key}, skipMessage(reasonLimit, "S3"), key)
+		s.countSkip(reasonLimit)
+		s.record(ctx, reportEntry{Key: key, Action: "skip", Reason: reasonLimit, Size: gsAttrs.Size, Checksum: hex.EncodeToString(gsAttrs.MD5)})
+		return nil, nil
+	case s.cfg.DryRun:
+		atomic.AddUint64(&s.numTransferred, 1)
+		atomic.AddUint64(&s.amtTransferred, uint64(gsAttrs.Size))
+		s.log.Info(Event{Action: "would-transfer", Key: key, Bytes: gsAttrs.Size}, "Would download/upload", key)
+		s.record(ctx, reportEntry{Key: key, Action: "would-transfer", Reason: reason, Size: gsAttrs.Size, Checksum: hex.EncodeToString(gsAttrs.MD5)})
+	default:
+		return func(int) error {
+			start := time.Now()
+			err := s.retry(key, func() error {
+				return s.transferObjectToS3(ctx, gsAttrs)
+			})
+			if err != nil {
+				s.releaseTransfer()
+				return err
+			}
+			elapsed := time.Since(start)
+			s.countTransfer(gsAttrs.Size, elapsed)
+			s.log.Info(Event{Action: "transferred", Key: key, Bytes: gsAttrs.Size, Duration: elapsed},
+				"Transferred", key, "in", elapsed)
+			s.record(ctx, reportEntry{Key: key, Action: "transferred", Reason: reason, Size: gsAttrs.Size, Checksum: hex.EncodeToString(gsAttrs.MD5)})
+			return s.state.record(entry)
+		}, nil
+	}
+
+	if s.cfg.DryRun {
+		return nil, nil
+	}
+	return nil, s.state.record(entry)
+}
+
+// transferObjectToS3 makes one attempt at streaming an object from GS to
+// S3 and checks the result.
+func (s *syncer) transferObjectToS3(ctx context.Context, gsAttrs *storage.ObjectAttrs) error {
+	ctx, cancel := s.objectContext(ctx)
+	defer cancel()
+
+	key := gsAttrs.Name
+	// Read gzip-encoded objects as stored rather than transcoded, so
+	// they keep their Content-Encoding and size in S3
+	r, err := s.gs.NewReader(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	contentTypeToS3 := gsAttrs.ContentType
+	switch {
+	case s.cfg.ContentType != "":
+		contentTypeToS3 = s.cfg.ContentType
+	case contentTypeToS3 == "" || contentTypeToS3 == "application/octet-stream":
+		if contentType := s.mimeType(key); contentType != "" {
+			contentTypeToS3 = contentType
+		}
+	}
+	cacheControlToS3 := gsAttrs.CacheControl
+	if s.cfg.CacheControl != "" {
+		cacheControlToS3 = s.cfg.CacheControl
+	}
+	contentLanguageToS3 := gsAttrs.ContentLanguage
+	if s.cfg.ContentLanguage != "" {
+		contentLanguageToS3 = s.cfg.ContentLanguage
+	}
+	contentDispositionToS3 := gsAttrs.ContentDisposition
+	if s.cfg.ContentDisposition != "" {
+		contentDispositionToS3 = s.cfg.ContentDisposition
+	}
+
+	s.log.Debug(Event{Action: "stream", Key: key}, "Streaming", key, "from GS to S3")
+	// Reading GS and writing S3 are one stream, traced as the upload
+	uploadCtx, upload := s.startSpan(ctx, "upload")
+	_, err = s.s3Uploader.UploadWithContext(uploadCtx, &s3manager.UploadInput{
+		Bucket:             aws.String(s.cfg.S3Bucket),
+		Key:                aws.String(key),
+		Body:               s.throttle(r),
+		ContentType:        aws.String(contentTypeToS3),
+		ContentEncoding:    optionalString(gsAttrs.ContentEncoding),
+		CacheControl:       optionalString(cacheControlToS3),
+		ContentLanguage:    optionalString(contentLanguageToS3),
+		ContentDisposition: optionalString(contentDispositionToS3),
+		Metadata:           s.s3Metadata(gsAttrs.Metadata),
+	})
+	endSpan(upload, err)
+	if err != nil {
+		return err
+	}
+
+	s3Attrs, err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(s3Attrs.ContentLength) != gsAttrs.Size {
+		return errUploadMismatch
+	}
+	return nil
+}
+
+// transferObject makes one attempt at copying key from S3 to each of
+// targets not yet done, downloading it once and staging it at
+// localFilepath with Config.UseDisk, and checks the results. It replaces
+// only the generation of each target, updating it to the generation
+// uploaded so a retry replaces that, and marks those checked done.
+func (s *syncer) transferObject(ctx context.Context, key *s3.Object, version, localFilepath string, targets []*target) error {
+	name := versionedName(*key.Key, version)
+	targets = pendingTargets(targets)
+	if len(targets) == 0 {
+		return nil
+	}
+	// Cancelling ctx also abandons the GS uploads
+	ctx, cancel := s.objectContext(ctx)
+	defer cancel()
+
+	// Hash the content on its way through so the download can be
+	// checked before the upload is committed, and the upload checked
+	// even when the ETag isn't an MD5
+	hasher := newContentHash()
+	var compressed *contentHash
+	var uploadErr error
+
+	if s.cfg.UploadOnly {
+		compressed, uploadErr = s.uploadLocalFile(ctx, key, targets, hasher)
+	} else if s.cfg.UseDisk {
+		// Create local file path and file
+		err := os.MkdirAll(filepath.Dir(localFilepath), s.cfg.DirMode)
+		if err != nil {
+			return fmt.Errorf("creating local dirs: %w", err)
+		}
+		file, err := os.OpenFile(localFilepath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.cfg.FileMode)
+		if err != nil {
+			return fmt.Errorf("creating local file: %w", err)
+		}
+		// Close and delete the local file however this attempt ends,
+		// including when the run is cancelled
+		defer func() {
+			file.Close()
+			s.log.Debug(Event{Action: "remove", Key: name}, "Removing", localFilepath)
+			os.Remove(localFilepath)
+		}()
+
+		// Download from S3
+		s3Head, err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(s.cfg.S3Bucket),
+			Key:       aws.String(*key.Key),
+			VersionId: optionalString(version),
+		})
+		if err != nil {
+			return fmt.Errorf("getting S3 attributes: %w", err)
+		}
+		s.log.Debug(Event{Action: "download", Key: name}, "Downloading from S3", name, "to", localFilepath)
+		downloadCtx, download := s.startSpan(ctx, "download")
+		_, err = s.s3Downloader.DownloadWithContext(downloadCtx, s.throttleWriterAt(file),
+			&s3.GetObjectInput{
+				Bucket:    aws.String(s.cfg.S3Bucket),
+				Key:       aws.String(*key.Key),
+				VersionId: optionalString(version),
+			})
+		endSpan(download, err)
+		if err != nil {
+			return fmt.Errorf("downloading from S3: %w", err)
+		}
+
+		src := sourceAttrsFromHead(s3Head)
+		if s.cfg.CopyTags {
+			if src.tags, err = s.s3Tags(ctx, *key.Key, version); err != nil {
+				return fmt.Errorf("getting S3 tags: %w", err)
+			}
+		}
+		if s.cfg.CopyACL && aclsAllowed(targets) {
+			if src.acl, err = s.s3ACL(ctx, *key.Key, version); err != nil {
+				return fmt.Errorf("getting S3 ACL: %w", err)
+			}
+		}
+
+		// Check the whole download before sending any of it, so a
+		// truncated or corrupt one is downloaded again rather than sent
+		if _, err := io.Copy(hasher, file); err != nil {
+			return fmt.Errorf("reading local file: %w", err)
+		}
+		if err := hasher.matchesSource(src); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewinding local file: %w", err)
+		}
+
+		s.log.Debug(Event{Action: "upload", Key: name}, "Uploading", localFilepath, "to GS at", name)
+		uploadCtx, upload := s.startSpan(ctx, "upload")
+		compressed, err = s.writeToGS(uploadCtx, name, targets, s.throttle(file), src,
+			func() error { return nil })
+		endSpan(upload, err)
+		uploadErr = err
+	} else {
+		// Stream the download straight into the GS writer
+		s3Head, err := s.s3Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(s.cfg.S3Bucket),
+			Key:       aws.String(*key.Key),
+			VersionId: optionalString(version),
+		})
+		if err != nil {
+			return fmt.Errorf("getting S3 attributes: %w", err)
+		}
+
+		src := sourceAttrsFromHead(s3Head)
+		if s.cfg.CopyTags {
+			if src.tags, err = s.s3Tags(ctx, *key.Key, version); err != nil {
+				return fmt.Errorf("getting S3 tags: %w", err)
+			}
+		}
+		if s.cfg.CopyACL && aclsAllowed(targets) {
+			if src.acl, err = s.s3ACL(ctx, *key.Key, version); err != nil {
+				return fmt.Errorf("getting S3 ACL: %w", err)
+			}
+		}
+
+		s.log.Debug(Event{Action: "stream", Key: name}, "Streaming", name, "from S3 to GS")
+		// The download and upload spans overlap, the one feeding the other
+		body, closeBody := s.streamFromS3(ctx, *key.Key, version, src.size)
+		uploadCtx, upload := s.startSpan(ctx, "upload")
+		compressed, err = s.writeToGS(uploadCtx, name, targets, io.TeeReader(s.throttle(body), hasher), src,
+			func() error { return hasher.matchesSource(src) })
+		endSpan(upload, err)
+		closeBody()
+		uploadErr = err
+	}
+
+	// Check the uploads that were committed, even if another failed
+	err := uploadErr
+	for _, t := range targets {
+		if !t.uploaded {
+			continue
+		}
+		verifyCtx, verify := s.startSpan(ctx, "verify")
+		checkErr := s.inBucket(t.destination, s.checkUpload(verifyCtx, t, key, name, hasher, compressed))
+		endSpan(verify, checkErr)
+		if checkErr == nil {
+			t.done = true
+		} else if err == nil {
+			err = checkErr
+		}
+	}
+	// A refused upload that didn't mark its target, which can't happen,
+	// would otherwise be tried forever
+	if isPreconditionFailed(err) && len(pendingTargets(targets)) == len(targets) {
+		for _, t := range targets {
+			t.changed = true
+		}
+	}
+	return err
+}
+
+// aclsAllowed reports whether any of targets can have ACLs.
+func aclsAllowed(targets []*target) bool {
+	for _, t := range targets {
+		if !t.uniformAccess {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpload checks the upload of key to t as name against what was
+// sent, hasher having hashed the source and compressed any gzipped bytes,
+// and sets the target's generation to the new generation.
+func (s *syncer) checkUpload(ctx context.Context, t *target, key *s3.Object, name string, hasher, compressed *contentHash) error {
+	// A compressed upload is checked against the bytes sent, the source
+	// having been checked on the way
+	sent := hasher
+	if compressed != nil {
+		sent = compressed
+	}
+	gsAttrs, err := s.uploadedAttrs(ctx, t.gs, name, sent.size)
+	if err != nil {
+		return fmt.Errorf("checking upload: %w", err)
+	}
+	t.generation = gsAttrs.Generation
+	s.log.Debug(Event{Action: "checksum", Key: name, Bytes: gsAttrs.Size},
+		"Uploaded", name, "size", gsAttrs.Size, "md5", hex.EncodeToString(sent.md5.Sum(nil)),
+		"crc32c", sent.crc32c.Sum32(), "GS md5", hex.EncodeToString(gsAttrs.MD5), "GS crc32c", gsAttrs.CRC32C)
+	if sent.size != gsAttrs.Size {
+		return errUploadMismatch
+	}
+	if matched, compared := sent.matches(gsAttrs, s.useCRC32C(gsAttrs)); compared && !matched {
+		return errUploadMismatch
+	}
+	if s.cfg.KMSKey != "" && !kmsKeyMatches(gsAttrs.KMSKeyName, s.cfg.KMSKey) {
+		return fmt.Errorf("encrypted with KMS key %q, not %q", gsAttrs.KMSKeyName, s.cfg.KMSKey)
+	}
+	if compressed != nil {
+		return nil
+	}
+	hashes := make(map[string]string)
+	if sum := hex.EncodeToString(hasher.md5.Sum(nil)); s.cfg.StoreSourceMD5 && !strings.EqualFold(strings.Trim(*key.ETag, "\""), sum) {
+		hashes[sourceMD5Key] = sum
+	}
+	if s.useCRC32C(gsAttrs) {
+		hashes[sourceCRC32CKey] = formatCRC32C(hasher.crc32c.Sum32())
+	}
+	if len(hashes) > 0 {
+		// The upload is good without them; later runs just can't skip the
+		// object by its stored hash
+		if err := s.storeSourceHash(ctx, t.gs, gsAttrs, *key.ETag, hashes); err != nil {
+			s.log.Error(Event{Action: "warning", Key: name, Err: err}, "Couldn't store the source hash of", name+":")
+		}
+	}
+	return nil
+}
+
+// streamFromS3 downloads key, or with version that version of it, to
+// the returned reader through an io.Pipe, so what's held in memory is
+// bounded whatever its size. It's downloaded one Config.DownloadPartSize
+// part at a time, in order, so a dropped connection costs a part rather
+// than the object. closeBody stops the download if it isn't done and
+// waits for it to end. The download is traced as a "download" span
+// under the one in ctx.
+func (s *syncer) streamFromS3(ctx context.Context, key, version string, size int64) (body io.Reader, closeBody func()) {
+	ctx, span := s.startSpan(ctx, "download")
+	// There are no parts to an empty object, which S3 can't serve a range of
+	if size == 0 {
+		endSpan(span, nil)
+		return strings.NewReader(""), func() {}
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := s.s3Downloader.DownloadWithContext(ctx, &pipeWriterAt{w: pw},
+			&s3.GetObjectInput{
+				Bucket:    aws.String(s.cfg.S3Bucket),
+				Key:       aws.String(key),
+				VersionId: optionalString(version),
+			},
+			func(d *s3manager.Downloader) { d.Concurrency = 1 })
+		if err != nil {
+			err = fmt.Errorf("downloading from S3: %w", err)
+		}
+		endSpan(span, err)
+		pw.CloseWithError(err)
+	}()
+	return pr, func() {
+		pr.Close()
+		<-done
+	}
+}
+
+// pipeWriterAt writes to w what a one part at a time s3manager.Downloader
+// writes at increasing offsets. A part the downloader retries is written
+// again from its start, so the bytes already passed on are dropped.
+type pipeWriterAt struct {
+	w      io.Writer
+	offset int64
+}
+
+func (p *pipeWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if off > p.offset {
+		return 0, fmt.Errorf("part written out of order at %d, expected %d", off, p.offset)
+	}
+	skip := p.offset - off
+	if skip >= int64(len(b)) {
+		return len(b), nil
+	}
+	n, err := p.w.Write(b[skip:])
+	p.offset += int64(n)
+	return int(skip) + n, err
+}
+
+// kmsKeyMatches reports whether an object's KMS key name, which GS
+// reports down to the key version, is the key named by want.
+func kmsKeyMatches(got, want string) bool {
+	return got == want || strings.HasPrefix(got, want+"/cryptoKeyVersions/")
+}
+
+// objectContext returns the context for one attempt at transferring an
+// object under ctx, limited to Config.ObjectTimeout if it's set.
+func (s *syncer) objectContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.ObjectTimeout > 0 {
+		return context.WithTimeout(ctx, s.cfg.ObjectTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// uploadedAttrs looks up key in gs just after uploading it, checking
+// again a few times if GS hasn't caught up yet and has no object or one of
+// a different size.
+func (s *syncer) uploadedAttrs(ctx context.Context, gs gsObjects, key string, size int64) (*storage.ObjectAttrs, error) {
+	backoff := uploadCheckDelay
+	for attempt := 1; ; attempt++ {
+		gsAttrs, err := gs.Attrs(ctx, key)
+		settled := err == nil && gsAttrs.Size == size
+		if settled || attempt == uploadCheckAttempts || (err != nil && err != storage.ErrObjectNotExist) {
+			return gsAttrs, err
+		}
+		s.log.Info(Event{Action: "recheck", Key: key}, "Upload of", key, "not visible yet, checking again in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// errUploadMismatch means the destination object doesn't match what was sent.
+var errUploadMismatch = errors.New("upload failed, destination object doesn't match")
+
+// errDownloadMismatch means what was read from the source doesn't match
+// the size or checksum it reported.
+var errDownloadMismatch = errors.New("download failed, content doesn't match the source")
+
+// retry calls fn until it succeeds, fails with an error that isn't worth
+// retrying or has been retried Config.MaxRetries times, backing off
+// exponentially with jitter between attempts. Each attempt at an object
+// starts over from its download, so a bad download isn't uploaded again.
+func (s *syncer) retry(name string, fn func() error) error {
+	backoff := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > s.cfg.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		s.log.Error(Event{Action: "retry", Key: name, Attempt: attempt, Err: err},
+			name, "failed on attempt", attempt, "of", s.cfg.MaxRetries+1, "retrying in", sleep.Round(time.Millisecond).String()+":")
+		select {
+		case <-time.After(sleep):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+		if backoff < retryMaxDelay {
+			backoff *= 2
+		}
+	}
+}
+
+// isNotFound reports whether err is S3 saying an object doesn't exist.
+func isNotFound(err error) bool {
+	var awsErr awserr.RequestFailure
+	return errors.As(err, &awsErr) && awsErr.StatusCode() == http.StatusNotFound
+}
+
+// isRetryable reports whether err is transient: a network error, a 5xx,
+// throttling, an attempt that hit Config.ObjectTimeout or a botched
+// download or upload.
+// Anything else, such as a 403 or 404, won't get better by trying again.
+func isRetryable(err error) bool {
+	if errors.Is(err, errUploadMismatch) || errors.Is(err, errDownloadMismatch) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	var awsErr awserr.RequestFailure
+	if errors.As(err, &awsErr) {
+		return awsErr.StatusCode() >= 500
+	}
+	var gsErr *googleapi.Error
+	if errors.As(err, &gsErr) {
+		return gsErr.Code >= 500 || gsErr.Code == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isPreconditionFailed reports whether err is GS refusing an upload
+// because the object changed since it was compared.
+func isPreconditionFailed(err error) bool {
+	var gsErr *googleapi.Error
+	return errors.As(err, &gsErr) && gsErr.Code == http.StatusPreconditionFailed
+}
+
+// skipChanged skips version of key, whose copy in d another runner
+// changed while it was being transferred. The new copy is compared again, to skip
+// it as in sync if it is.
+func (s *syncer) skipChanged(ctx context.Context, key *s3.Object, version string, d *destination) error {
+	name := versionedName(*key.Key, version)
+	gsAttrs, err := d.gs.Attrs(ctx, name)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return s.inBucket(d, fmt.Errorf("looking up in GS after it changed: %w", err))
+	}
+	reason := reasonChanged
+	if err == nil {
+		if r := s.skipReason(ctx, *key.Key, version, *key.ETag, *key.Size, gsAttrs); r != "" {
+			reason = r
+		}
+	}
+	s.log.Info(Event{Action: "skip", Key: name}, skipMessage(reason, d.label), s.logName(d, name))
+	s.countSkip(reason)
+	s.record(ctx, reportEntry{Key: name, Bucket: s.reportBucket(d), Action: "skip", Reason: reason, Size: *key.Size, Checksum: *key.ETag})
+	return nil
+}
+
+// contentMatches downloads key from S3 and reports whether its checksum
+// matches the one GS has for it.
+func (s *syncer) contentMatches(ctx context.Context, key, version string, gsAttrs *storage.ObjectAttrs) bool {
+	if len(gsAttrs.MD5) == 0 && !s.useCRC32C(gsAttrs) {
+		return false
+	}
+	s3Object, err := s.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Key:       aws.String(key),
+		VersionId: optionalString(version),
+	})
+	if err != nil {
+		s.log.Error(Event{Action: "error", Key: key, Err: err}, "Failed to get object", key)
+		return false
+	}
+	defer s3Object.Body.Close()
+
+	hasher := newContentHash()
+	if _, err := io.Copy(hasher, s.throttle(s3Object.Body)); err != nil {
+		s.log.Error(Event{Action: "error", Key: key, Err: err}, "Failed to hash object", key)
+		return false
+	}
+	matched, _ := hasher.matches(gsAttrs, s.useCRC32C(gsAttrs))
+	return matched
+}
+
+// task is one object to sync. A comparison worker runs compare with the
+// context of the object's span, and a transfer worker the transfer it
+// returns, unless that's nil because there's nothing to transfer.
+type task struct {
+	key     string
+	size    int64 // 0 if not known until the comparison looks it up
+	compare func(ctx context.Context) (transfer func(worker int) error, err error)
+}
+
+// transferQueueSize is how many compared objects can wait for a
+// transfer worker before the comparison workers wait too.
+const transferQueueSize = 1000
+
+// queuedTransfer is a task whose comparison found it needs transferring,
+// waiting for a transfer worker.
+type queuedTransfer struct {
+	task
+	ctx      context.Context
+	span     trace.Span
+	transfer func(worker int) error
+}
+
+// finishTask ends t, which failed with err if it's not nil, and its
+// span, which ctx carries.
+func (s *syncer) finishTask(ctx context.Context, t task, span trace.Span, err error) {
+	if err != nil {
+		s.log.Error(Event{Action: "failed", Key: t.key, Err: err}, "Failed to sync", t.key)
+		s.addFailure(t.key, err)
+		s.record(ctx, reportEntry{Key: t.key, Action: "failed", Size: t.size, Error: err.Error()})
+		if s.cfg.FailFast {
+			s.stopListing()
+		}
+	}
+	endSpan(span, err)
+	atomic.AddInt64(&s.numDone, 1)
+}
+
+// listS3 lists the objects under Config.S3Prefix one page at a time,
+// sending each to tasks, until the listing ends or stopListing is called.
+// It returns how many objects were listed.
+func (s *syncer) listS3(tasks chan<- task) (int, error) {
+	var numObjects int
+	err := s.listS3Prefix(tasks, s.cfg.S3Prefix, "", &numObjects)
+	return numObjects, err
+}
+
+// listS3Prefix is listS3 for the objects under prefix, or with delimiter
+// only those not under a further delimiter, adding those listed to
+// numObjects. It is safe to run several at once, for listShards.
+func (s *syncer) listS3Prefix(tasks chan<- task, prefix, delimiter string, numObjects *int) error {
+	s3ListInput := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.cfg.S3Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: optionalString(delimiter),
+	}
+	for {
+		select {
+		case <-s.stop:
+			return nil
+		default:
+		}
+
+		s3List, err := s.s3Client.ListObjectsV2WithContext(s.ctx, s3ListInput)
+		if err != nil {
+			return err
+		}
+		if done := s.listS3Page(tasks, s3List.Contents, numObjects); done || !aws.BoolValue(s3List.IsTruncated) {
+			return nil
+		}
+		s3ListInput.ContinuationToken = s3List.NextContinuationToken
+	}
+}
+
+// listS3Page filters a page of the S3 listing and sends what's left to
+// tasks, reporting whether the listing should stop. The page is handled
+// under listMu, as the listing counts and Config.MaxObjects are shared by
+// every shard.
+func (s *syncer) listS3Page(tasks chan<- task, page []*s3.Object, numObjects *int) (done bool) {
+	s.listMu.Lock()
+	defer s.listMu.Unlock()
+	for _, key := range page {
+		key := key
+		if !s.included(*key.Key) {
+			s.leaveOut(&s.numFiltered, reasonFiltered, *key.Key, *key.Size)
+			continue
+		}
+		if s.cfg.Delete || s.cfg.DiffReport != "" {
+			s.sourceKeys[*key.Key] = true
+		}
+		if !s.sizeInRange(*key.Size) {
+			s.leaveOut(&s.numOutOfRange, reasonOutOfRange, *key.Key, *key.Size)
+			continue
+		}
+		if !s.modifiedInRange(aws.TimeValue(key.LastModified)) {
+			s.leaveOut(&s.numTooOld, reasonTooOld, *key.Key, *key.Size)
+			continue
+		}
+		if s.cfg.SkipFolders && isFolder(*key.Key, *key.Size) {
+			s.leaveOut(&s.numFolders, reasonFolder, *key.Key, *key.Size)
+			continue
+		}
+		if s.listLimitReached(*numObjects) {
+			s.moreRemain = true
+			return true
+		}
+		if s.cfg.List != nil {
+			s.cfg.List(listed(key))
+			*numObjects++
+			continue
+		}
+		compare := func(ctx context.Context) (func(worker int) error, error) { return s.syncObject(ctx, key, "") }
+		if s.cfg.Verify {
+			compare = func(ctx context.Context) (func(worker int) error, error) { return s.verifyObject(ctx, key) }
+		} else if s.cfg.DiffReport != "" {
+			compare = func(context.Context) (func(worker int) error, error) { return s.diffObject(key) }
+		}
+		select {
+		case tasks <- task{*key.Key, *key.Size, compare}:
+			*numObjects++
+		case <-s.stop:
+			return true
+		}
+	}
+	return false
+}
+
+// listS3Versions is listS3 for every version of the objects under
+// Config.S3Prefix, for Config.AllVersions. Delete markers are left out.
+func (s *syncer) listS3Versions(tasks chan<- task) (int, error) {
+	numObjects := 0
+	s3ListInput := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.cfg.S3Bucket),
+		Prefix: aws.String(s.cfg.S3Prefix),
+	}
+	for {
+		select {
+		case <-s.stop:
+			return numObjects, nil
+		default:
+		}
+
+		s3List, err := s.s3Client.ListObjectVersionsWithContext(s.ctx, s3ListInput)
+		if err != nil {
+			return numObjects, err
+		}
+
+		for _, v := range s3List.Versions {
+			version := aws.StringValue(v.VersionId)
+			key := &s3.Object{Key: v.Key, ETag: v.ETag, Size: v.Size, LastModified: v.LastModified, StorageClass: v.StorageClass}
+			name := versionedName(*key.Key, version)
+			if !s.included(*key.Key) {
+				s.leaveOut(&s.numFiltered, reasonFiltered, name, *key.Size)
+				continue
+			}
+			if s.cfg.Delete {
+				s.sourceKeys[name] = true
+			}
+			if !s.sizeInRange(*key.Size) {
+				s.leaveOut(&s.numOutOfRange, reasonOutOfRange, name, *key.Size)
+				continue
+			}
+			if !s.modifiedInRange(aws.TimeValue(key.LastModified)) {
+				s.leaveOut(&s.numTooOld, reasonTooOld, name, *key.Size)
+				continue
+			}
+			if s.cfg.SkipFolders && isFolder(*key.Key, *key.Size) {
+				s.leaveOut(&s.numFolders, reasonFolder, name, *key.Size)
+				continue
+			}
+			if s.listLimitReached(numObjects) {
+				s.moreRemain = true
+				return numObjects, nil
+			}
+			compare := func(ctx context.Context) (func(worker int) error, error) { return s.syncObject(ctx, key, version) }
+			select {
+			case tasks <- task{name, *key.Size, compare}:
+				numObjects++
+			case <-s.stop:
+				return numObjects, nil
+			}
+		}
+
+		if !aws.BoolValue(s3List.IsTruncated) {
+			return numObjects, nil
+		}
+		s3ListInput.KeyMarker = s3List.NextKeyMarker
+		s3ListInput.VersionIdMarker = s3List.NextVersionIdMarker
+	}
+}
+
+// versionedName is the GS name of version of key: key@version, or just
+// key if version is empty.
+func versionedName(key, version string) string {
+	if version == "" {
+		return key
+	}
+	return key + "@" + version
+}
+
+// listGS is listS3 for the objects under Config.S3Prefix in
+// Config.GSBucket.
+func (s *syncer) listGS(tasks chan<- task) (int, error) {
+	numObjects := 0
+	it := s.gs.Objects(s.ctx, &storage.Query{Prefix: s.cfg.S3Prefix})
+	for {
+		select {
+		case <-s.stop:
+			return numObjects, nil
+		default:
+		}
+
+		gsAttrs, err := it.Next()
+		if err == iterator.Done {
+			return numObjects, nil
+		}
+		if err != nil {
+			return numObjects, err
+		}
+
+		if !s.included(gsAttrs.Name) {
+			s.leaveOut(&s.numFiltered, reasonFiltered, gsAttrs.Name, gsAttrs.Size)
+			continue
+		}
+		if s.cfg.Delete {
+			s.sourceKeys[gsAttrs.Name] = true
+		}
+		if !s.sizeInRange(gsAttrs.Size) {
+			s.leaveOut(&s.numOutOfRange, reasonOutOfRange, gsAttrs.Name, gsAttrs.Size)
+			continue
+		}
+		if !s.modifiedInRange(gsAttrs.Updated) {
+			s.leaveOut(&s.numTooOld, reasonTooOld, gsAttrs.Name, gsAttrs.Size)
+			continue
+		}
+		if s.cfg.SkipFolders && isFolder(gsAttrs.Name, gsAttrs.Size) {
+			s.leaveOut(&s.numFolders, reasonFolder, gsAttrs.Name, gsAttrs.Size)
+			continue
+		}
+		if s.listLimitReached(numObjects) {
+			s.moreRemain = true
+			return numObjects, nil
+		}
+
+		select {
+		case tasks <- task{gsAttrs.Name, gsAttrs.Size, func(ctx context.Context) (func(worker int) error, error) { return s.syncObjectToS3(ctx, gsAttrs) }}:
+			numObjects++
+		case <-s.stop:
+			return numObjects, nil
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var modified = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestSyncCopiesThenSkips(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "alpha", modified)
+	src.put("dir/b.txt", "bravo", modified)
+
+	result := mustSync(t, Config{}, src, dst)
+	if result.Transferred != 2 {
+		t.Fatalf("first run transferred %d objects, want 2", result.Transferred)
+	}
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		o := dst.get(name)
+		if o == nil {
+			t.Fatalf("%s wasn't copied", name)
+		}
+		if got, want := string(o.data), string(src.objects[name].data); got != want {
+			t.Errorf("%s is %q in GS, want %q", name, got, want)
+		}
+	}
+
+	result = mustSync(t, Config{}, src, dst)
+	if result.Transferred != 0 || result.Skipped.InSync != 2 {
+		t.Errorf("second run transferred %d and skipped %d in sync, want 0 and 2", result.Transferred, result.Skipped.InSync)
+	}
+}
+
+func TestSyncRecopiesChanged(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "alpha", modified)
+	dst.put("a.txt", "old", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{}, src, dst)
+	if result.Transferred != 1 {
+		t.Fatalf("transferred %d objects, want 1", result.Transferred)
+	}
+	if got := string(dst.get("a.txt").data); got != "alpha" {
+		t.Errorf("a.txt is %q in GS, want %q", got, "alpha")
+	}
+}
+
+func TestSyncDryRunWritesNothing(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("new.txt", "new", modified)
+	src.put("changed.txt", "changed", modified)
+	dst.put("changed.txt", "old", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{DryRun: true, DeleteSource: true}, src, dst)
+	if result.Transferred != 2 {
+		t.Errorf("dry run would transfer %d objects, want 2", result.Transferred)
+	}
+	if dst.writes != 0 {
+		t.Errorf("dry run wrote %d objects to GS", dst.writes)
+	}
+	if got := string(dst.get("changed.txt").data); got != "old" {
+		t.Errorf("dry run changed changed.txt to %q", got)
+	}
+	if len(src.deleted) != 0 || len(src.objects) != 2 {
+		t.Errorf("dry run deleted %v from S3", src.deleted)
+	}
+	if result.SourceDeleted != 0 || result.SourceWouldDelete != 2 {
+		t.Errorf("dry run counted %d sources deleted and %d that would be, want 0 and 2", result.SourceDeleted, result.SourceWouldDelete)
+	}
+	for _, total := range result.Totals() {
+		if total.Name == "Sources deleted" {
+			t.Errorf("dry run summary has %d sources deleted", total.Value)
+		}
+	}
+}
+
+func TestSyncDeleteSource(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("moved.txt", "moved", modified)
+	src.put("in-sync.txt", "in sync", modified)
+	dst.put("in-sync.txt", "in sync", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{DeleteSource: true}, src, dst)
+	if result.SourceDeleted != 1 || result.SourceWouldDelete != 0 {
+		t.Errorf("counted %d sources deleted and %d that would be, want 1 and 0", result.SourceDeleted, result.SourceWouldDelete)
+	}
+	if len(src.deleted) != 1 || src.deleted[0] != "moved.txt" {
+		t.Errorf("deleted %v from S3, want just moved.txt", src.deleted)
+	}
+}
+
+func TestSyncMultipartETag(t *testing.T) {
+	for _, tc := range []struct {
+		fallback    string
+		transferred uint64
+	}{
+		{"size", 0},
+		{"hash", 0},
+		{"transfer", 1},
+	} {
+		t.Run(tc.fallback, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("big.bin", "multipart content", modified).etag = multipartETag("multipart content", 3)
+			dst.put("big.bin", "multipart content", storage.ObjectAttrs{})
+
+			result := mustSync(t, Config{MultipartFallback: tc.fallback}, src, dst)
+			if result.Transferred != tc.transferred {
+				t.Errorf("transferred %d objects, want %d", result.Transferred, tc.transferred)
+			}
+		})
+	}
+}
+
+func TestSyncMultipartETagDifferentContent(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("big.bin", "multipart content", modified).etag = multipartETag("multipart content", 3)
+	dst.put("big.bin", "different content", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{MultipartFallback: "hash"}, src, dst)
+	if result.Transferred != 1 {
+		t.Errorf("transferred %d objects, want the one whose content differs", result.Transferred)
+	}
+}
+
+func TestSyncDownloadError(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "alpha", modified)
+	src.getErr = errors.New("access denied")
+
+	result, err := runSync(t, Config{}, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 1 || len(result.Failures) != 1 || result.Failures[0].Key != "a.txt" {
+		t.Fatalf("got %d failures %v, want a.txt", result.Failed, result.Failures)
+	}
+	if !errors.Is(result.Failures[0].Err, src.getErr) {
+		t.Errorf("failed with %v, want %v", result.Failures[0].Err, src.getErr)
+	}
+	if names := dst.names(); len(names) != 0 {
+		t.Errorf("left %v in GS", names)
+	}
+}
+
+func TestSyncGSListingError(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "alpha", modified)
+	dst.put("a.txt", "alpha", storage.ObjectAttrs{})
+	dst.attrsErr = errors.New("forbidden")
+
+	result, err := runSync(t, Config{DisableDestinationListing: true}, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 1 || result.Transferred != 0 {
+		t.Errorf("failed %d and transferred %d, want the object failed, not overwritten", result.Failed, result.Transferred)
+	}
+}
+
+func TestSyncConflictNewer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		gsUpdated   time.Time
+		transferred uint64
+	}{
+		{"GS newer is kept", modified.Add(time.Hour), 0},
+		{"S3 newer is copied", modified.Add(-time.Hour), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("a.txt", "from S3", modified)
+			dst.put("a.txt", "from GS", storage.ObjectAttrs{Updated: tc.gsUpdated})
+
+			result := mustSync(t, Config{Conflict: "newer"}, src, dst)
+			if result.Transferred != tc.transferred {
+				t.Errorf("transferred %d objects, want %d", result.Transferred, tc.transferred)
+			}
+			if tc.transferred == 0 && string(dst.get("a.txt").data) != "from GS" {
+				t.Error("the newer GS copy was overwritten")
+			}
+		})
+	}
+}
+
+func TestSyncConflictNewerRecordedSource(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		recorded    time.Time // x-source-last-modified of the GS copy
+		gsUpdated   time.Time
+		transferred uint64
+	}{
+		// The GS copy was uploaded after S3 changed, from an older source
+		{"S3 changed since the recorded source", modified.Add(-time.Hour), modified.Add(time.Hour), 1},
+		// The GS copy was uploaded long ago, from this very source
+		{"recorded source is S3's", modified, modified.Add(-time.Hour), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("a.txt", "from S3", modified)
+			dst.put("a.txt", "from GS", storage.ObjectAttrs{
+				Updated:  tc.gsUpdated,
+				Metadata: map[string]string{sourceLastModifiedKey: tc.recorded.Format(time.RFC3339)},
+			})
+
+			result := mustSync(t, Config{Conflict: "newer"}, src, dst)
+			if result.Transferred != tc.transferred {
+				t.Errorf("transferred %d objects, want %d", result.Transferred, tc.transferred)
+			}
+		})
+	}
+}
+
+func TestSyncConflictNewerRerun(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "first", modified)
+	cfg := Config{Conflict: "newer"}
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Fatalf("first run transferred %d objects, want 1", result.Transferred)
+	}
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 0 || result.Skipped.NotNewer != 1 {
+		t.Errorf("rerun transferred %d and skipped %d not newer, want 0 and 1", result.Transferred, result.Skipped.NotNewer)
+	}
+
+	// Modified in S3 since, though still before the GS copy was uploaded
+	src.put("a.txt", "second", modified.Add(time.Minute))
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Errorf("run after a change transferred %d objects, want 1", result.Transferred)
+	}
+}
+
+func TestSyncCompressedCopySkippedOnRerun(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("log.txt", strings.Repeat("compressible ", 100), modified)
+	cfg := Config{Compress: true}
+
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Fatalf("first run transferred %d objects, want 1", result.Transferred)
+	}
+	if !isCompressedCopy(&dst.get("log.txt").attrs) {
+		t.Fatalf("GS copy isn't compressed: %+v", dst.get("log.txt").attrs)
+	}
+	result := mustSync(t, cfg, src, dst)
+	if result.Transferred != 0 || result.Skipped.StoredHash != 1 {
+		t.Errorf("rerun transferred %d and skipped %d by stored hash, want 0 and 1", result.Transferred, result.Skipped.StoredHash)
+	}
+
+	// A change in S3 is still copied
+	src.put("log.txt", strings.Repeat("changed ", 100), modified)
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Errorf("run after a change transferred %d objects, want 1", result.Transferred)
+	}
+}
+
+func TestSyncStoredSourceMD5(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	const data = "uploaded in parts"
+	src.put("big.bin", data, modified).etag = multipartETag(data, 2)
+	// Without the stored hash a multipart object would be copied again
+	cfg := Config{StoreSourceMD5: true, MultipartFallback: "transfer"}
+
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Fatalf("first run transferred %d objects, want 1", result.Transferred)
+	}
+	if got := dst.get("big.bin").attrs.Metadata[sourceMD5Key]; got != md5Hex(data) {
+		t.Fatalf("stored MD5 %q, want %q", got, md5Hex(data))
+	}
+	result := mustSync(t, cfg, src, dst)
+	if result.Transferred != 0 || result.Skipped.StoredHash != 1 {
+		t.Errorf("rerun transferred %d and skipped %d by stored hash, want 0 and 1", result.Transferred, result.Skipped.StoredHash)
+	}
+
+	// A new upload to S3 has a new ETag, whatever the stored hash says
+	src.put("big.bin", data, modified).etag = multipartETag(data+" again", 2)
+	if result := mustSync(t, cfg, src, dst); result.Transferred != 1 {
+		t.Errorf("run after a new upload transferred %d objects, want 1", result.Transferred)
+	}
+}
+
+func TestSyncDecision(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		gs       string // the GS copy, none if empty
+		dryRun   bool
+		transfer bool
+	}{
+		{name: "missing", transfer: true},
+		{name: "missing, dry run", dryRun: true, transfer: true},
+		{name: "same hash and size", gs: "alpha"},
+		{name: "same hash and size, dry run", gs: "alpha", dryRun: true},
+		{name: "hash differs", gs: "alpah", transfer: true},
+		{name: "hash differs, dry run", gs: "alpah", dryRun: true, transfer: true},
+		{name: "size differs", gs: "alphabet", transfer: true},
+		{name: "size differs, dry run", gs: "alphabet", dryRun: true, transfer: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			src.put("key", "alpha", modified)
+			if tc.gs != "" {
+				dst.put("key", tc.gs, storage.ObjectAttrs{})
+			}
+
+			result := mustSync(t, Config{DryRun: tc.dryRun}, src, dst)
+			var transferred, inSync uint64
+			if tc.transfer {
+				transferred = 1
+			} else {
+				inSync = 1
+			}
+			if result.Transferred != transferred || result.Skipped.InSync != inSync {
+				t.Errorf("transferred %d and skipped %d, want %d and %d", result.Transferred, result.Skipped.InSync, transferred, inSync)
+			}
+			want := tc.gs
+			if tc.transfer && !tc.dryRun {
+				want = "alpha"
+			}
+			switch o := dst.get("key"); {
+			case o == nil && want != "":
+				t.Errorf("nothing in GS, want %q", want)
+			case o != nil && string(o.data) != want:
+				t.Errorf("%q in GS, want %q", o.data, want)
+			}
+		})
+	}
+}
+
+func TestWriteToGSFailureLeavesNothing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		writeErr error
+		closeErr error
+		checkErr error
+	}{
+		{name: "write fails", writeErr: errors.New("connection reset")},
+		{name: "source changed", checkErr: errors.New("source changed")},
+		// GS committing the upload though closing it failed
+		{name: "close fails", closeErr: errors.New("response lost")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := newFakeGS()
+			dst.writeErr, dst.closeErr = tc.writeErr, tc.closeErr
+			s := newTestSyncer(t, Config{}, newFakeS3(), dst)
+			tgt := &target{destination: s.dests[0]}
+			check := func() error { return tc.checkErr }
+
+			_, err := s.writeToGS(s.ctx, "key", []*target{tgt}, strings.NewReader("content"), sourceAttrs{size: 7}, check)
+			if err == nil {
+				t.Fatal("writeToGS succeeded")
+			}
+			if names := dst.names(); len(names) != 0 {
+				t.Errorf("left %v in GS", names)
+			}
+			if tgt.uploaded {
+				t.Error("the target was marked uploaded")
+			}
+		})
+	}
+}
+
+func TestWriteToGSFailureKeepsOldCopy(t *testing.T) {
+	dst := newFakeGS()
+	old := dst.put("key", "old", storage.ObjectAttrs{})
+	dst.writeErr = errors.New("connection reset")
+	s := newTestSyncer(t, Config{}, newFakeS3(), dst)
+	tgt := &target{destination: s.dests[0], generation: old.Generation}
+
+	if _, err := s.writeToGS(s.ctx, "key", []*target{tgt}, strings.NewReader("new"), sourceAttrs{size: 3}, func() error { return nil }); err == nil {
+		t.Fatal("writeToGS succeeded")
+	}
+	o := dst.get("key")
+	if o == nil || string(o.data) != "old" || o.attrs.Generation != old.Generation {
+		t.Errorf("the old copy wasn't left as it was: %+v", o)
+	}
+}
+
+func TestWriteToGSGzipRoundTrip(t *testing.T) {
+	dst := newFakeGS()
+	s := newTestSyncer(t, Config{Compress: true}, newFakeS3(), dst)
+	content := strings.Repeat("compressible text\n", 1000)
+	src := sourceAttrs{size: int64(len(content)), etag: md5Hex(content), contentType: "text/plain"}
+
+	compressed, err := s.writeToGS(s.ctx, "log.txt", []*target{{destination: s.dests[0]}}, strings.NewReader(content), src, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := dst.get("log.txt")
+	if o.attrs.ContentEncoding != "gzip" || o.attrs.ContentType != "text/plain" {
+		t.Errorf("stored with encoding %q and type %q, want gzip and text/plain", o.attrs.ContentEncoding, o.attrs.ContentType)
+	}
+	if o.attrs.Size >= src.size {
+		t.Errorf("stored %d bytes of %d", o.attrs.Size, src.size)
+	}
+	if compressed == nil || compressed.size != o.attrs.Size || !bytes.Equal(compressed.md5.Sum(nil), o.attrs.MD5) {
+		t.Errorf("the hash of what was sent doesn't match what GS stored")
+	}
+	if !isCompressedCopy(&o.attrs) || !compressedCopyMatches(src.etag, src.size, &o.attrs) {
+		t.Errorf("the copy doesn't record its source: %v", o.attrs.Metadata)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(o.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("decompressed %d bytes that don't match the %d sent", len(got), len(content))
+	}
+}
+
+func TestLocalPathFlattenSharedBasename(t *testing.T) {
+	for _, flatten := range []bool{false, true} {
+		s := newTestSyncer(t, Config{UseDisk: true, LocalDir: "/staging", Flatten: flatten}, newFakeS3(), newFakeGS())
+		a, b := s.localPath(0, "a/data.csv"), s.localPath(0, "b/data.csv")
+		if a == b {
+			t.Errorf("flatten %v: a/data.csv and b/data.csv are both staged at %s", flatten, a)
+		}
+		for _, p := range []string{a, b, s.localPath(0, "../../etc/data.csv")} {
+			if !strings.HasPrefix(p, filepath.Join("/staging", "worker-0")+string(filepath.Separator)) {
+				t.Errorf("flatten %v: staged outside the worker's dir at %s", flatten, p)
+			}
+			if flatten && filepath.Dir(p) != filepath.Join("/staging", "worker-0") {
+				t.Errorf("flatten: staged in a subdirectory at %s", p)
+			}
+		}
+	}
+}
+
+func TestSyncFlattenSharedBasename(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a/data.csv", "from a", modified)
+	src.put("b/data.csv", "from b", modified)
+
+	result := mustSync(t, Config{UseDisk: true, LocalDir: t.TempDir(), Flatten: true}, src, dst)
+	if result.Transferred != 2 {
+		t.Fatalf("transferred %d objects, want 2", result.Transferred)
+	}
+	for _, name := range []string{"a/data.csv", "b/data.csv"} {
+		if got, want := string(dst.get(name).data), string(src.objects[name].data); got != want {
+			t.Errorf("%s is %q in GS, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSyncMissingIsAbsent(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a.txt", "alpha", modified)
+
+	// Without the listing each object is looked up, and GS has none
+	for _, cfg := range []Config{{DisableDestinationListing: true}, {DisableDestinationListing: true, GSPrefix: "copy/"}} {
+		result := mustSync(t, cfg, src, dst)
+		if result.Transferred != 1 {
+			t.Errorf("GS prefix %q: transferred %d objects, want the missing one", cfg.GSPrefix, result.Transferred)
+		}
+	}
+	if names := dst.names(); len(names) != 2 {
+		t.Errorf("GS has %v, want a.txt and copy/a.txt", names)
+	}
+}
+
+func TestSyncToS3MissingIsAbsent(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	dst.put("a.txt", "alpha", storage.ObjectAttrs{})
+
+	result := mustSync(t, Config{Direction: GSToS3}, src, dst)
+	if result.Transferred != 1 {
+		t.Errorf("transferred %d objects, want the one missing from S3", result.Transferred)
+	}
+	if o := src.objects["a.txt"]; o == nil || string(o.data) != "alpha" {
+		t.Errorf("S3 has %+v, want a.txt copied", o)
+	}
+}
+
+func TestSyncEmptyAndFolderKeys(t *testing.T) {
+	for _, useDisk := range []bool{false, true} {
+		t.Run(fmt.Sprintf("useDisk %v", useDisk), func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			// SSE-KMS gives even empty objects an ETag that isn't their MD5
+			empty := src.put("empty", "", modified)
+			empty.etag, empty.sse = md5Hex("not the content"), s3.ServerSideEncryptionAwsKms
+			src.put("dir/", "", modified)
+			src.put("dir/a.txt", "a", modified)
+			src.put("odd/", "not a folder", modified)
+			cfg := Config{UseDisk: useDisk}
+			if useDisk {
+				cfg.LocalDir = t.TempDir()
+			}
+
+			if result := mustSync(t, cfg, src, dst); result.Transferred != 4 {
+				t.Fatalf("transferred %d objects, want 4", result.Transferred)
+			}
+			for _, name := range []string{"empty", "dir/"} {
+				o := dst.get(name)
+				if o == nil || len(o.data) != 0 || o.attrs.ContentType != "application/octet-stream" {
+					t.Errorf("%s is %+v in GS, want empty and application/octet-stream", name, o)
+				}
+			}
+			if result := mustSync(t, cfg, src, dst); result.Transferred != 0 || result.Skipped.InSync != 4 {
+				t.Errorf("rerun transferred %d and skipped %d in sync, want 0 and 4", result.Transferred, result.Skipped.InSync)
+			}
+		})
+	}
+}
+
+func TestSyncSkipFolders(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("dir/", "", modified)
+	src.put("dir/a.txt", "a", modified)
+	src.put("odd/", "not a folder", modified)
+	src.put("empty", "", modified)
+
+	result := mustSync(t, Config{SkipFolders: true}, src, dst)
+	if result.Folders != 1 || result.Transferred != 3 {
+		t.Errorf("left out %d folders and transferred %d, want 1 and 3", result.Folders, result.Transferred)
+	}
+	if dst.get("dir/") != nil {
+		t.Error("the folder placeholder was copied")
+	}
+}
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter shared by all the readers and writers it
+// wraps. It allows bursts of up to one second's worth of bytes.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // negative when callers are waiting
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond uint64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens and sleeps until the bucket has paid them back.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// maxThrottleChunk caps each read or write so that one large buffer can't
+// hog the bucket.
+const maxThrottleChunk = 32 * 1024
+
+type throttledReader struct {
+	r io.Reader
+	b *tokenBucket
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottleChunk {
+		p = p[:maxThrottleChunk]
+	}
+	n, err := t.r.Read(p)
+	t.b.wait(n)
+	return n, err
+}
+
+type throttledWriterAt struct {
+	w io.WriterAt
+	b *tokenBucket
+}
+
+func (t throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	t.b.wait(len(p))
+	return t.w.WriteAt(p, off)
+}
+
+// throttle limits r, which feeds an upload, to Config.BandwidthLimit and
+// counts what's read from it for Progress.
+func (s *syncer) throttle(r io.Reader) io.Reader {
+	r = countingReader{r, &s.bytesSent}
+	if s.bandwidth == nil {
+		return r
+	}
+	return throttledReader{r, s.bandwidth}
+}
+
+// throttleWriterAt limits w to Config.BandwidthLimit.
+func (s *syncer) throttleWriterAt(w io.WriterAt) io.WriterAt {
+	if s.bandwidth == nil {
+		return w
+	}
+	return throttledWriterAt{w, s.bandwidth}
+}
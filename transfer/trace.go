@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/context"
+)
+
+// tracerName is the instrumentation scope of the spans of a run.
+const tracerName = "github.com/julianvmodesto/S3toGS/transfer"
+
+// With Config.TracerProvider a run is traced as a root span "run" for
+// each Transfer or pass of Watch, a child "object" for each object
+// synced, tagged with its key, size and outcome, and under that
+// "download", "upload" and "verify" for the steps of its transfer. Each
+// span travels in the context of the requests made under it, so the AWS
+// and GS requests are traced beneath it.
+
+// newTracer is the tracer of provider, or one that records nothing if
+// provider is nil.
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startSpan starts a span named name under the span in ctx, returning it
+// and ctx carrying it.
+func (s *syncer) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, as failed if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
+
+// record adds entry to the report and tags the span of its object, in
+// ctx, with the outcome, so every outcome the report sees is traced too.
+func (s *syncer) record(ctx context.Context, entry reportEntry) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("outcome", entry.Action))
+	if entry.Reason != "" {
+		span.SetAttributes(attribute.String("reason", entry.Reason))
+	}
+	if entry.Size > 0 {
+		span.SetAttributes(attribute.Int64("size", entry.Size))
+	}
+	s.report.add(entry)
+}
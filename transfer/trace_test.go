@@ -0,0 +1,58 @@
+package transfer
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("a", "a", modified)
+	src.put("b", "b", modified)
+	mustSync(t, Config{TracerProvider: provider}, src, dst)
+
+	// The key of each object span
+	objects := make(map[trace.SpanID]string)
+	for _, span := range recorder.Ended() {
+		if span.Name() != "object" {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if attrs["outcome"] != "transferred" {
+			t.Errorf("object %s has outcome %q, want transferred", attrs["key"], attrs["outcome"])
+		}
+		objects[span.SpanContext().SpanID()] = attrs["key"]
+	}
+	if len(objects) != 2 {
+		t.Fatalf("got %d object spans, want 2", len(objects))
+	}
+
+	// Each step is traced once, under the span of its own object
+	steps := make(map[string]int)
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "download", "upload", "verify":
+			key, ok := objects[span.Parent().SpanID()]
+			if !ok {
+				t.Errorf("%s span isn't under an object span", span.Name())
+				continue
+			}
+			steps[key+" "+span.Name()]++
+		}
+	}
+	for _, key := range []string{"a", "b"} {
+		for _, step := range []string{"download", "upload", "verify"} {
+			if n := steps[key+" "+step]; n != 1 {
+				t.Errorf("got %d %s spans for %s, want 1", n, step, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,1041 @@
+// Package transfer syncs objects between an AWS S3 bucket and a GCP GS
+// bucket, streaming one object at a time per worker.
+package transfer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Directions for Config.Direction
+const (
+	S3ToGS = "s3-to-gs"
+	GSToS3 = "gs-to-s3"
+)
+
+// Config describes a sync. The zero value of each field is the default
+// unless noted, so only the buckets are required.
+type Config struct {
+	Direction   string // S3ToGS (the default) or GSToS3
+	S3Bucket    string
+	S3Prefix    string // key prefix to sync
+	GSBucket    string
+	GSPrefix    string // put before each key to make its GS name
+	StripPrefix bool   // take S3Prefix off each key before adding GSPrefix
+
+	// ExtraPrefixes are more prefixes of S3Bucket to sync in the same
+	// run after S3Prefix, each listed, compared and deleted from as
+	// S3Prefix would be on its own, and counted in the one Result. None
+	// may overlap another or S3Prefix. They only work with a listing of
+	// S3, or of GS with GSToS3, not KeysFile, SQSQueueURL,
+	// InventoryManifest, S3VersionID or UploadOnly.
+	ExtraPrefixes []Prefix
+
+	// ExtraGSBuckets are more buckets to copy each object to from S3 as
+	// well as GSBucket, under the same names. Each object is downloaded
+	// once and streamed to every bucket it's missing from or differs in,
+	// and the totals count each copy. It only works for a sync, not with
+	// Verify, Delete or Plan.
+	ExtraGSBuckets []string
+
+	// KeyRegex, if set, rewrites each key into its GS name with
+	// regexp.ReplaceAllString(key, KeyReplace) before StripPrefix and
+	// GSPrefix apply. Keys it doesn't match are left alone. GS can't be
+	// listed by the rewritten names, so it rules out GSToS3 and Delete and
+	// each key is looked up in GS.
+	KeyRegex      string
+	KeyReplace    string
+	GSUserProject string // project billed for GS requests, for Requester Pays buckets
+
+	// GCPCredentialsFile is a service account key file for GS, used
+	// instead of Application Default Credentials.
+	GCPCredentialsFile string
+	AWSProfile         string // shared credentials profile; the default credential chain if empty
+	AWSRegion          string // region of S3Bucket; detected if empty
+	AWSRoleARN         string // role to assume for all S3 requests, with the credentials above
+	AWSExternalID      string // external ID the role's trust policy requires, if any
+
+	// S3SSECustomerKey is the key, 32 raw bytes for AES256, that the S3
+	// objects are encrypted with by SSE-C, sent with every read of them.
+	// S3SSECustomerAlgorithm is AES256 if empty.
+	S3SSECustomerKey       string
+	S3SSECustomerAlgorithm string
+
+	// S3RequesterPays is for buckets with Requester Pays: S3 refuses
+	// requests for them that don't agree to be billed, and with it the
+	// caller's account pays for each request and the data read.
+	S3RequesterPays bool
+
+	// For S3-compatible stores such as MinIO, Ceph RGW or Wasabi
+	S3Endpoint       string // URL of the S3 API; AWS's if empty
+	S3ForcePathStyle bool   // address buckets as endpoint/bucket rather than bucket.endpoint
+	S3DualStack      bool   // use AWS's dual-stack IPv4 and IPv6 endpoints, s3.dualstack.REGION.amazonaws.com
+
+	// ProxyURL is the HTTP proxy for every AWS and GS request, such as
+	// http://proxy:3128; the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables apply if empty.
+	ProxyURL string
+
+	// Which objects to sync
+	Includes          []string // only keys matching one of these globs
+	Excludes          []string // not keys matching one of these globs; wins over Includes
+	MinSize           uint64
+	MaxSize           uint64    // no limit if 0
+	ModifiedAfter     time.Time // only objects the source last modified after this; no limit if zero
+	MaxObjects        int       // no limit if 0
+	MaxObjectsCount   string    // what MaxObjects counts: "considered" (the default) or "transferred"
+	KeysFile          string    // file of keys to sync, one per line, instead of listing S3Prefix
+	InventoryManifest string    // s3://bucket/key of the manifest.json of a CSV, ORC or Parquet S3 Inventory report listing S3Bucket, to read instead of listing S3Prefix
+	SQSQueueURL       string    // sync the objects S3 event notifications on this queue announce, until stopped, instead of listing S3Prefix
+	ListShards        int       // list the S3 prefixes one segment below S3Prefix this many at a time; one listing if 0 or 1
+	SkipFolders       bool      // leave out listed folder placeholders: empty objects whose key ends in a slash
+
+	// S3 object versions, each stored in GS as key@versionId. S3VersionID
+	// syncs just that version of the key S3Prefix; AllVersions syncs every
+	// version of each object under S3Prefix rather than only the latest.
+	S3VersionID string
+	AllVersions bool
+
+	// How objects are compared. Conflict is what to do with an object
+	// already in the destination: "compare" (the default) skips it if
+	// CompareMode matches, "skip" always skips it, "overwrite" always
+	// transfers it and "newer" transfers it only if the source was
+	// modified after the destination.
+	Conflict                  string
+	CompareMode               string // what must match to skip an object: "size", "hash" or "both" (the default)
+	Checksum                  string // "md5" (the default), "crc32c" or "auto" (crc32c when GS has no md5)
+	MultipartFallback         string // how to compare multipart S3 objects: "size" (the default), "hash" or "transfer"
+	DisableDestinationListing bool   // look each key up in GS rather than listing it up front
+
+	// Attributes of uploaded objects
+	ContentType        string // the source object's if empty
+	CacheControl       string // the source object's if empty
+	ContentLanguage    string // the source object's if empty
+	ContentDisposition string // the source object's if empty
+	StorageClass       string // the bucket default if empty
+	KMSKey             string // Cloud KMS key name; the bucket default if empty
+	NoTranscode        bool   // stop GS decompressing gzip-encoded objects when serving them
+	CopyTags           bool   // copy S3 object tags to GS metadata named s3-tag-<tag>
+
+	// MimeTypes maps extensions such as .css to the content type of objects
+	// whose source has none or application/octet-stream, over a built-in
+	// map of web asset types, before falling back to sniffing their first
+	// bytes. Extensions are matched regardless of case.
+	MimeTypes map[string]string
+
+	// Compress gzips objects on their way to GS, storing them with
+	// Content-Encoding gzip and the source's ETag and size in their
+	// metadata to be compared by, as the stored bytes differ. Objects the
+	// source already encodes are left alone. CompressIncludes, globs of
+	// keys, and CompressTypes, globs of content types such as text/*,
+	// limit it to the objects matching either; with neither, every
+	// object.
+	Compress         bool
+	CompressIncludes []string
+	CompressTypes    []string
+
+	// StoreSourceMD5 records the MD5 of each object whose S3 ETag isn't
+	// one, such as a multipart upload, in its GS metadata, with the ETag.
+	// Later runs compare by it while the ETag is unchanged. It costs a
+	// request per such object.
+	StoreSourceMD5 bool
+
+	// ACLs of uploaded objects, unless the GS bucket has uniform
+	// bucket-level access. CopyACL gives each object the GS predefined ACL
+	// nearest its S3 ACL, at the cost of a request per object;
+	// PredefinedACL, e.g. "publicRead", is given to every object instead.
+	CopyACL       bool
+	PredefinedACL string
+	Metadata      map[string]string
+
+	DryRun bool
+	Plan   bool // with DryRun, return what would be done with each object in Result.Plan
+	Verify bool // only compare S3 with GS, transferring nothing
+	Repair bool // verify, transferring again the objects that differ
+	Delete bool // after syncing, delete destination objects that aren't in the source
+
+	// Objects in the GLACIER and DEEP_ARCHIVE storage classes can only be
+	// read once restored, and are otherwise skipped for a later run.
+	// RestoreDays requests a restored copy for that many days, at
+	// RestoreTier ("Standard", the default, "Bulk" or "Expedited"), and
+	// RestoreWait waits that long for it rather than moving on.
+	RestoreDays int
+	RestoreTier string
+	RestoreWait time.Duration
+
+	// DeleteSource deletes each S3 object once it has been transferred
+	// and the upload checked, making S3ToGS a move. Objects skipped as
+	// already in GS are left in S3.
+	DeleteSource bool
+
+	Concurrency int // objects to transfer at once; 1 if 0
+	// CompareConcurrency is how many objects are compared with the
+	// destination at once, ahead of the Concurrency transfers of those
+	// that need it; Concurrency if 0. Comparing is only metadata
+	// requests, so it can go much wider than transferring.
+	CompareConcurrency int
+	MaxRetries         int // times to retry an object after a transient error
+	AWSMaxRetries      int // times the AWS SDK retries each request, within each object attempt; its default if 0, none if negative
+	FailFast           bool
+	ObjectTimeout      time.Duration // limit on one attempt at transferring an object; none if 0
+	ConnectTimeout     time.Duration // limit on setting up the GS client; none if 0
+	BandwidthLimit     uint64        // bytes per second across all transfers; unlimited if 0
+
+	UseDisk             bool   // download each object to LocalDir before uploading instead of streaming
+	LocalDir            string // the system temp dir if empty, unless UploadOnly
+	Flatten             bool   // stage every object directly in LocalDir rather than under its key's directories
+	DownloadConcurrency int    // parts of one object to download at once with UseDisk
+	DownloadPartSize    int64  // at least 5MB; streamed objects are downloaded a part at a time
+
+	// FileMode and DirMode are the permissions of what's written locally:
+	// the files staged with UseDisk and the directories made for them,
+	// StateFile, ReportFile and DiffReport. They're 0600 and 0700 if 0,
+	// so other users of the host can't read what's staged. The umask
+	// still applies.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// UploadOnly uploads the files under LocalDir to GS instead, named by
+	// their paths relative to it, without touching S3. Each is compared
+	// with GS by its size and MD5 as an S3 object would be by its ETag.
+	UploadOnly bool
+
+	// GSChunkSize is how much of an object each request of a resumable
+	// GS upload sends, and so how much each upload buffers. A failed
+	// request only resends its chunk. It's rounded up to a multiple of
+	// 256KB; the GS default of 16MB if 0, or a single request for the
+	// whole object if negative.
+	GSChunkSize int
+
+	StateFile     string // records the objects found in sync, so a rerun can skip them
+	DisableResume bool   // start StateFile afresh rather than skipping what it records
+	ReportFile    string // gets a line of JSON for every object
+
+	// DiffReport, if set, makes Transfer only list S3Prefix and GS and
+	// compare them, from metadata alone, writing how each object compares
+	// to this file: identical, only-in-s3, only-in-gs, size-mismatch,
+	// checksum-mismatch, or unverified when the sizes match but there's
+	// no usable hash. It's CSV if the name ends in .csv and otherwise a
+	// line of JSON per object. Unlike Verify, it also finds the objects
+	// that are only in GS. Nothing is transferred or changed.
+	DiffReport string
+
+	// VerifyContent makes Verify download each object from S3 and read
+	// its GS copy, comparing the sizes, MD5s and CRC32Cs of the bytes
+	// themselves rather than trusting either side's metadata. It's
+	// costly, so VerifySample, from 0 to 1, is the fraction of objects
+	// picked at random to check that way, 1 if 0; the rest are verified
+	// by their metadata as usual.
+	VerifyContent bool
+	VerifySample  float64
+
+	// Stop, when closed, stops picking up new objects and lets the
+	// in-flight transfers finish. Cancelling the context passed to
+	// Transfer aborts them.
+	Stop <-chan struct{}
+
+	Logger  Logger  // a text StdLogger at info level if nil
+	Metrics Metrics // counts each object if set
+	// TracerProvider, if set, traces the run and each object, and the
+	// requests made for them.
+	TracerProvider trace.TracerProvider
+
+	// Progress, if set, is called with a snapshot of the run every
+	// ProgressInterval (a second if 0) and once more at the end.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+
+	// List, if set, makes Transfer only list S3Prefix, passing every
+	// object that gets through the filters to List in listing order, one
+	// call at a time. Nothing is compared or transferred, and GSBucket
+	// isn't needed.
+	List func(Listed)
+
+	keyRegex *regexp.Regexp // KeyRegex, compiled by withDefaults
+	proxyURL *url.URL       // ProxyURL, parsed by withDefaults
+}
+
+// ConfigError is a Config that can't be used. Transfer returns it before
+// attempting anything.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+func configErrorf(format string, v ...interface{}) error {
+	return &ConfigError{fmt.Errorf(format, v...)}
+}
+
+// withDefaults returns cfg with its defaults filled in, or a ConfigError.
+func (cfg Config) withDefaults() (Config, error) {
+	if cfg.Direction == "" {
+		cfg.Direction = S3ToGS
+	}
+	if cfg.Repair {
+		if cfg.Direction != S3ToGS {
+			return cfg, configErrorf("repairing only works from S3 to GS")
+		}
+		cfg.Verify = true
+	}
+	if cfg.VerifyContent {
+		cfg.Verify = true
+		if cfg.VerifySample == 0 {
+			cfg.VerifySample = 1
+		}
+	}
+	if cfg.VerifySample < 0 || cfg.VerifySample > 1 {
+		return cfg, configErrorf("verify sample %v isn't a fraction from 0 to 1", cfg.VerifySample)
+	}
+	if cfg.MaxObjectsCount == "" {
+		cfg.MaxObjectsCount = "considered"
+	}
+	if cfg.ProxyURL != "" {
+		var err error
+		if cfg.proxyURL, err = url.Parse(cfg.ProxyURL); err != nil || cfg.proxyURL.Host == "" {
+			return cfg, configErrorf("invalid proxy URL %q, want e.g. http://proxy:3128", cfg.ProxyURL)
+		}
+	}
+	if cfg.S3DualStack && cfg.S3Endpoint != "" {
+		return cfg, configErrorf("dual-stack endpoints are AWS's and can't be combined with a custom S3 endpoint")
+	}
+	if cfg.S3SSECustomerKey != "" {
+		if cfg.S3SSECustomerAlgorithm == "" {
+			cfg.S3SSECustomerAlgorithm = s3.ServerSideEncryptionAes256
+		}
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("an SSE-C key is for reading S3 objects and only works from S3 to GS")
+		case cfg.S3SSECustomerAlgorithm != s3.ServerSideEncryptionAes256:
+			return cfg, configErrorf("unknown SSE-C algorithm %q, S3 only supports %s", cfg.S3SSECustomerAlgorithm, s3.ServerSideEncryptionAes256)
+		case len(cfg.S3SSECustomerKey) != 32:
+			// Never shown, not even in part
+			return cfg, configErrorf("an AES256 SSE-C key must be 32 bytes, not %d", len(cfg.S3SSECustomerKey))
+		}
+	} else if cfg.S3SSECustomerAlgorithm != "" {
+		return cfg, configErrorf("an SSE-C algorithm needs a key")
+	}
+	if cfg.RestoreTier == "" {
+		cfg.RestoreTier = s3.TierStandard
+	}
+	if cfg.Conflict == "" {
+		cfg.Conflict = "compare"
+	}
+	if cfg.CompareMode == "" {
+		cfg.CompareMode = "both"
+	}
+	if cfg.Checksum == "" {
+		cfg.Checksum = "md5"
+	}
+	if cfg.MultipartFallback == "" {
+		cfg.MultipartFallback = "size"
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.CompareConcurrency < 1 {
+		cfg.CompareConcurrency = cfg.Concurrency
+	}
+	if cfg.DownloadConcurrency < 1 {
+		cfg.DownloadConcurrency = s3manager.DefaultDownloadConcurrency
+	}
+	if cfg.DownloadPartSize == 0 {
+		cfg.DownloadPartSize = s3manager.DefaultDownloadPartSize
+	}
+	if cfg.FileMode == 0 {
+		cfg.FileMode = defaultFileMode
+	}
+	if cfg.DirMode == 0 {
+		cfg.DirMode = defaultDirMode
+	}
+	if cfg.FileMode&^os.ModePerm != 0 || cfg.DirMode&^os.ModePerm != 0 {
+		return cfg, configErrorf("file mode %v and dir mode %v must be only permission bits", cfg.FileMode, cfg.DirMode)
+	}
+	if cfg.UseDisk && cfg.LocalDir == "" {
+		cfg.LocalDir = os.TempDir()
+	}
+	if cfg.ProgressInterval <= 0 {
+		cfg.ProgressInterval = defaultProgressInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger, _ = NewLogger(LevelInfo, "text")
+	}
+	cfg.StorageClass = strings.ToUpper(cfg.StorageClass)
+
+	switch {
+	case cfg.S3Bucket == "" && !cfg.UploadOnly:
+		return cfg, configErrorf("no S3 bucket")
+	case cfg.GSBucket == "" && cfg.List == nil:
+		return cfg, configErrorf("no GS bucket")
+	}
+	if len(cfg.ExtraGSBuckets) > 0 {
+		seen := map[string]bool{cfg.GSBucket: true}
+		for _, bucket := range cfg.ExtraGSBuckets {
+			if bucket == "" || seen[bucket] {
+				return cfg, configErrorf("GS bucket %q is empty or given twice", bucket)
+			}
+			seen[bucket] = true
+		}
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("only S3 can be copied to several GS buckets")
+		case cfg.Verify || cfg.Delete || cfg.Plan || cfg.List != nil:
+			return cfg, configErrorf("several GS buckets only work for a sync, not with verifying, deleting, a plan or listing")
+		}
+	}
+	if len(cfg.ExtraPrefixes) > 0 {
+		all := append([]Prefix{{cfg.S3Prefix, cfg.GSPrefix, cfg.StripPrefix}}, cfg.ExtraPrefixes...)
+		for i, p := range all {
+			for _, q := range all[:i] {
+				if strings.HasPrefix(p.S3, q.S3) || strings.HasPrefix(q.S3, p.S3) {
+					return cfg, configErrorf("S3 prefixes %q and %q overlap", q.S3, p.S3)
+				}
+			}
+		}
+		if cfg.KeysFile != "" || cfg.SQSQueueURL != "" || cfg.InventoryManifest != "" || cfg.S3VersionID != "" || cfg.UploadOnly {
+			return cfg, configErrorf("several S3 prefixes are each listed and can't be combined with another way of naming objects")
+		}
+	}
+	if cfg.List != nil {
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("only S3 can be listed")
+		case cfg.KeysFile != "" || cfg.SQSQueueURL != "" || cfg.InventoryManifest != "" || cfg.S3VersionID != "" || cfg.AllVersions:
+			return cfg, configErrorf("listing only works with an S3 listing, not another way of naming objects")
+		case cfg.Verify || cfg.Delete || cfg.DeleteSource || cfg.Plan:
+			return cfg, configErrorf("listing only lists and can't be combined with verifying, deleting or a plan")
+		}
+	}
+	// A diff needs both whole listings to find what's only on one side
+	if cfg.DiffReport != "" {
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("a diff report compares S3 with GS and only works from S3 to GS")
+		case cfg.KeysFile != "" || cfg.SQSQueueURL != "" || cfg.InventoryManifest != "" || cfg.S3VersionID != "" || cfg.AllVersions || cfg.UploadOnly || cfg.List != nil:
+			return cfg, configErrorf("a diff report lists both sides and can't be combined with another way of naming objects")
+		case cfg.Verify || cfg.Delete || cfg.DeleteSource || cfg.Plan:
+			return cfg, configErrorf("a diff report is read-only and can't be combined with verifying, deleting or a plan")
+		case cfg.MaxObjects > 0:
+			return cfg, configErrorf("a max objects limit lists only part of the source and can't be combined with a diff report")
+		case cfg.DisableDestinationListing || cfg.KeyRegex != "" || len(cfg.ExtraGSBuckets) > 0:
+			return cfg, configErrorf("a diff report compares with the listing of one GS bucket and can't be combined with disabling it, renaming by regex or several buckets")
+		}
+	}
+	if cfg.UploadOnly {
+		switch {
+		case cfg.LocalDir == "":
+			return cfg, configErrorf("uploading local files needs a local dir")
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("local files are only uploaded to GS")
+		case cfg.KeysFile != "" || cfg.SQSQueueURL != "" || cfg.InventoryManifest != "" || cfg.S3VersionID != "" || cfg.AllVersions || cfg.ListShards > 1 || cfg.List != nil:
+			return cfg, configErrorf("uploading local files walks the local dir and can't be combined with listing S3")
+		case cfg.Verify || cfg.Delete || cfg.DeleteSource || cfg.CopyTags || cfg.CopyACL || cfg.UseDisk:
+			return cfg, configErrorf("uploading local files can't be combined with verifying, deleting, copying S3 tags or ACLs, or staging on disk")
+		}
+		if info, err := os.Stat(cfg.LocalDir); err != nil || !info.IsDir() {
+			return cfg, configErrorf("local dir %q isn't a directory", cfg.LocalDir)
+		}
+	}
+	if cfg.GCPCredentialsFile != "" {
+		f, err := os.Open(cfg.GCPCredentialsFile)
+		if err != nil {
+			return cfg, configErrorf("GCP credentials file: %v", err)
+		}
+		f.Close()
+	}
+	switch cfg.Direction {
+	case S3ToGS, GSToS3:
+	default:
+		return cfg, configErrorf("unknown direction %q", cfg.Direction)
+	}
+	switch cfg.Checksum {
+	case "md5", "crc32c", "auto":
+	default:
+		return cfg, configErrorf("unknown checksum %q", cfg.Checksum)
+	}
+	switch cfg.CompareMode {
+	case "size", "hash", "both":
+	default:
+		return cfg, configErrorf("unknown compare mode %q", cfg.CompareMode)
+	}
+	switch cfg.Conflict {
+	case "compare", "skip", "overwrite", "newer":
+	default:
+		return cfg, configErrorf("unknown conflict policy %q", cfg.Conflict)
+	}
+	switch cfg.RestoreTier {
+	case s3.TierStandard, s3.TierBulk, s3.TierExpedited:
+	default:
+		return cfg, configErrorf("unknown restore tier %q", cfg.RestoreTier)
+	}
+	if cfg.RestoreDays < 0 {
+		return cfg, configErrorf("restore days can't be negative")
+	}
+	switch cfg.MultipartFallback {
+	case "size", "hash", "transfer":
+	default:
+		return cfg, configErrorf("unknown multipart fallback %q", cfg.MultipartFallback)
+	}
+	switch cfg.MaxObjectsCount {
+	case "considered", "transferred":
+	default:
+		return cfg, configErrorf("unknown max objects count %q", cfg.MaxObjectsCount)
+	}
+	if cfg.PredefinedACL != "" && !gsPredefinedACLs[cfg.PredefinedACL] {
+		return cfg, configErrorf("unknown predefined ACL %q", cfg.PredefinedACL)
+	}
+	if (cfg.CopyACL || cfg.PredefinedACL != "") && cfg.Direction != S3ToGS {
+		return cfg, configErrorf("ACLs are only set from S3 to GS")
+	}
+	if cfg.StorageClass != "" && !gsStorageClasses[cfg.StorageClass] {
+		return cfg, configErrorf("unknown storage class %q", cfg.StorageClass)
+	}
+	if err := patterns(cfg.Includes).validate(); err != nil {
+		return cfg, &ConfigError{err}
+	}
+	if err := patterns(cfg.Excludes).validate(); err != nil {
+		return cfg, &ConfigError{err}
+	}
+	if err := patterns(cfg.CompressIncludes).validate(); err != nil {
+		return cfg, &ConfigError{err}
+	}
+	if err := patterns(cfg.CompressTypes).validate(); err != nil {
+		return cfg, &ConfigError{err}
+	}
+	if cfg.Compress && cfg.Direction != S3ToGS {
+		return cfg, configErrorf("compressing only works from S3 to GS")
+	}
+	if len(cfg.MimeTypes) > 0 {
+		mimeTypes := make(map[string]string, len(cfg.MimeTypes))
+		for ext, contentType := range cfg.MimeTypes {
+			if contentType == "" || strings.Trim(ext, ".") == "" {
+				return cfg, configErrorf("invalid MIME type mapping %q=%q", ext, contentType)
+			}
+			mimeTypes["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = contentType
+		}
+		cfg.MimeTypes = mimeTypes
+	}
+	if cfg.KeyRegex != "" {
+		var err error
+		if cfg.keyRegex, err = regexp.Compile(cfg.KeyRegex); err != nil {
+			return cfg, configErrorf("invalid key regex: %v", err)
+		}
+		switch {
+		case cfg.Direction == GSToS3:
+			return cfg, configErrorf("a key regex only works from S3 to GS")
+		case cfg.Delete:
+			return cfg, configErrorf("a key regex can't be combined with deleting, as GS can't be listed by the rewritten names")
+		}
+	}
+	if cfg.MaxSize > 0 && cfg.MinSize > cfg.MaxSize {
+		return cfg, configErrorf("minimum size is larger than the maximum")
+	}
+	if cfg.DownloadPartSize < minPartSize {
+		return cfg, configErrorf("download part size must be at least %d", minPartSize)
+	}
+
+	if cfg.S3VersionID != "" || cfg.AllVersions {
+		switch {
+		case cfg.S3VersionID != "" && cfg.AllVersions:
+			return cfg, configErrorf("a version ID names one version and can't be combined with all versions")
+		case cfg.S3VersionID != "" && cfg.S3Prefix == "":
+			return cfg, configErrorf("a version ID needs the key as the S3 prefix")
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("S3 versions only work from S3 to GS")
+		case cfg.Verify:
+			return cfg, configErrorf("verifying compares only the latest versions and can't be combined with S3 versions")
+		case cfg.DeleteSource:
+			return cfg, configErrorf("deleting the source removes the latest version and can't be combined with S3 versions")
+		case cfg.KeysFile != "":
+			return cfg, configErrorf("a keys file names only latest versions and can't be combined with S3 versions")
+		}
+	}
+
+	if cfg.InventoryManifest != "" {
+		if _, _, err := parseS3URL(cfg.InventoryManifest); err != nil {
+			return cfg, &ConfigError{err}
+		}
+		switch {
+		case cfg.Direction != S3ToGS && !cfg.Verify:
+			return cfg, configErrorf("an S3 inventory lists the S3 side and only works from S3 to GS")
+		case cfg.KeysFile != "" || cfg.SQSQueueURL != "" || cfg.S3VersionID != "" || cfg.AllVersions || cfg.ListShards > 1:
+			return cfg, configErrorf("an S3 inventory replaces listing and can't be combined with another way of listing")
+		case cfg.Delete:
+			// Anything copied since the report would look extra
+			return cfg, configErrorf("an S3 inventory can be out of date and can't be combined with deleting")
+		}
+	}
+	if cfg.SQSQueueURL != "" {
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("S3 event notifications only work from S3 to GS")
+		case cfg.KeysFile != "" || cfg.S3VersionID != "" || cfg.AllVersions || cfg.ListShards > 1:
+			return cfg, configErrorf("an SQS queue replaces listing and can't be combined with another way of listing")
+		case cfg.Verify || cfg.Delete:
+			return cfg, configErrorf("an SQS queue names only new objects and can't be combined with verifying or deleting")
+		}
+	}
+	if cfg.ListShards > 1 && (cfg.KeysFile != "" || cfg.S3VersionID != "" || cfg.AllVersions || (cfg.Direction == GSToS3 && !cfg.Verify)) {
+		return cfg, configErrorf("listing shards only applies to listing the latest S3 objects")
+	}
+	if cfg.Plan && !cfg.DryRun {
+		return cfg, configErrorf("a plan is only kept for a dry run")
+	}
+
+	if cfg.DeleteSource {
+		switch {
+		case cfg.Direction != S3ToGS:
+			return cfg, configErrorf("deleting the source only works from S3 to GS")
+		case cfg.Verify:
+			return cfg, configErrorf("verifying is read-only and can't be combined with deleting the source")
+		}
+	}
+
+	// Delete needs the whole source listing to know what's extra
+	if cfg.Delete {
+		switch {
+		case cfg.Verify:
+			return cfg, configErrorf("verifying is read-only and can't be combined with deleting")
+		case cfg.KeysFile != "":
+			return cfg, configErrorf("a keys file names only part of the source and can't be combined with deleting")
+		case cfg.MaxObjects > 0:
+			return cfg, configErrorf("a max objects limit lists only part of the source and can't be combined with deleting")
+		}
+	}
+	return cfg, nil
+}
+
+// Validate reports, as a *ConfigError, why Transfer would reject cfg, or
+// nil if it describes a job that can be attempted.
+func (cfg Config) Validate() error {
+	_, err := cfg.withDefaults()
+	return err
+}
+
+// Transfer syncs the objects described by cfg. Objects that fail to sync
+// are counted in the Result rather than returned as an error; the error is
+// a *ConfigError for a bad cfg, the context's error if ctx was cancelled,
+// or why the clients couldn't be set up or the buckets listed.
+func Transfer(ctx context.Context, cfg Config) (Result, error) {
+	start := time.Now()
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return Result{}, err
+	}
+	c, err := newClients(ctx, cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.close()
+	return c.transfer(ctx, cfg, start)
+}
+
+// clients are the connections to the buckets, set up once per Transfer
+// and shared by the passes of Watch.
+type clients struct {
+	s3Client     s3Objects
+	s3Downloader objectDownloader
+	s3Uploader   objectUploader
+	sqs          sqsQueue
+	gsClient     *storage.Client
+	bucket       *storage.BucketHandle
+	extraBuckets []*storage.BucketHandle // Config.ExtraGSBuckets
+}
+
+// newClients sets up the clients for cfg, which has its defaults.
+func newClients(ctx context.Context, cfg Config) (*clients, error) {
+	// Set up AWS clients
+	// Without a profile the SDK's default chain applies: environment
+	// variables, the default shared profile, then the ECS task or EC2
+	// instance role.
+	httpClient := newHTTPClient(cfg.proxyURL, cfg.Concurrency+cfg.CompareConcurrency)
+	if cfg.TracerProvider != nil {
+		httpClient = tracedHTTPClient(httpClient, cfg.TracerProvider)
+	}
+	awsConfig := &aws.Config{HTTPClient: httpClient}
+	if cfg.AWSProfile != "" {
+		awsConfig.Credentials = credentials.NewSharedCredentials("", cfg.AWSProfile)
+	}
+	if cfg.AWSRoleARN != "" {
+		awsConfig.Credentials = assumeRole(awsConfig.Credentials, httpClient, cfg)
+	}
+	if cfg.S3Endpoint != "" {
+		awsConfig.Endpoint = aws.String(cfg.S3Endpoint)
+	}
+	if cfg.S3ForcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	if cfg.S3DualStack {
+		awsConfig.UseDualStack = aws.Bool(true)
+	}
+	switch {
+	case cfg.AWSMaxRetries > 0:
+		awsConfig.MaxRetries = aws.Int(cfg.AWSMaxRetries)
+	case cfg.AWSMaxRetries < 0:
+		awsConfig.MaxRetries = aws.Int(0)
+	}
+	region := cfg.AWSRegion
+	if region == "" && cfg.UploadOnly {
+		// S3 isn't used
+		region = defaultRegion
+	} else if region == "" {
+		region = detectBucketRegion(ctx, cfg.Logger, awsConfig, cfg.S3Bucket)
+	} else {
+		cfg.Logger.Debug(Event{Action: "region"}, "Using region", region, "for", cfg.S3Bucket)
+	}
+	awsSession := session.New(awsConfig.Copy().WithRegion(region))
+	if cfg.S3SSECustomerKey != "" {
+		// The downloader's client comes from the session too
+		awsSession.Handlers.Validate.PushFront(sseCustomerKey(cfg.S3SSECustomerAlgorithm, cfg.S3SSECustomerKey))
+	}
+	if cfg.S3RequesterPays {
+		awsSession.Handlers.Validate.PushFront(requesterPays)
+	}
+	s3Downloader := s3manager.NewDownloader(awsSession, func(d *s3manager.Downloader) {
+		d.Concurrency = cfg.DownloadConcurrency
+		d.PartSize = cfg.DownloadPartSize
+	})
+	var queue sqsQueue
+	if cfg.SQSQueueURL != "" {
+		// The queue is AWS's own, whatever Config.S3Endpoint says
+		sqsConfig := awsConfig.Copy()
+		sqsConfig.Endpoint = nil
+		sqsConfig.S3ForcePathStyle = nil
+		sqsConfig.UseDualStack = nil
+		queue = sqs.New(session.New(sqsConfig.WithRegion(sqsRegion(cfg.SQSQueueURL, region))))
+	}
+
+	c := &clients{
+		s3Client:     s3.New(awsSession),
+		s3Downloader: s3Downloader,
+		s3Uploader:   s3manager.NewUploader(awsSession),
+		sqs:          queue,
+	}
+	if cfg.List != nil {
+		return c, nil
+	}
+
+	// Set up GCP clients
+	var gsOptions []option.ClientOption
+	if cfg.GCPCredentialsFile != "" {
+		gsOptions = append(gsOptions, option.WithCredentialsFile(cfg.GCPCredentialsFile))
+	}
+	if cfg.TracerProvider != nil {
+		// httpClient traces the GS requests already
+		gsOptions = append(gsOptions, option.WithTelemetryDisabled())
+	}
+	gsClient, err := newGSClient(ctx, cfg.ConnectTimeout, httpClient, gsOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize GS: %w", err)
+	}
+	c.gsClient, c.bucket = gsClient, gsClient.Bucket(cfg.GSBucket)
+	if cfg.GSUserProject != "" {
+		c.bucket = c.bucket.UserProject(cfg.GSUserProject)
+	}
+	for _, name := range cfg.ExtraGSBuckets {
+		bucket := gsClient.Bucket(name)
+		if cfg.GSUserProject != "" {
+			bucket = bucket.UserProject(cfg.GSUserProject)
+		}
+		c.extraBuckets = append(c.extraBuckets, bucket)
+	}
+	return c, nil
+}
+
+func (c *clients) close() error {
+	if c.gsClient == nil {
+		return nil
+	}
+	return c.gsClient.Close()
+}
+
+// transfer is Transfer with c, from start.
+func (c *clients) transfer(ctx context.Context, cfg Config, start time.Time) (result Result, err error) {
+	s := &syncer{
+		cfg:          cfg,
+		log:          cfg.Logger,
+		ctx:          ctx,
+		s3Client:     c.s3Client,
+		s3Downloader: c.s3Downloader,
+		s3Uploader:   c.s3Uploader,
+		sqs:          c.sqs,
+		sourceKeys:   make(map[string]bool),
+		sample:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:         make(chan struct{}),
+		limit:        make(chan struct{}),
+		tracer:       newTracer(cfg.TracerProvider),
+	}
+	s.ctx, s.runSpan = s.startSpan(ctx, "run",
+		attribute.String("direction", cfg.Direction),
+		attribute.String("s3.bucket", cfg.S3Bucket),
+		attribute.String("gs.bucket", cfg.GSBucket))
+	defer func() {
+		s.runSpan.SetAttributes(
+			attribute.Int64("objects.listed", int64(result.Listed)),
+			attribute.Int64("objects.transferred", int64(result.Transferred)),
+			attribute.Int64("objects.failed", int64(result.Failed)),
+			attribute.Int64("bytes.transferred", int64(result.BytesTransferred)))
+		endSpan(s.runSpan, err)
+	}()
+	handles := append([]*storage.BucketHandle{c.bucket}, c.extraBuckets...)
+	buckets := append([]string{cfg.GSBucket}, cfg.ExtraGSBuckets...)
+	for i, handle := range handles {
+		d := &destination{bucket: buckets[i], base: gsBucket{handle, gsChunkSize(cfg.GSChunkSize)}, label: "GS"}
+		if len(handles) > 1 {
+			d.label = "gs://" + d.bucket
+		}
+		s.dests = append(s.dests, d)
+	}
+	prefixes := append([]Prefix{{cfg.S3Prefix, cfg.GSPrefix, cfg.StripPrefix}}, cfg.ExtraPrefixes...)
+	s.usePrefix(prefixes[0])
+	if cfg.BandwidthLimit > 0 {
+		s.bandwidth = newTokenBucket(cfg.BandwidthLimit)
+	}
+	if (cfg.CopyACL || cfg.PredefinedACL != "") && !cfg.DryRun && (!cfg.Verify || cfg.Repair) && cfg.DiffReport == "" {
+		for i, d := range s.dests {
+			attrs, err := handles[i].Attrs(ctx)
+			switch {
+			case err != nil:
+				s.log.Error(Event{Action: "warning", Err: err}, "Couldn't check", d.bucket, "for uniform bucket-level access:")
+			case attrs.UniformBucketLevelAccess.Enabled:
+				s.log.Error(Event{Action: "warning"}, d.bucket, "has uniform bucket-level access, so objects are uploaded without ACLs")
+				d.uniformAccess = true
+			}
+		}
+	}
+
+	if cfg.StateFile != "" && !cfg.Verify && cfg.List == nil && cfg.DiffReport == "" {
+		s.state, err = openState(cfg.StateFile, stateHeader{
+			Direction: cfg.Direction,
+			S3Bucket:  cfg.S3Bucket,
+			S3Prefix:  cfg.S3Prefix,
+			GSBucket:  cfg.GSBucket,
+
+			ExtraGSBuckets: strings.Join(cfg.ExtraGSBuckets, ","),
+			ExtraPrefixes:  prefixList(cfg.ExtraPrefixes),
+			GSPrefix:       cfg.GSPrefix,
+			StripPrefix:    cfg.StripPrefix,
+			KeyRegex:       cfg.KeyRegex,
+			KeyReplace:     cfg.KeyReplace,
+		}, !cfg.DisableResume, cfg.FileMode, s.log)
+		if err != nil {
+			return Result{}, &ConfigError{err}
+		}
+		defer s.state.Close()
+	}
+
+	if cfg.ReportFile != "" {
+		s.report, err = openReport(cfg.ReportFile, cfg.FileMode, s.log)
+		if err != nil {
+			return Result{}, &ConfigError{err}
+		}
+		defer s.report.Close()
+	}
+	if cfg.DiffReport != "" {
+		s.diff, err = openDiff(cfg.DiffReport, cfg.FileMode, s.log)
+		if err != nil {
+			return Result{}, &ConfigError{err}
+		}
+		defer s.diff.Close()
+	}
+	if cfg.Plan {
+		if s.report == nil {
+			s.report = &reportFile{log: s.log}
+		}
+		s.report.keepPlan = true
+	}
+
+	// Stop listing on Config.Stop or once ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-cfg.Stop:
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		s.stopListing()
+	}()
+
+	if cfg.Progress != nil {
+		defer s.startProgress(start)()
+	}
+
+	var numObjects, numDeleted int
+	for i, p := range prefixes {
+		if i > 0 && (s.stopped() || s.moreRemain) {
+			break
+		}
+		s.listedBefore = numObjects
+		n, deleted, err := s.syncPrefix(p, i == len(prefixes)-1)
+		numObjects += n
+		numDeleted += deleted
+		if ctx.Err() != nil {
+			result := s.result(numObjects)
+			result.Stopped = true
+			result.Elapsed = time.Since(start)
+			return result, ctx.Err()
+		}
+		if err != nil {
+			return s.result(numObjects), err
+		}
+	}
+
+	if cfg.VerifyContent {
+		s.logContentChecks()
+	}
+	result = s.result(numObjects)
+	result.Deleted = numDeleted
+	result.Stopped = s.stopped()
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// assumeRole returns credentials for cfg.AWSRoleARN, assumed with base
+// (the default chain if nil) through httpClient. The SDK assumes the role
+// again shortly before each session expires, so long runs keep going.
+func assumeRole(base *credentials.Credentials, httpClient *http.Client, cfg Config) *credentials.Credentials {
+	// STS is reached with the base credentials and the normal endpoint,
+	// never Config.S3Endpoint
+	stsRegion := cfg.AWSRegion
+	if stsRegion == "" {
+		stsRegion = defaultRegion
+	}
+	stsSession := session.New(&aws.Config{
+		Region:      aws.String(stsRegion),
+		Credentials: base,
+		HTTPClient:  httpClient,
+	})
+	return stscreds.NewCredentials(stsSession, cfg.AWSRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if cfg.AWSExternalID != "" {
+			p.ExternalID = aws.String(cfg.AWSExternalID)
+		}
+		p.ExpiryWindow = time.Minute
+	})
+}
+
+// sseCustomerKey returns a request handler adding the SSE-C key to every
+// read of an S3 object, which S3 refuses without it. The SDK sends it
+// base64 encoded, with its MD5.
+func sseCustomerKey(algorithm, key string) func(*request.Request) {
+	return func(r *request.Request) {
+		switch input := r.Params.(type) {
+		case *s3.GetObjectInput:
+			input.SSECustomerAlgorithm, input.SSECustomerKey = aws.String(algorithm), aws.String(key)
+		case *s3.HeadObjectInput:
+			input.SSECustomerAlgorithm, input.SSECustomerKey = aws.String(algorithm), aws.String(key)
+		}
+	}
+}
+
+// requesterPays is a request handler agreeing to pay for every request
+// on the S3 bucket that S3 would otherwise refuse with Requester Pays.
+func requesterPays(r *request.Request) {
+	payer := aws.String(s3.RequestPayerRequester)
+	switch input := r.Params.(type) {
+	case *s3.ListObjectsV2Input:
+		input.RequestPayer = payer
+	case *s3.ListObjectVersionsInput:
+		input.RequestPayer = payer
+	case *s3.HeadObjectInput:
+		input.RequestPayer = payer
+	case *s3.GetObjectInput:
+		input.RequestPayer = payer
+	case *s3.GetObjectAclInput:
+		input.RequestPayer = payer
+	case *s3.GetObjectTaggingInput:
+		input.RequestPayer = payer
+	case *s3.RestoreObjectInput:
+		input.RequestPayer = payer
+	case *s3.DeleteObjectInput:
+		input.RequestPayer = payer
+	}
+}
+
+// gsChunkSize is the storage.Writer ChunkSize for Config.GSChunkSize.
+func gsChunkSize(size int) int {
+	if size < 0 {
+		// A ChunkSize of 0 makes a single request
+		return 0
+	}
+	if size == 0 {
+		return googleapi.DefaultUploadChunkSize
+	}
+	return size
+}
+
+// newGSClient creates the GS client on httpClient, giving up after
+// timeout so that an unreachable metadata server or credentials endpoint
+// can't hang the run. The client keeps using ctx to refresh its
+// credentials, so ctx itself isn't given the deadline.
+func newGSClient(ctx context.Context, timeout time.Duration, httpClient *http.Client, opts ...option.ClientOption) (*storage.Client, error) {
+	create := func() (*storage.Client, error) {
+		authorized, err := newGSHTTPClient(ctx, httpClient, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewClient(ctx, option.WithHTTPClient(authorized))
+	}
+	if timeout <= 0 {
+		return create()
+	}
+	type client struct {
+		c   *storage.Client
+		err error
+	}
+	created := make(chan client, 1)
+	go func() {
+		c, err := create()
+		created <- client{c, err}
+	}()
+	var err error
+	select {
+	case c := <-created:
+		return c.c, c.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	// Close the client if it turns up after all
+	go func() {
+		if c := <-created; c.c != nil {
+			c.c.Close()
+		}
+	}()
+	return nil, err
+}
+
+// stopped reports whether stopListing has been called.
+func (s *syncer) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
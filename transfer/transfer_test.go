@@ -0,0 +1,93 @@
+package transfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// listBucketResult is an S3 listing of one object, key.
+const listBucketResult = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>bucket</Name><Prefix></Prefix><KeyCount>1</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>
+  <Contents><Key>key</Key><LastModified>2020-01-02T03:04:05.000Z</LastModified><ETag>"etag"</ETag><Size>3</Size><StorageClass>STANDARD</StorageClass></Contents>
+</ListBucketResult>`
+
+func TestS3EndpointPathStyle(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(listBucketResult))
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	var got []Listed
+	_, err := Transfer(context.Background(), Config{
+		S3Bucket:         "bucket",
+		S3Endpoint:       server.URL,
+		S3ForcePathStyle: true,
+		AWSRegion:        "us-east-1",
+		Logger:           testLogger{t},
+		List:             func(l Listed) { got = append(got, l) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Key != "key" {
+		t.Errorf("listed %+v, want key", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 {
+		t.Fatalf("the endpoint got %d requests, want 1", len(requests))
+	}
+	// Path style puts the bucket in the path rather than the host
+	r := requests[0]
+	if r.Host != strings.TrimPrefix(server.URL, "http://") || !strings.HasPrefix(r.URL.Path, "/bucket") {
+		t.Errorf("requested %s%s, want the bucket in the path", r.Host, r.URL.Path)
+	}
+}
+
+func TestS3EndpointConfig(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	for _, pathStyle := range []bool{false, true} {
+		cfg, err := Config{
+			S3Bucket:         "bucket",
+			S3Endpoint:       "https://storage.example.com",
+			S3ForcePathStyle: pathStyle,
+			AWSRegion:        "us-east-1",
+			Logger:           testLogger{t},
+			List:             func(Listed) {},
+		}.withDefaults()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newClients(context.Background(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := c.s3Client.(*s3.S3)
+		if got := aws.StringValue(client.Config.Endpoint); got != cfg.S3Endpoint {
+			t.Errorf("endpoint %q, want %q", got, cfg.S3Endpoint)
+		}
+		if got := aws.BoolValue(client.Config.S3ForcePathStyle); got != pathStyle {
+			t.Errorf("path style %v, want %v", got, pathStyle)
+		}
+		if got := client.Endpoint; got != cfg.S3Endpoint {
+			t.Errorf("client endpoint %q, want %q", got, cfg.S3Endpoint)
+		}
+	}
+}
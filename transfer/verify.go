@@ -0,0 +1,223 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// VerifyCounts tallies the outcomes of Config.Verify. Fields are
+// accessed atomically during a run.
+type VerifyCounts struct {
+	Matched    uint64
+	Mismatched uint64
+	Missing    uint64
+	Unverified uint64 // sizes match but there was no usable hash
+	Repaired   uint64 // of Mismatched, transferred again with Config.Repair
+
+	// With Config.VerifyContent, the objects sampled and hashed on both
+	// sides, and of those the ones whose bytes differ
+	ContentChecked    uint64
+	ContentMismatched uint64
+}
+
+// verifyObject compares key in S3 with its GS copy without transferring
+// anything, unless it differs with Config.Repair, when it returns the
+// repair for a transfer worker to run. Multipart objects, whose ETag
+// isn't an MD5, are only hashed with Config.MultipartFallback hash, and
+// the objects sampled by Config.VerifyContent are hashed on both sides.
+func (s *syncer) verifyObject(ctx context.Context, key *s3.Object) (func(worker int) error, error) {
+	gsAttrs, err := s.gsAttrs(ctx, *key.Key)
+	if err == storage.ErrObjectNotExist {
+		s.log.Info(Event{Action: "missing", Key: *key.Key}, "Missing from GS", *key.Key)
+		atomic.AddUint64(&s.verified.Missing, 1)
+		s.record(ctx, reportEntry{Key: *key.Key, Action: "missing", Size: *key.Size, Checksum: *key.ETag})
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var action, outcome string
+	var counter *uint64
+	if s.cfg.VerifyContent && s.sampled() {
+		action, outcome, counter, err = s.contentOutcome(ctx, key, gsAttrs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		action, outcome, counter = s.metadataOutcome(ctx, key, gsAttrs)
+	}
+	s.log.Info(Event{Action: action, Key: *key.Key, Bytes: *key.Size}, outcome, *key.Key)
+	atomic.AddUint64(counter, 1)
+	s.record(ctx, reportEntry{Key: *key.Key, Action: action, Reason: outcome, Size: *key.Size, Checksum: *key.ETag})
+	if action == "match" {
+		atomic.AddUint64(&s.numInSync, 1)
+	}
+	if !s.cfg.Repair || action != "mismatch" {
+		return nil, nil
+	}
+	if s.cfg.DryRun {
+		s.log.Info(Event{Action: "would-repair", Key: *key.Key, Bytes: *key.Size}, "Would download/upload", *key.Key)
+		s.record(ctx, reportEntry{Key: *key.Key, Action: "would-repair", Size: *key.Size, Checksum: *key.ETag})
+		return nil, nil
+	}
+	return func(worker int) error {
+		return s.repairObject(ctx, key, gsAttrs.Generation, worker)
+	}, nil
+}
+
+// metadataOutcome is how key compares with gsAttrs by their sizes and
+// hashes: the report action, the outcome to log and the count it adds
+// to. gsAttrs needs its metadata and encoding, which record the source
+// of a compressed copy or a stored source hash, as the GS index keeps.
+func (s *syncer) metadataOutcome(ctx context.Context, key *s3.Object, gsAttrs *storage.ObjectAttrs) (action, outcome string, counter *uint64) {
+	s3MD5 := strings.Replace(*key.ETag, "\"", "", -1)
+	comparableMD5 := !isMultipartETag(s3MD5) && len(gsAttrs.MD5) > 0
+
+	action, outcome, counter = "match", "Matches", &s.verified.Matched
+	switch {
+	case isCompressedCopy(gsAttrs) && compressedCopyMatches(*key.ETag, *key.Size, gsAttrs):
+		outcome = "Compressed copy of this source"
+	case isCompressedCopy(gsAttrs):
+		action, outcome, counter = "mismatch", "Compressed copy of a different source", &s.verified.Mismatched
+	case *key.Size != gsAttrs.Size:
+		action, outcome, counter = "mismatch", "Size differs", &s.verified.Mismatched
+	case comparableMD5 && !strings.EqualFold(s3MD5, hex.EncodeToString(gsAttrs.MD5)):
+		action, outcome, counter = "mismatch", "Hash differs", &s.verified.Mismatched
+	case comparableMD5:
+	case storedHashMatches(*key.ETag, gsAttrs):
+		outcome = "Stored source hash matches"
+	case s.cfg.MultipartFallback == "hash":
+		if !s.contentMatches(ctx, *key.Key, "", gsAttrs) {
+			action, outcome, counter = "mismatch", "Content hash differs", &s.verified.Mismatched
+		}
+	default:
+		action, outcome, counter = "unverified", "Size matches, no usable hash", &s.verified.Unverified
+	}
+	return action, outcome, counter
+}
+
+// sampled reports whether to check the content of the next object, for
+// Config.VerifySample.
+func (s *syncer) sampled() bool {
+	if s.cfg.VerifySample >= 1 {
+		return true
+	}
+	s.sampleMu.Lock()
+	defer s.sampleMu.Unlock()
+	return s.sample.Float64() < s.cfg.VerifySample
+}
+
+// contentOutcome is metadataOutcome for Config.VerifyContent: it
+// downloads key from S3 and reads its GS copy at the same time, and the
+// sizes, MD5s and CRC32Cs of the bytes themselves decide. A compressed
+// copy is decompressed first.
+func (s *syncer) contentOutcome(ctx context.Context, key *s3.Object, gsAttrs *storage.ObjectAttrs) (action, outcome string, counter *uint64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	gsHash, gsErr := newContentHash(), make(chan error, 1)
+	go func() {
+		gsErr <- s.hashGS(ctx, *key.Key, isCompressedCopy(gsAttrs), gsHash)
+	}()
+	s3Hash := newContentHash()
+	if err := s.hashS3(ctx, *key.Key, s3Hash); err != nil {
+		cancel()
+		<-gsErr
+		return "", "", nil, err
+	}
+	if err := <-gsErr; err != nil {
+		return "", "", nil, err
+	}
+
+	atomic.AddUint64(&s.verified.ContentChecked, 1)
+	if s3Hash.size != gsHash.size || !bytes.Equal(s3Hash.md5.Sum(nil), gsHash.md5.Sum(nil)) ||
+		s3Hash.crc32c.Sum32() != gsHash.crc32c.Sum32() {
+		atomic.AddUint64(&s.verified.ContentMismatched, 1)
+		return "mismatch", "Content differs", &s.verified.Mismatched, nil
+	}
+	return "match", "Content matches", &s.verified.Matched, nil
+}
+
+// hashS3 downloads key from S3 into hasher.
+func (s *syncer) hashS3(ctx context.Context, key string, hasher *contentHash) error {
+	s3Object, err := s.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("downloading from S3: %w", err)
+	}
+	defer s3Object.Body.Close()
+	if _, err := io.Copy(hasher, s.throttle(s3Object.Body)); err != nil {
+		return fmt.Errorf("downloading from S3: %w", err)
+	}
+	return nil
+}
+
+// hashGS reads key from GS into hasher, decompressed if it's a
+// compressed copy.
+func (s *syncer) hashGS(ctx context.Context, key string, compressed bool, hasher *contentHash) error {
+	r, err := s.dests[0].gs.NewReader(ctx, key)
+	if err != nil {
+		return fmt.Errorf("reading from GS: %w", err)
+	}
+	defer r.Close()
+	var content io.Reader = s.throttle(r)
+	if compressed {
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return fmt.Errorf("decompressing from GS: %w", err)
+		}
+		defer gz.Close()
+		content = gz
+	}
+	if _, err := io.Copy(hasher, content); err != nil {
+		return fmt.Errorf("reading from GS: %w", err)
+	}
+	return nil
+}
+
+// logContentChecks logs how the objects sampled by Config.VerifyContent
+// fared, as a pass rate.
+func (s *syncer) logContentChecks() {
+	checked := atomic.LoadUint64(&s.verified.ContentChecked)
+	failed := atomic.LoadUint64(&s.verified.ContentMismatched)
+	if checked == 0 {
+		s.log.Info(Event{Action: "content-check"}, "No objects were sampled for a content check")
+		return
+	}
+	passed := checked - failed
+	s.log.Info(Event{Action: "content-check"}, "Content checked", checked, "sampled objects:", passed, "passed,",
+		failed, "failed, a pass rate of", fmt.Sprintf("%.2f%%", float64(passed)*100/float64(checked)))
+}
+
+// repairObject transfers key again, over the differing generation in GS,
+// as syncObject would.
+func (s *syncer) repairObject(ctx context.Context, key *s3.Object, generation int64, worker int) error {
+	start := time.Now()
+	t := &target{destination: s.dests[0], generation: generation}
+	err := s.retry(*key.Key, func() error {
+		return s.transferObject(ctx, key, "", s.localPath(worker, *key.Key), []*target{t})
+	})
+	if err != nil {
+		return fmt.Errorf("repairing: %w", err)
+	}
+	elapsed := time.Since(start)
+	atomic.AddUint64(&s.verified.Repaired, 1)
+	s.countTransfer(*key.Size, elapsed)
+	s.log.Info(Event{Action: "repaired", Key: *key.Key, Bytes: *key.Size, Duration: elapsed},
+		"Repaired", *key.Key, "in", elapsed)
+	s.record(ctx, reportEntry{Key: *key.Key, Action: "repaired", Size: *key.Size, Checksum: *key.ETag})
+	return nil
+}
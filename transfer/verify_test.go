@@ -0,0 +1,95 @@
+package transfer
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestVerifyOutcomes(t *testing.T) {
+	compressible := strings.Repeat("compressible ", 100)
+	for _, tc := range []struct {
+		name      string
+		s3        string
+		multipart bool    // whether S3 has a multipart ETag
+		sync      *Config // makes the GS copy if set
+		gs        string  // the GS copy otherwise
+		change    string  // put in S3 after the sync if set
+		want      func(VerifyCounts) uint64
+	}{
+		{name: "matches", s3: "alpha", gs: "alpha", want: matched},
+		{name: "size differs", s3: "alpha", gs: "alphabet", want: mismatched},
+		{name: "hash differs", s3: "alpha", gs: "alpah", want: mismatched},
+		{name: "compressed copy of this source", s3: compressible, sync: &Config{Compress: true}, want: matched},
+		{name: "compressed copy of another source", s3: compressible, sync: &Config{Compress: true}, change: compressible + "more", want: mismatched},
+		{name: "stored source hash", s3: "in parts", multipart: true, sync: &Config{StoreSourceMD5: true}, want: matched},
+		{name: "multipart without a stored hash", s3: "in parts", multipart: true, gs: "in parts", want: unverified},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, dst := newFakeS3(), newFakeGS()
+			put := func(data string) {
+				o := src.put("key", data, modified)
+				if tc.multipart {
+					o.etag = multipartETag(data, 2)
+				}
+			}
+			put(tc.s3)
+			if tc.sync != nil {
+				mustSync(t, *tc.sync, src, dst)
+			} else {
+				dst.put("key", tc.gs, storage.ObjectAttrs{})
+			}
+			if tc.change != "" {
+				put(tc.change)
+			}
+
+			result := mustSync(t, Config{Verify: true}, src, dst)
+			if tc.want(result.Verified) != 1 {
+				t.Errorf("verified %+v, want %s counted", result.Verified, tc.name)
+			}
+		})
+	}
+}
+
+func matched(c VerifyCounts) uint64    { return c.Matched }
+func mismatched(c VerifyCounts) uint64 { return c.Mismatched }
+func unverified(c VerifyCounts) uint64 { return c.Unverified }
+
+func TestRepair(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	compressible := strings.Repeat("compressible ", 100)
+	src.put("compressed.txt", compressible, modified)
+	src.put("stale.txt", "fresh", modified)
+	mustSync(t, Config{Compress: true, CompressIncludes: []string{"compressed.*"}}, src, dst)
+	dst.put("stale.txt", "stale", storage.ObjectAttrs{})
+	generation := dst.get("compressed.txt").attrs.Generation
+
+	result := mustSync(t, Config{Verify: true, Repair: true}, src, dst)
+	if result.Verified.Matched != 1 || result.Verified.Mismatched != 1 || result.Verified.Repaired != 1 {
+		t.Errorf("verified %+v, want the compressed copy matched and the stale one repaired", result.Verified)
+	}
+	if got := dst.get("compressed.txt").attrs.Generation; got != generation {
+		t.Errorf("the correct compressed copy was rewritten, at generation %d, not %d", got, generation)
+	}
+	if got := string(dst.get("stale.txt").data); got != "fresh" {
+		t.Errorf("stale.txt is %q after repair, want %q", got, "fresh")
+	}
+}
+
+func TestVerifyContent(t *testing.T) {
+	src, dst := newFakeS3(), newFakeGS()
+	src.put("compressed.txt", strings.Repeat("compressible ", 100), modified)
+	src.put("tampered.txt", "original", modified)
+	mustSync(t, Config{Compress: true, CompressIncludes: []string{"compressed.*"}}, src, dst)
+	// Same size and recorded hash, different bytes
+	md5 := dst.get("tampered.txt").attrs.MD5
+	dst.put("tampered.txt", "0riginal", storage.ObjectAttrs{})
+	dst.get("tampered.txt").attrs.MD5 = md5
+
+	result := mustSync(t, Config{VerifyContent: true}, src, dst)
+	want := VerifyCounts{Matched: 1, Mismatched: 1, ContentChecked: 2, ContentMismatched: 1}
+	if result.Verified != want {
+		t.Errorf("verified %+v, want %+v", result.Verified, want)
+	}
+}
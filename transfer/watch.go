@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Watch keeps the buckets in sync: it runs a Transfer of cfg, waits
+// interval from its start, and runs another, reusing the clients, until
+// ctx is cancelled or Config.Stop closed. A stop lets the pass underway
+// finish, and no more start. pass is called with the outcome of each pass
+// as Transfer would return it.
+//
+// A failed pass, e.g. one that couldn't list a bucket, doesn't end the
+// watch; only a *ConfigError does. With Config.StateFile every pass after
+// the first resumes from it, so only objects changed since are compared
+// in full. Config.ReportFile is rewritten by each pass.
+func Watch(ctx context.Context, cfg Config, interval time.Duration, pass func(Result, error)) error {
+	if interval <= 0 {
+		return configErrorf("watch interval must be positive")
+	}
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return err
+	}
+	c, err := newClients(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	for {
+		start := time.Now()
+		result, err := c.transfer(ctx, cfg, start)
+		pass(result, err)
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			return err
+		}
+		cfg.DisableResume = false
+
+		next := time.NewTimer(interval - time.Since(start))
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			return nil
+		case <-cfg.Stop:
+			next.Stop()
+			return nil
+		case <-next.C:
+		}
+	}
+}
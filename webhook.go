@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/julianvmodesto/S3toGS/transfer"
+)
+
+// webhookTimeout bounds the whole webhook request, so a slow endpoint
+// can't hold up the exit.
+const webhookTimeout = 10 * time.Second
+
+// maxWebhookFailures caps the failures listed in a notification.
+const maxWebhookFailures = 50
+
+// runOutcome is what the webhook reports, set once the run is over.
+type runOutcome struct {
+	result transfer.Result
+	err    error
+}
+
+// finished is the run to notify -webhookUrl of on exit, or nil.
+var finished *runOutcome
+
+// webhookPayload is the JSON posted with -webhookFormat json.
+type webhookPayload struct {
+	Status   string            `json:"status"`
+	ExitCode int               `json:"exitCode"`
+	Source   string            `json:"source"`
+	Dest     string            `json:"destination"`
+	Totals   map[string]uint64 `json:"totals"`
+	Duration float64           `json:"durationSeconds"`
+	Failures []webhookFailure  `json:"failures,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type webhookFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// notify posts the outcome of the run, which exits with code, to
+// -webhookUrl. A failure to notify is logged and otherwise ignored.
+func notify(code int) {
+	if finished == nil || *webhookURL == "" {
+		return
+	}
+	body, err := webhookBody(code, *finished)
+	if err == nil {
+		err = postWebhook(*webhookURL, body)
+	}
+	if err != nil {
+		logger.Error(transfer.Event{Action: "warning", Err: err}, "Couldn't notify", *webhookURL+":")
+	}
+}
+
+// webhookBody is the request body for -webhookFormat.
+func webhookBody(code int, run runOutcome) ([]byte, error) {
+	status := "success"
+	if code != 0 {
+		status = exitReasons[code]
+	}
+	source, dest := endpoints()
+	totals := run.result.Totals()
+
+	if *webhookFormat == "slack" {
+		var text strings.Builder
+		fmt.Fprintf(&text, "S3toGS %s to %s: %s\n", source, dest, status)
+		if run.err != nil {
+			fmt.Fprintf(&text, "Error: %v\n", run.err)
+		}
+		for _, t := range totals {
+			switch {
+			case t.Bytes:
+				fmt.Fprintf(&text, "%s: %s\n", t.Name, bytefmt.ByteSize(t.Value))
+			case t.Duration:
+				fmt.Fprintf(&text, "%s: %s\n", t.Name, time.Duration(t.Value).Round(time.Second))
+			default:
+				fmt.Fprintf(&text, "%s: %d\n", t.Name, t.Value)
+			}
+		}
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{text.String()})
+	}
+
+	payload := webhookPayload{
+		Status:   status,
+		ExitCode: code,
+		Source:   source,
+		Dest:     dest,
+		Totals:   make(map[string]uint64),
+		Duration: run.result.Elapsed.Seconds(),
+	}
+	for _, t := range totals {
+		if !t.Duration {
+			payload.Totals[t.JSONName()] = t.Value
+		}
+	}
+	for i, f := range run.result.Failures {
+		if i == maxWebhookFailures {
+			break
+		}
+		payload.Failures = append(payload.Failures, webhookFailure{f.Key, f.Err.Error()})
+	}
+	if run.err != nil {
+		payload.Error = run.err.Error()
+	}
+	return json.Marshal(payload)
+}
+
+func postWebhook(url string, body []byte) error {
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}